@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Known peer addresses, loosely following Bitcoin Core's addrman.
+// Addresses heard from others go into "new" buckets picked by the network group
+// of the peer that told us, so one source can only fill a small part of the table.
+// Addresses we managed to connect to move to "tried" buckets.
+const (
+	NewBucketCount   = 256
+	TriedBucketCount = 64
+	BucketSize       = 64
+	// buckets one source group can reach
+	newBucketsPerSource  = 32
+	triedBucketsPerGroup = 8
+)
+
+const (
+	// addresses not seen for this long are forgotten first
+	AddrHorizon = 30 * 24 * time.Hour
+	// give up on addresses that never worked after this many attempts
+	MaxAddrRetries = 3
+	// an address is not dialed again sooner than this
+	AddrRetryInterval = time.Minute
+)
+
+type KnownAddress struct {
+	Addr string `json:"addr"`
+	// group of the peer that told us about it
+	Source      string `json:"source"`
+	LastSeen    int64  `json:"lastseen"`
+	LastTried   int64  `json:"lasttried,omitempty"`
+	LastSuccess int64  `json:"lastsuccess,omitempty"`
+	// failed attempts since the last success
+	Attempts  int  `json:"attempts,omitempty"`
+	Successes int  `json:"successes,omitempty"`
+	Tried     bool `json:"tried"`
+	bucket    int
+}
+
+type AddrManager struct {
+	mtx sync.Mutex
+	// where Save writes, empty to keep the addresses in memory
+	path  string
+	key   [32]byte
+	addrs map[string]*KnownAddress
+	news  [NewBucketCount]map[string]void
+	tried [TriedBucketCount]map[string]void
+}
+
+type addrFile struct {
+	Key   string          `json:"key"`
+	Addrs []*KnownAddress `json:"addrs"`
+}
+
+func NewAddrManager() *AddrManager {
+	a := &AddrManager{addrs: make(map[string]*KnownAddress)}
+	rand.Read(a.key[:])
+	for i := range a.news {
+		a.news[i] = make(map[string]void)
+	}
+	for i := range a.tried {
+		a.tried[i] = make(map[string]void)
+	}
+	return a
+}
+
+// IPv4 addresses are grouped by /16, IPv6 by /32
+func addrGroup(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4[:2])
+	}
+	if len(ip) == net.IPv6len {
+		return string(ip[:4])
+	}
+	return ""
+}
+
+func (a *AddrManager) hash(parts ...string) uint64 {
+	h := sha256.New()
+	h.Write(a.key[:])
+	for _, p := range parts {
+		var l [4]byte
+		binary.LittleEndian.PutUint32(l[:], uint32(len(p)))
+		h.Write(l[:])
+		h.Write([]byte(p))
+	}
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+func splitIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (a *AddrManager) newBucket(addr string, source string) int {
+	group := addrGroup(splitIP(addr))
+	i := a.hash(group, source) % newBucketsPerSource
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], i)
+	return int(a.hash(source, string(b[:])) % NewBucketCount)
+}
+
+func (a *AddrManager) triedBucket(addr string) int {
+	i := a.hash(addr) % triedBucketsPerGroup
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], i)
+	return int(a.hash(addrGroup(splitIP(addr)), string(b[:])) % TriedBucketCount)
+}
+
+func (ka *KnownAddress) isTerrible(now time.Time) bool {
+	if ka.LastTried > now.Add(-AddrRetryInterval).Unix() {
+		// just tried, keep it for now
+		return false
+	}
+	if ka.LastSeen < now.Add(-AddrHorizon).Unix() {
+		return true
+	}
+	if ka.LastSuccess == 0 && ka.Attempts >= MaxAddrRetries {
+		return true
+	}
+	return ka.Attempts >= 10 && ka.LastSuccess < now.Add(-7*24*time.Hour).Unix()
+}
+
+// The entry of a full bucket that should go first
+func (a *AddrManager) worst(bucket map[string]void, now time.Time) (worst *KnownAddress) {
+	for addr := range bucket {
+		ka := a.addrs[addr]
+		if ka.isTerrible(now) {
+			return ka
+		}
+		if worst == nil || ka.LastSeen < worst.LastSeen {
+			worst = ka
+		}
+	}
+	return
+}
+
+func (a *AddrManager) remove(ka *KnownAddress) {
+	if ka.Tried {
+		delete(a.tried[ka.bucket], ka.Addr)
+	} else {
+		delete(a.news[ka.bucket], ka.Addr)
+	}
+	delete(a.addrs, ka.Addr)
+}
+
+func (a *AddrManager) insertNew(ka *KnownAddress, now time.Time) {
+	ka.Tried = false
+	ka.bucket = a.newBucket(ka.Addr, ka.Source)
+	bucket := a.news[ka.bucket]
+	if len(bucket) >= BucketSize {
+		a.remove(a.worst(bucket, now))
+	}
+	bucket[ka.Addr] = void_null
+	a.addrs[ka.Addr] = ka
+}
+
+// Remember an address heard from source, returns whether it was new
+func (a *AddrManager) Add(addr *net.TCPAddr, source net.IP, seen time.Time) bool {
+	if addr.IP == nil || addr.IP.IsUnspecified() || addr.Port == 0 {
+		return false
+	}
+	key := addr.String()
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if ka, ok := a.addrs[key]; ok {
+		if seen.Unix() > ka.LastSeen {
+			ka.LastSeen = seen.Unix()
+		}
+		return false
+	}
+	ka := &KnownAddress{Addr: key, Source: hex.EncodeToString([]byte(addrGroup(source))), LastSeen: seen.Unix()}
+	a.insertNew(ka, utils.Now())
+	return true
+}
+
+// Record a connection attempt before dialing
+func (a *AddrManager) Attempt(addr string) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if ka, ok := a.addrs[addr]; ok {
+		ka.LastTried = utils.Now().Unix()
+		ka.Attempts++
+	}
+}
+
+// Record a successful connection, the address moves to the tried table
+func (a *AddrManager) Good(addr *net.TCPAddr) {
+	now := utils.Now()
+	key := addr.String()
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	ka, ok := a.addrs[key]
+	if !ok {
+		ka = &KnownAddress{Addr: key, Source: hex.EncodeToString([]byte(addrGroup(addr.IP)))}
+		a.insertNew(ka, now)
+	}
+	ka.LastSeen = now.Unix()
+	ka.LastTried = now.Unix()
+	ka.LastSuccess = now.Unix()
+	ka.Attempts = 0
+	ka.Successes++
+	if ka.Tried {
+		return
+	}
+	delete(a.news[ka.bucket], key)
+	ka.Tried = true
+	ka.bucket = a.triedBucket(key)
+	bucket := a.tried[ka.bucket]
+	if len(bucket) >= BucketSize {
+		// the oldest success goes back to the new table
+		var oldest *KnownAddress
+		for other := range bucket {
+			if oldest == nil || a.addrs[other].LastSuccess < oldest.LastSuccess {
+				oldest = a.addrs[other]
+			}
+		}
+		delete(bucket, oldest.Addr)
+		a.insertNew(oldest, now)
+	}
+	bucket[key] = void_null
+}
+
+// Pick an address to connect to, skipping those skip returns true for
+func (a *AddrManager) Select(skip func(addr string) bool) (string, bool) {
+	now := utils.Now()
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	// only look at buckets that have something
+	var news, tried []map[string]void
+	for _, b := range a.news {
+		if len(b) > 0 {
+			news = append(news, b)
+		}
+	}
+	for _, b := range a.tried {
+		if len(b) > 0 {
+			tried = append(tried, b)
+		}
+	}
+	if len(news) == 0 && len(tried) == 0 {
+		return "", false
+	}
+	for i := 0; i < 100; i++ {
+		// tried and new addresses are equally likely when both exist
+		var bucket map[string]void
+		if len(news) == 0 || (len(tried) > 0 && mrand.Intn(2) == 0) {
+			bucket = tried[mrand.Intn(len(tried))]
+		} else {
+			bucket = news[mrand.Intn(len(news))]
+		}
+		n := mrand.Intn(len(bucket))
+		for addr := range bucket {
+			if n > 0 {
+				n--
+				continue
+			}
+			ka := a.addrs[addr]
+			if ka.LastTried > now.Add(-AddrRetryInterval).Unix() || skip(addr) {
+				break
+			}
+			// addresses that failed recently are less likely
+			chance := 1.0
+			for j := 0; j < ka.Attempts && j < 8; j++ {
+				chance *= 0.66
+			}
+			if mrand.Float64() < chance {
+				return addr, true
+			}
+			break
+		}
+	}
+	return "", false
+}
+
+// A random sample of usable addresses, for answering getaddr
+func (a *AddrManager) GetAddresses(max int) (ret []KnownAddress) {
+	now := utils.Now()
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for _, ka := range a.addrs {
+		if !ka.isTerrible(now) {
+			ret = append(ret, *ka)
+		}
+	}
+	mrand.Shuffle(len(ret), func(i, j int) {
+		ret[i], ret[j] = ret[j], ret[i]
+	})
+	if len(ret) > max {
+		ret = ret[:max]
+	}
+	return
+}
+
+func (a *AddrManager) Size() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return len(a.addrs)
+}
+
+// Read addresses saved earlier, and keep saving to the same file.
+// A missing file is not an error.
+func (a *AddrManager) Load(path string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var f addrFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return err
+	}
+	key, err := hex.DecodeString(f.Key)
+	if err == nil && len(key) == len(a.key) {
+		copy(a.key[:], key)
+	}
+	now := utils.Now()
+	for _, ka := range f.Addrs {
+		if splitIP(ka.Addr) == nil {
+			continue
+		}
+		if old, ok := a.addrs[ka.Addr]; ok {
+			a.remove(old)
+		}
+		tried := ka.Tried
+		a.insertNew(ka, now)
+		if tried {
+			delete(a.news[ka.bucket], ka.Addr)
+			ka.Tried = true
+			ka.bucket = a.triedBucket(ka.Addr)
+			if len(a.tried[ka.bucket]) < BucketSize {
+				a.tried[ka.bucket][ka.Addr] = void_null
+			} else {
+				a.insertNew(ka, now)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *AddrManager) Save() error {
+	a.mtx.Lock()
+	if a.path == "" {
+		a.mtx.Unlock()
+		return nil
+	}
+	f := addrFile{Key: hex.EncodeToString(a.key[:])}
+	for _, ka := range a.addrs {
+		f.Addrs = append(f.Addrs, ka)
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	path := a.path
+	a.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	// replace the file in one step so a crash cannot leave half of it
+	tmp := path + ".new"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
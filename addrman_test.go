@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sshockwave/bitebi/p2p"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+func TestAddrManager(t *testing.T) {
+	a := NewAddrManager()
+	now := utils.Now()
+	source := net.ParseIP("10.0.0.1")
+	// one source sending addresses from many groups only fills a few buckets
+	for i := 0; i < 5000; i++ {
+		addr := net.TCPAddr{IP: net.IPv4(byte(i>>8)+1, byte(i), 0, 1), Port: 8333}
+		a.Add(&addr, source, now)
+	}
+	if n := a.Size(); n > newBucketsPerSource*BucketSize {
+		t.Fatalf("A single source should fill at most %v entries, %v found", newBucketsPerSource*BucketSize, n)
+	}
+	good := net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 8333}
+	if !a.Add(&good, net.ParseIP("10.1.0.1"), now) || a.Add(&good, source, now) {
+		t.Fatalf("Only the first Add of an address should report it as new")
+	}
+	a.Good(&good)
+	if _, ok := a.Select(func(addr string) bool { return true }); ok {
+		t.Fatalf("Skipped addresses should not be selected")
+	}
+	addr, ok := a.Select(func(addr string) bool { return false })
+	if !ok {
+		t.Fatalf("An address should be selected")
+	}
+	a.Attempt(addr)
+
+	path := filepath.Join(t.TempDir(), "peers.json")
+	a.path = path
+	if err := a.Save(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	b := NewAddrManager()
+	if err := b.Load(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if b.Size() != a.Size() {
+		t.Fatalf("Expect %v addresses after loading, %v found", a.Size(), b.Size())
+	}
+	ka := b.addrs[good.String()]
+	if ka == nil || !ka.Tried || ka.Successes != 1 {
+		t.Fatalf("Unexpected entry %+v", ka)
+	}
+	if _, ok := b.tried[ka.bucket][ka.Addr]; !ok {
+		t.Fatalf("Tried addresses should be put back in the tried table")
+	}
+}
+
+func TestOutboundConnections(t *testing.T) {
+	interval := ConnectInterval
+	ConnectInterval = 20 * time.Millisecond
+	defer func() { ConnectInterval = interval }()
+	newPeer := func() *Peer {
+		var chain BlockChain
+		var wallet Wallet
+		wallet.Init(&chain)
+		chain.init(&wallet)
+		peer, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return peer
+	}
+	a, b := newPeer(), newPeer()
+	defer a.ln.Close()
+	defer b.ln.Close()
+	addr := ConnectionToAddr(b.ln.Addr())
+	a.Addrs.Add(&addr, addr.IP, utils.Now())
+	// nothing listens here
+	dead := net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	a.Addrs.Add(&dead, addr.IP, utils.Now())
+	a.SetLimits(ConnLimits{MaxOutbound: 1})
+	deadline := time.Now().Add(10 * time.Second)
+	for a.outboundCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("No outbound connection was made")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	info := a.GetPeerInfo()
+	if len(info) != 1 || info[0].Addr.String() != addr.String() {
+		t.Fatalf("Unexpected peers %v", info)
+	}
+	ka := a.Addrs.GetAddresses(10)
+	if len(ka) != 2 {
+		t.Fatalf("Expect 2 known addresses, found %v", fmt.Sprint(ka))
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Peers reaching this score are banned
+const BanThreshold = 100
+
+var DefaultBanTime = 24 * time.Hour
+
+// Scores added for each kind of misbehavior
+const (
+	scoreInvalidBlock      = 100
+	scoreBadHeader         = 100
+	scoreMalformed         = 20
+	scoreBadChecksum       = 10
+	scoreUnexpectedPayload = 10
+)
+
+var errBanned = errors.New("The address is banned.")
+
+// Returned by message handlers when the peer broke the protocol
+type misbehavior struct {
+	score  int
+	reason string
+}
+
+func (m *misbehavior) Error() string {
+	return m.reason
+}
+
+// Decode a payload, the peer is blamed if it cannot be read
+func decodePayload(command string, data []byte, msg utils.BinaryReadable) error {
+	err := msg.LoadBuffer(utils.NewBufReader(bytes.NewBuffer(data)))
+	if err != nil {
+		return &misbehavior{scoreMalformed, fmt.Sprintf("malformed %v: %v", command, err)}
+	}
+	return nil
+}
+
+// Add to the misbehavior score of a connection, banning it at BanThreshold.
+// Whitelisted peers are only disconnected.
+func (c *PeerConnection) Misbehaving(score int, reason string) {
+	c.mtx.Lock()
+	c.banScore += score
+	total := c.banScore
+	c.mtx.Unlock()
+	addr := ConnectionToAddr(c.Conn.RemoteAddr())
+	netLog.Warn("Peer misbehaving", "addr", addr.String(), "reason", reason, "score", total)
+	if total < BanThreshold {
+		return
+	}
+	if !c.peer.Bans.IsWhitelisted(addr.IP) {
+		c.peer.Ban(singleIP(addr.IP), DefaultBanTime, reason)
+		return
+	}
+	netLog.Info("Disconnecting misbehaving peer", "addr", addr.String())
+	c.Conn.Close()
+}
+
+type BanEntry struct {
+	Subnet string `json:"subnet"`
+	// unix times
+	Created int64  `json:"created"`
+	Until   int64  `json:"until"`
+	Reason  string `json:"reason"`
+	ipnet   *net.IPNet
+}
+
+// Banned subnets, saved to a file on every change
+type BanList struct {
+	mtx  sync.Mutex
+	path string
+	bans map[string]*BanEntry
+	// never banned automatically, like local nodes sharing an address
+	whitelist []*net.IPNet
+}
+
+func NewBanList() *BanList {
+	return &BanList{bans: make(map[string]*BanEntry)}
+}
+
+func singleIP(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Accepts an IP address or a subnet like 10.0.0.0/8
+func ParseSubnet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		return ipnet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP address %v", s)
+	}
+	return singleIP(ip), nil
+}
+
+func (l *BanList) Ban(subnet *net.IPNet, d time.Duration, reason string) error {
+	now := utils.Now()
+	l.mtx.Lock()
+	l.bans[subnet.String()] = &BanEntry{
+		Subnet:  subnet.String(),
+		Created: now.Unix(),
+		Until:   now.Add(d).Unix(),
+		Reason:  reason,
+		ipnet:   subnet,
+	}
+	l.mtx.Unlock()
+	return l.Save()
+}
+
+// Returns false if the subnet was not banned
+func (l *BanList) Unban(subnet *net.IPNet) (bool, error) {
+	l.mtx.Lock()
+	_, ok := l.bans[subnet.String()]
+	delete(l.bans, subnet.String())
+	l.mtx.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, l.Save()
+}
+
+// Forget bans that expired, l.mtx should be held
+func (l *BanList) sweep() {
+	now := utils.Now().Unix()
+	for key, e := range l.bans {
+		if e.Until <= now {
+			delete(l.bans, key)
+		}
+	}
+}
+
+func (l *BanList) IsBanned(ip net.IP) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.sweep()
+	for _, e := range l.bans {
+		if e.ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *BanList) Whitelist(subnet *net.IPNet) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.whitelist = append(l.whitelist, subnet)
+}
+
+func (l *BanList) IsWhitelisted(ip net.IP) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for _, subnet := range l.whitelist {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *BanList) List() (ret []BanEntry) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.sweep()
+	for _, e := range l.bans {
+		ret = append(ret, *e)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Subnet < ret[j].Subnet
+	})
+	return
+}
+
+// Read bans saved earlier, and keep saving to the same file.
+// A missing file is not an error.
+func (l *BanList) Load(path string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var entries []*BanEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		_, e.ipnet, err = net.ParseCIDR(e.Subnet)
+		if err != nil {
+			continue
+		}
+		l.bans[e.Subnet] = e
+	}
+	l.sweep()
+	return nil
+}
+
+func (l *BanList) Save() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.path == "" {
+		return nil
+	}
+	entries := make([]*BanEntry, 0, len(l.bans))
+	for _, e := range l.bans {
+		entries = append(entries, e)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".new"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// Ban a subnet and drop the connections from it
+func (p *Peer) Ban(subnet *net.IPNet, d time.Duration, reason string) {
+	err := p.Bans.Ban(subnet, d, reason)
+	if err != nil {
+		netLog.Error("Saving the ban list failed", "err", err)
+	}
+	netLog.Info("Banned", "subnet", subnet.String(), "until", utils.Now().Add(d).Format(time.RFC3339), "reason", reason)
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for c := range p.conns {
+		if subnet.Contains(ConnectionToAddr(c.Conn.RemoteAddr()).IP) {
+			// Serve notices and cleans up
+			c.Conn.Close()
+		}
+	}
+}
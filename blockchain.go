@@ -3,10 +3,11 @@ package main
 import (
 	"bytes"
 	"crypto/dsa"
-	"log"
+	"errors"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/sshockwave/bitebi/message"
 	"github.com/sshockwave/bitebi/utils"
@@ -15,6 +16,11 @@ import (
 const CoinBaseReward = 1
 
 type BlockChain struct {
+	// Miner statistics, accessed atomically.
+	// Kept at the top so that they are 64-bit aligned.
+	hashCount  uint64
+	hashRate   uint64 // bits of a float64
+	extraNonce uint64
 	// All blocks
 	Block []message.SerializedBlock
 	Mtx   sync.Mutex
@@ -30,6 +36,9 @@ type BlockChain struct {
 	Height map[[32]byte]int
 	UTXO   map[message.Outpoint]bool
 	Wallet *Wallet
+	// Optional indexes, kept in sync with the chain
+	Indexes []Indexer
+	Events  *EventBus
 }
 
 func (b *BlockChain) init(w *Wallet) {
@@ -37,6 +46,7 @@ func (b *BlockChain) init(w *Wallet) {
 	b.Mempool = make(map[[32]byte]message.Transaction)
 	b.Height = make(map[[32]byte]int)
 	b.UTXO = make(map[message.Outpoint]bool)
+	b.Events = NewEventBus()
 
 	TS := []message.Transaction{{}}
 	genesis := message.Block{
@@ -50,7 +60,7 @@ func (b *BlockChain) init(w *Wallet) {
 
 	genesis_full, err := message.CreateSerialBlock(genesis, TS)
 	if err != nil {
-		log.Fatalln(err)
+		chainLog.Fatal("Creating the genesis block failed", "err", err)
 	}
 	b.Block = []message.SerializedBlock{genesis_full}
 	b.Height[genesis_full.HeaderHash] = 0
@@ -181,41 +191,68 @@ func (b *BlockChain) verifyScripts(tx message.Transaction, signature_scripts []b
 	}
 }
 
+// Why a transaction was not accepted
+var (
+	txMissingInputs = errors.New("txMissingInputs")
+	txInputSpent    = errors.New("txInputSpent")
+	txBadScript     = errors.New("txBadScript")
+	txOverspend     = errors.New("txOverspend")
+)
+
 // Verify if this tx is valid without examining the links and states
 func (b *BlockChain) verifyTransaction(tx message.Transaction, isCoinbase bool) bool {
+	return b.checkTransaction(tx) == nil
+}
+
+func (b *BlockChain) checkTransaction(tx message.Transaction) error {
+	defer observeSince(metricTxVerify, time.Now())
 	wallet := int64(0) // wallet varification
 	for i := 0; i < len(tx.Tx_in); i++ {
 		previous_output := tx.Tx_in[i].Previous_output
 		hash := previous_output.Hash
 		pre_tx, ok := b.TX[hash]
 		if !ok {
-			return false
+			return txMissingInputs
 		}
 		index := previous_output.Index
 		if int(index) >= len(pre_tx.Tx_out) {
-			return false
+			return txMissingInputs
 		}
 		pre_out := pre_tx.Tx_out[index]
 		pass := b.verifyScripts(tx, tx.Tx_in[i].Signature_script, pre_out.Pk_script)
 		if !pass {
-			return false
+			return txBadScript
 		}
 		wallet += pre_out.Value
 	}
 	for i := 0; i < len(tx.Tx_out); i++ {
 		wallet -= tx.Tx_out[i].Value
 		if wallet < 0 {
-			return false
+			return txOverspend
 		}
 	}
-	return true
+	return nil
+}
+
+// Check a transaction relayed to us before it joins the mempool,
+// its inputs must not be spent in the chain.
+// Must be called with Mtx held
+func (b *BlockChain) checkNewTransaction(tx message.Transaction) error {
+	for _, in := range tx.Tx_in {
+		if unspent, ok := b.UTXO[in.Previous_output]; ok && !unspent {
+			return txInputSpent
+		}
+	}
+	return b.checkTransaction(tx)
 }
 
 func (b *BlockChain) verifyCoinbase(tx message.Transaction, height int) bool {
 	if len(tx.Tx_in) != 1 {
 		return false
 	}
-	if len(tx.Tx_in[0].Signature_script) != 4 {
+	// height followed by an optional extranonce
+	script_len := len(tx.Tx_in[0].Signature_script)
+	if script_len < 4 || script_len > MaxCoinbaseScriptSize {
 		return false
 	}
 	hgt_bytes := tx.Tx_in[0].Signature_script[1:]
@@ -250,6 +287,16 @@ func (b *BlockChain) addTransaction(tx message.Transaction) {
 	b.Wallet.OnTX(&tx)
 }
 
+// Add a transaction that is not in a block, and tell the subscribers
+func (b *BlockChain) acceptTransaction(tx message.Transaction) {
+	txID, _ := utils.GetHash(&tx)
+	if _, ok := b.TX[txID]; ok {
+		return
+	}
+	b.addTransaction(tx)
+	b.Events.Publish(TopicTxAccepted, TxEvent{utils.HashToString(txID), "new"})
+}
+
 func (b *BlockChain) confirmTransaction(tx message.Transaction, isCoinbase bool) bool {
 	// input verification should have been done in verify
 	for i := 0; i < len(tx.Tx_in) && !isCoinbase; i++ { // input verification
@@ -273,7 +320,8 @@ func (b *BlockChain) cancelTransaction(tx message.Transaction, isCoinbase bool)
 	for i := 0; i < len(tx.Tx_in) && !isCoinbase; i++ {
 		ans, ok := b.UTXO[tx.Tx_in[i].Previous_output]
 		if !ok || ans {
-			log.Fatalf("[ERROR] the transaction should have been confirmed")
+			chainLog.Error("Cancelling a transaction that is not confirmed", "input", i)
+			continue
 		}
 		b.UTXO[tx.Tx_in[i].Previous_output] = true
 	}
@@ -283,6 +331,9 @@ func (b *BlockChain) cancelTransaction(tx message.Transaction, isCoinbase bool)
 
 func (b *BlockChain) delTransaction(tx message.Transaction) {
 	hash, _ := utils.GetHash(&tx)
+	if _, ok := b.Mempool[hash]; ok {
+		b.Events.Publish(TopicTxRemoved, TxEvent{utils.HashToString(hash), "invalid"})
+	}
 	delete(b.TX, hash)
 	delete(b.Mempool, hash)
 	for i := 0; i < len(tx.Tx_out); i++ {
@@ -291,60 +342,99 @@ func (b *BlockChain) delTransaction(tx message.Transaction) {
 	}
 }
 
+// Why a block was not accepted
+var (
+	blockNotLonger      = errors.New("blockNotLonger")
+	blockNotConnected   = errors.New("blockNotConnected")
+	blockNoTransactions = errors.New("blockNoTransactions")
+	blockBadProofOfWork = errors.New("blockBadProofOfWork")
+	blockBadMerkleRoot  = errors.New("blockBadMerkleRoot")
+	blockBadCoinbase    = errors.New("blockBadCoinbase")
+	blockBadTransaction = errors.New("blockBadTransaction")
+	blockMissingInputs  = errors.New("blockMissingInputs")
+)
+
+// Whether a rejection means the block is invalid,
+// rather than just not better than what we have
+func isInvalidBlock(err error) bool {
+	return err != nil && err != blockNotLonger
+}
+
 // Verify if this block is valid without examining the links and states
 func (b *BlockChain) verifyBlock(sBlock message.SerializedBlock, height int) bool {
+	return b.checkBlock(sBlock, height) == nil
+}
+
+func (b *BlockChain) checkBlock(sBlock message.SerializedBlock, height int) error {
 	newBlock := sBlock.Header
 	//newBlockHash := sBlock.HeaderHash
 	newTransactions := sBlock.Txns
 
+	if len(newTransactions) == 0 {
+		return blockNoTransactions
+	}
+
 	if !utils.HasValidHash(sBlock.HeaderHash, newBlock.NBits) {
-		return false
+		return blockBadProofOfWork
 	}
 
 	if newBlock.Merkle_root_hash != message.MakeMerkleTree(newTransactions) { // merkleTree_hash_verification
-		return false
+		return blockBadMerkleRoot
 	}
 
 	if !b.verifyCoinbase(newTransactions[0], height) {
-		return false
+		return blockBadCoinbase
 	}
 	for _, transaction := range newTransactions[1:] {
 		if b.verifyTransaction(transaction, false) == false {
-			return false
+			return blockBadTransaction
 		}
 	}
 
-	return true
+	return nil
 }
 
 func (b *BlockChain) addBlock(startPos int, newBlocks []message.SerializedBlock) (accepted bool) {
+	return b.acceptBlocks(startPos, newBlocks) == nil
+}
+
+// Replace the active chain from startPos with newBlocks if they are valid and longer
+func (b *BlockChain) acceptBlocks(startPos int, newBlocks []message.SerializedBlock) error {
 	b.Mtx.Lock()
 	defer b.Mtx.Unlock()
 	// add new known transactions
 	// they should always be added
 	// since they might be useful
+	pooled := make(map[[32]byte]bool) // announced to subscribers before
 	for i := range newBlocks {
 		for j := range newBlocks[i].Txns {
+			txID, _ := utils.GetHash(&newBlocks[i].Txns[j])
+			if _, ok := b.Mempool[txID]; ok {
+				pooled[txID] = true
+			}
 			b.addTransaction(newBlocks[i].Txns[j])
 		}
 	}
 	// Consensus: always use longest chain
 	if !(startPos <= len(b.Block) && startPos+len(newBlocks) > len(b.Block)) {
-		return false
+		return blockNotLonger
 	}
 	// verify block connect hash
 	if bytes.Compare(newBlocks[0].Header.Previous_block_header_hash[:], b.Block[startPos-1].HeaderHash[:]) != 0 {
-		return false
+		return blockNotConnected
 	}
 	for i := range newBlocks[1:] {
 		if bytes.Compare(newBlocks[i+1].Header.Previous_block_header_hash[:], newBlocks[i].HeaderHash[:]) != 0 {
-			return false
+			return blockNotConnected
 		}
 	}
 	// verify block content
 	for i := range newBlocks {
-		if !b.verifyBlock(newBlocks[i], startPos+i) {
-			return false
+		start := time.Now()
+		err := b.checkBlock(newBlocks[i], startPos+i)
+		observeSince(metricBlockVerify, start)
+		if err != nil {
+			return err
 		}
 	}
 	// Roll back current chain
@@ -361,7 +451,8 @@ func (b *BlockChain) addBlock(startPos int, newBlocks []message.SerializedBlock)
 			ret := b.confirmTransaction(v.Txns[j], j == 0)
 			if !ret {
 				// invalid transaction, roll back all
-				for ; j >= 0; j-- {
+				// the failed one has restored its own inputs
+				for j--; j >= 0; j-- {
 					b.cancelTransaction(v.Txns[j], j == 0)
 				}
 				for _, v := range newBlocks[:i] {
@@ -373,28 +464,53 @@ func (b *BlockChain) addBlock(startPos int, newBlocks []message.SerializedBlock)
 					for j := range v.Txns {
 						ret := b.confirmTransaction(v.Txns[j], j == 0)
 						if !ret {
-							log.Fatalf("[ERROR] the blockchain should have been valid")
+							chainLog.Error("Restoring the active chain failed")
 						}
 					}
 				}
-				return false
+				return blockMissingInputs
 			}
 		}
 	}
 	{ // Commit success!
+		if startPos < len(b.Block) {
+			metricReorgs.Inc()
+		}
+		for height := len(b.Block) - 1; height >= startPos; height-- {
+			for _, idx := range b.Indexes {
+				idx.DisconnectBlock(b, &b.Block[height], height)
+			}
+			delete(b.Height, b.Block[height].HeaderHash)
+			b.Events.Publish(TopicBlockDisconnected, BlockEvent{b.Block[height].HexString(), height})
+		}
 		for _, v := range b.Block[startPos:] {
-			delete(b.Height, v.HeaderHash)
+			for i := 1; i < len(v.Txns); i++ {
+				txID, _ := utils.GetHash(&v.Txns[i])
+				if _, ok := b.Mempool[txID]; ok {
+					b.Events.Publish(TopicTxAccepted, TxEvent{utils.HashToString(txID), "reorg"})
+				}
+			}
 		}
 		b.Block = b.Block[:startPos]
 		for i := 0; i < len(newBlocks); i++ {
 			height := len(b.Block)
 			b.Height[newBlocks[i].HeaderHash] = height
 			b.Block = append(b.Block, newBlocks[i])
-			log.Printf("[INFO] New block at height %v: %v", height, newBlocks[i].HexString())
+			for _, idx := range b.Indexes {
+				idx.ConnectBlock(b, &b.Block[height], height)
+			}
+			chainLog.Info("New block", "height", height, "hash", newBlocks[i].HexString())
+			for j := 1; j < len(newBlocks[i].Txns); j++ {
+				txID, _ := utils.GetHash(&newBlocks[i].Txns[j])
+				if pooled[txID] {
+					b.Events.Publish(TopicTxRemoved, TxEvent{utils.HashToString(txID), "confirmed"})
+				}
+			}
+			b.Events.Publish(TopicBlockConnected, BlockEvent{newBlocks[i].HexString(), height})
 		}
 	}
 	go b.refreshMining()
-	return true
+	return nil
 }
 
 func (b *BlockChain) sortedMempool() (ans [][32]byte) {
@@ -432,84 +548,22 @@ func (b *BlockChain) sortedMempool() (ans [][32]byte) {
 		}
 	}
 	if len(ans) < len(b.Mempool) {
-		log.Fatalln("[FATAL] Loop detected in unconfirmed txns. This is hardly possible.")
+		mempoolLog.Error("Loop detected in unconfirmed transactions")
 	}
 	return
 }
 
-func (b *BlockChain) mine(version int32, nBits uint32, peer *Peer, Pk_script []byte) {
-	rewardTransaction := message.Transaction{
-		Tx_out: []message.TxOut{
-			{
-				Value:     CoinBaseReward, // How many bitcoins to use for reward?
-				Pk_script: Pk_script,
-			},
-		},
-	}
-	var TS []message.Transaction
-	ver := -1
-	var block message.Block
-	for {
-		if ver < b.MineVersion {
-			b.MineBarrier.Lock() // sync progress
-			b.MineBarrier.Unlock()
-			b.Mtx.Lock()
-			ver = b.MineVersion
-			height := len(b.Block)
-			// https://developer.bitcoin.org/reference/transactions.html?highlight=coinbase
-			rewardTransaction.Tx_in = []message.TxIn{
-				{
-					Previous_output: message.Outpoint{Index: 0xffff},
-					Signature_script: []byte{
-						0x03, // number of bytes in the height
-						byte(height & 255),
-						byte((height >> 8) & 255),
-						byte((height >> 16) & 255),
-					},
-				},
-			}
-			TS = []message.Transaction{rewardTransaction}
-			for _, hash := range b.sortedMempool() {
-				value := b.Mempool[hash]
-				if b.verifyTransaction(value, false) && b.confirmTransaction(value, false) {
-					TS = append(TS, value)
-				} else {
-					b.delTransaction(value)
-				}
-			}
-			// rollback
-			for _, value := range TS[1:] {
-				b.cancelTransaction(value, false)
-			}
-			previous_block_header_hash := b.Block[height-1].HeaderHash
-			b.Mtx.Unlock()
-			block = message.CreateBlock(version, previous_block_header_hash, TS, nBits, 0)
-			block.Nonce = 0
-		}
-		hash, err := utils.GetHash(&block)
-		if err == nil && utils.HasValidHash(hash, nBits) {
-			log.Printf("[INFO] A new block is successfully mined!!!!")
-			var serializedBlock message.SerializedBlock
-			serializedBlock, err = message.CreateSerialBlock(block, TS)
-			if err != nil {
-				log.Fatalf("[FATAL] Block creation failed")
-				continue
-			}
-			ok := b.addBlock(len(b.Block), []message.SerializedBlock{serializedBlock})
-			if !ok {
-				log.Println("[WARN] A mined block is discarded.")
-			}
-			peer.BroadcastBlock(serializedBlock)
-		}
-		block.Nonce++
-	}
-}
+var miningNotPaused = errors.New("miningNotPaused")
 
-func (b *BlockChain) ResumeMining() {
+func (b *BlockChain) ResumeMining() error {
 	b.Mtx.Lock()
 	defer b.Mtx.Unlock()
+	if !b.MinerPaused {
+		return miningNotPaused
+	}
 	b.MinerPaused = false
 	b.MineBarrier.Unlock()
+	return nil
 }
 
 func (b *BlockChain) PauseMining() {
@@ -3,10 +3,14 @@ package main
 import (
 	"crypto/dsa"
 	"fmt"
+	"io"
+	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/p2p"
 
 	"github.com/sshockwave/bitebi/utils"
 )
@@ -194,3 +198,312 @@ func TestAddBlock(t *testing.T) {
 func TestMine(t *testing.T) {
 
 }
+
+func TestGenerate(t *testing.T) {
+	utils.SetClock(utils.NewMockClock(time.Unix(1650000000, 0)))
+	defer utils.SetClock(nil)
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	peer, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer peer.ln.Close()
+	hashes, err := peer.Generate(5, 0, pk_script2)
+	if err != nil || len(hashes) != 5 {
+		t.Fatalf("Expect 5 blocks, %v found: %v", len(hashes), err)
+	}
+	if len(chain.Block) != 6 || chain.Block[5].HeaderHash != hashes[4] {
+		t.Fatalf("Generated blocks should be on the chain")
+	}
+	if chain.Block[5].Header.Time != 1650000000 {
+		t.Fatalf("Expect mocked time, %v found", chain.Block[5].Header.Time)
+	}
+	if _, err = peer.Generate(1, 0, pk_script2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	peer.Config = p2p.GetBitebinet()
+	if _, err = peer.Generate(1, 0, pk_script2); err == nil {
+		t.Fatalf("Generate should only work on regtest")
+	}
+}
+
+func TestCoinbaseExtraNonce(t *testing.T) {
+	tx1 := makeCoinbase(70000, 1, pk_script2)
+	tx2 := makeCoinbase(70000, 2, pk_script2)
+	if !blockchain.verifyCoinbase(tx1, 70000) || !blockchain.verifyCoinbase(tx2, 70000) {
+		t.Fatalf("It should pass, but it doesn't.")
+	}
+	if blockchain.verifyCoinbase(tx1, 70001) {
+		t.Fatalf("It should return false, but it returns true")
+	}
+	if message.MakeMerkleTree([]message.Transaction{tx1}) == message.MakeMerkleTree([]message.Transaction{tx2}) {
+		t.Fatalf("Different extranonces should give different merkle roots")
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	utils.SetClock(utils.NewMockClock(time.Unix(1650000000, 0)))
+	defer utils.SetClock(nil)
+	newChain := func() (*BlockChain, *Peer) {
+		var chain BlockChain
+		var wallet Wallet
+		wallet.Init(&chain)
+		chain.init(&wallet)
+		peer, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &chain, peer
+	}
+	chain, peer := newChain()
+	defer peer.ln.Close()
+	peer.Generate(1, 0, pk_script2)
+	chain.Mtx.Lock()
+	chain.AddIndex(NewTxIndex())
+	chain.AddIndex(NewAddrIndex())
+	chain.Mtx.Unlock()
+	peer.Generate(2, 0, pk_script2)
+	addr := ScriptAddress(pk_script2)
+	if addr != string(PK2Bytes(pk)) {
+		t.Fatalf("Unexpected address %v", addr)
+	}
+	txid, _ := utils.GetHash(&chain.Block[3].Txns[0])
+	loc, ok := chain.GetTxIndex().Lookup(txid)
+	if !ok || loc.Height != 3 || loc.BlockHash != chain.Block[3].HeaderHash {
+		t.Fatalf("Unexpected location %+v", loc)
+	}
+	if n := len(chain.GetAddrIndex().Unspent(addr)); n != 3 {
+		t.Fatalf("Expect 3 unspent outputs, %v found", n)
+	}
+
+	// a longer chain paying to another script replaces blocks 1 to 3
+	other, otherPeer := newChain()
+	defer otherPeer.ln.Close()
+	otherPeer.Generate(4, 0, pk_script4)
+	if !chain.addBlock(1, other.Block[1:]) {
+		t.Fatalf("The longer chain should be accepted")
+	}
+	if _, ok = chain.GetTxIndex().Lookup(txid); ok {
+		t.Fatalf("Disconnected transactions should be removed")
+	}
+	if n := len(chain.GetAddrIndex().History(addr)); n != 0 {
+		t.Fatalf("Expect an empty history, %v events found", n)
+	}
+	if n := len(chain.GetAddrIndex().History(ScriptAddress(pk_script4))); n != 4 {
+		t.Fatalf("Expect 4 events, %v found", n)
+	}
+}
+
+func TestCFilterIndex(t *testing.T) {
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	peer, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer peer.ln.Close()
+	peer.Generate(1, 0, pk_script2)
+	chain.Mtx.Lock()
+	chain.AddIndex(NewCFilterIndex())
+	chain.Mtx.Unlock()
+	peer.Generate(2, 0, pk_script4)
+	idx := chain.GetCFilterIndex()
+	var prev [32]byte
+	for height := range chain.Block {
+		filter, header, ok := idx.Filter(height)
+		if !ok || header != message.CFilterHeader(filter, prev) {
+			t.Fatalf("Unexpected filter header at %v", height)
+		}
+		prev = header
+	}
+	filter, _, _ := idx.Filter(3)
+	hash := chain.Block[3].HeaderHash
+	if ok, _ := message.MatchBasicFilter(hash, filter, [][]byte{pk_script4}); !ok {
+		t.Fatalf("The filter should match the coinbase output")
+	}
+	if ok, _ := message.MatchBasicFilter(hash, filter, [][]byte{pk_script2}); ok {
+		t.Fatalf("The filter should not match other scripts")
+	}
+
+	c := &PeerConnection{Conn: &fakeConn{}, peer: peer, sendq: newSendQueue(MaxSendQueueBytes), known: newInvFilter(10)}
+	req := message.GetCFiltersMsg{FilterType: message.CFilterBasic, StartHeight: 2, StopHash: hash}
+	data, _ := utils.GetBytes(&req)
+	c.dispatchMessage("getcfheaders", data)
+	m, ok := c.sendq.pop()
+	if !ok || m.command != "cfheaders" {
+		t.Fatalf("Expect cfheaders")
+	}
+	var resp message.CFHeadersMsg
+	if err := decodePayload("cfheaders", m.data[24:], &resp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, header1, _ := idx.Filter(1)
+	_, header3, _ := idx.Filter(3)
+	if resp.PrevHeader != header1 || len(resp.FilterHashes) != 2 || resp.FilterHashes[1] != utils.Sha256Twice(filter) {
+		t.Fatalf("Unexpected cfheaders %+v", resp)
+	}
+	// a client chains the hashes from the previous header
+	header := resp.PrevHeader
+	for _, h := range resp.FilterHashes {
+		header = utils.Sha256Twice(append(h[:], header[:]...))
+	}
+	if header != header3 {
+		t.Fatalf("The filter hashes should lead to the filter header of the stop block")
+	}
+	c.dispatchMessage("getcfilters", data)
+	for height := 2; height <= 3; height++ {
+		m, ok = c.sendq.pop()
+		var cf message.CFilterMsg
+		if !ok || decodePayload("cfilter", m.data[24:], &cf) != nil || cf.BlockHash != chain.Block[height].HeaderHash {
+			t.Fatalf("Expect the filter of block %v", height)
+		}
+	}
+	// a range ending before it starts
+	req.StartHeight = 4
+	data, _ = utils.GetBytes(&req)
+	c.dispatchMessage("getcfilters", data)
+	if c.banScore == 0 {
+		t.Fatalf("Invalid ranges should count as misbehavior")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	peer, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer peer.ln.Close()
+	sub := chain.Events.Subscribe(TopicBlockConnected)
+	defer sub.Close()
+	hashes, _ := peer.Generate(1, 0, pk_script2)
+	ev := <-sub.C
+	if ev.Topic != TopicBlockConnected || ev.Data.(BlockEvent).Hash != utils.HashToString(hashes[0]) {
+		t.Fatalf("Unexpected event %+v", ev)
+	}
+	sub.Remove(TopicBlockConnected)
+	sub.Add(TopicTxAccepted)
+	chain.Mtx.Lock()
+	chain.acceptTransaction(tx1)
+	chain.Mtx.Unlock()
+	peer.Generate(1, 0, pk_script2)
+	ev = <-sub.C
+	txid, _ := utils.GetHash(&tx1)
+	if ev.Topic != TopicTxAccepted || ev.Data.(TxEvent).Txid != utils.HashToString(txid) {
+		t.Fatalf("Unexpected event %+v", ev)
+	}
+	select {
+	case ev = <-sub.C:
+		t.Fatalf("Unexpected event %+v", ev)
+	default:
+	}
+}
+
+func TestPing(t *testing.T) {
+	interval, timeout := PingInterval, PingTimeout
+	PingInterval, PingTimeout = 20*time.Millisecond, 200*time.Millisecond
+	defer func() { PingInterval, PingTimeout = interval, timeout }()
+	newPeer := func() *Peer {
+		var chain BlockChain
+		var wallet Wallet
+		wallet.Init(&chain)
+		chain.init(&wallet)
+		peer, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return peer
+	}
+	a, b := newPeer(), newPeer()
+	defer a.ln.Close()
+	defer b.ln.Close()
+	conn, err := a.Dial(b.ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	a.NewConn(conn)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		info := a.GetPeerInfo()
+		if len(info) == 1 && info[0].RTT > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No pong received: %+v", info)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a peer that never answers is dropped
+	silent, err := net.Dial("tcp", a.ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer silent.Close()
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.Copy(io.Discard, silent)
+	if err != nil {
+		t.Fatalf("The silent connection should be closed by the peer: %v", err)
+	}
+	for len(a.GetPeerInfo()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expect 1 connection left, %v found", len(a.GetPeerInfo()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRescanWithCFilters(t *testing.T) {
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	peer, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer peer.ln.Close()
+	chain.Mtx.Lock()
+	chain.AddIndex(NewCFilterIndex())
+	chain.Mtx.Unlock()
+	peer.Generate(2, 0, pk_script4)
+	peer.Generate(1, 0, pk_script2)
+	peer.Generate(1, 0, pk_script4)
+	tx := message.Transaction{Tx_out: []message.TxOut{{Value: 7, Pk_script: pk_script2}}}
+	chain.Mtx.Lock()
+	chain.acceptTransaction(tx)
+	chain.Mtx.Unlock()
+	wallet.AddPrivKey("self", sk)
+	if !wallet.Rescan("self") {
+		t.Fatalf("Expect the account to be rescanned")
+	}
+	expected := chain.Block[3].Txns[0].Tx_out[0].Value + 7
+	if balance := wallet.GetBalance("self"); balance != expected {
+		t.Fatalf("Expect balance %v, %v found", expected, balance)
+	}
+}
+
+func TestResumeMining(t *testing.T) {
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	if err := chain.ResumeMining(); err != miningNotPaused {
+		t.Fatalf("Expect %v, %v found", miningNotPaused, err)
+	}
+	chain.PauseMining()
+	if err := chain.ResumeMining(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := chain.ResumeMining(); err != miningNotPaused {
+		t.Fatalf("Expect %v, %v found", miningNotPaused, err)
+	}
+}
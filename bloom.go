@@ -0,0 +1,266 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// A BIP37 bloom filter loaded by a lightweight client.
+// Only transactions matching it are announced to the client, and
+// filtered blocks carry just the matching transactions.
+type BloomFilter struct {
+	mtx       sync.Mutex
+	data      []byte
+	hashFuncs uint32
+	tweak     uint32
+	flags     uint8
+}
+
+func NewBloomFilter(msg *message.FilterLoadMsg) *BloomFilter {
+	f := &BloomFilter{hashFuncs: msg.HashFuncs, tweak: msg.Tweak, flags: msg.Flags}
+	f.data = append([]byte{}, msg.Filter...)
+	return f
+}
+
+// An empty filter sized for n elements at the false positive rate fp,
+// as a lightweight client makes it
+func NewBloomFilterFor(n int, fp float64, tweak uint32, flags uint8) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	bits := -1 / (math.Ln2 * math.Ln2) * float64(n) * math.Log(fp)
+	size := int(math.Min(bits, message.MaxBloomFilterSize*8) / 8)
+	funcs := math.Min(float64(size*8)/float64(n)*math.Ln2, message.MaxBloomHashFuncs)
+	return &BloomFilter{data: make([]byte, size), hashFuncs: uint32(funcs), tweak: tweak, flags: flags}
+}
+
+// The filterload message that loads this filter
+func (f *BloomFilter) LoadMsg() message.FilterLoadMsg {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return message.FilterLoadMsg{Filter: append([]byte{}, f.data...), HashFuncs: f.hashFuncs, Tweak: f.tweak, Flags: f.flags}
+}
+
+func (f *BloomFilter) bit(n uint32, data []byte) uint32 {
+	return utils.Murmur3(n*0xfba4c795+f.tweak, data) % uint32(len(f.data)*8)
+}
+
+// f.mtx should be held
+func (f *BloomFilter) insert(data []byte) {
+	if len(f.data) == 0 {
+		return
+	}
+	for n := uint32(0); n < f.hashFuncs; n++ {
+		i := f.bit(n, data)
+		f.data[i>>3] |= 1 << (i & 7)
+	}
+}
+
+// f.mtx should be held
+func (f *BloomFilter) contains(data []byte) bool {
+	if len(f.data) == 0 {
+		// matches everything, like Bitcoin Core
+		return true
+	}
+	for n := uint32(0); n < f.hashFuncs; n++ {
+		i := f.bit(n, data)
+		if f.data[i>>3]&(1<<(i&7)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomFilter) Add(data []byte) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.insert(data)
+}
+
+func (f *BloomFilter) Contains(data []byte) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.contains(data)
+}
+
+// The data elements of a script, those that are not operations
+func scriptElements(script []byte) (ret [][]byte) {
+	for _, op := range strings.FieldsFunc(string(script), split) {
+		if !strings.HasPrefix(op, "OP ") {
+			ret = append(ret, []byte(op))
+		}
+	}
+	return
+}
+
+func paysToPubkey(pk_script []byte) bool {
+	ops := strings.FieldsFunc(string(pk_script), split)
+	if len(ops) == 0 {
+		return false
+	}
+	last := ops[len(ops)-1]
+	return last == "OP CHECKSIG" || last == "OP CHECKMULTISIG"
+}
+
+// Whether the client wants tx, following the BIP37 rules.
+// Outpoints of matching outputs are added so that spends of them match too.
+func (f *BloomFilter) MatchTx(tx *message.Transaction, txid [32]byte) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	matched := f.contains(txid[:])
+	for i, out := range tx.Tx_out {
+		for _, e := range scriptElements(out.Pk_script) {
+			if !f.contains(e) {
+				continue
+			}
+			matched = true
+			update := f.flags & message.BloomUpdateMask
+			if update == message.BloomUpdateAll || (update == message.BloomUpdateP2PubkeyOnly && paysToPubkey(out.Pk_script)) {
+				outpoint := message.NewOutPoint(txid, uint32(i))
+				data, _ := utils.GetBytes(&outpoint)
+				f.insert(data)
+			}
+			break
+		}
+	}
+	if matched {
+		return true
+	}
+	for _, in := range tx.Tx_in {
+		data, _ := utils.GetBytes(&in.Previous_output)
+		if f.contains(data) {
+			return true
+		}
+		for _, e := range scriptElements(in.Signature_script) {
+			if f.contains(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The filter of a connection, nil if none is loaded
+func (c *PeerConnection) bloomFilter() *BloomFilter {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.filter
+}
+
+func (c *PeerConnection) onFilterLoad(data []byte) (err error) {
+	var msg message.FilterLoadMsg
+	err = decodePayload("filterload", data, &msg)
+	if err != nil {
+		return
+	}
+	c.mtx.Lock()
+	c.filter = NewBloomFilter(&msg)
+	c.mtx.Unlock()
+	return
+}
+
+func (c *PeerConnection) onFilterAdd(data []byte) (err error) {
+	var msg message.FilterAddMsg
+	err = decodePayload("filteradd", data, &msg)
+	if err != nil {
+		return
+	}
+	f := c.bloomFilter()
+	if f == nil {
+		return &misbehavior{scoreMalformed, "filteradd without a filter"}
+	}
+	f.Add(msg.Data)
+	return
+}
+
+func (c *PeerConnection) onFilterClear(data []byte) (err error) {
+	if len(data) > 0 {
+		return &misbehavior{scoreUnexpectedPayload, "unexpected payload in filterclear"}
+	}
+	c.mtx.Lock()
+	c.filter = nil
+	c.mtx.Unlock()
+	return
+}
+
+// Send a merkleblock of the transactions matching the filter, followed by those transactions
+func (c *PeerConnection) sendFilteredBlock(hash [32]byte) (err error) {
+	f := c.bloomFilter()
+	if f == nil {
+		// filtered blocks only make sense with a filter
+		return
+	}
+	blk, _, ok := c.peer.findBlock(hash)
+	if !ok {
+		return
+	}
+	match := make([]bool, len(blk.Txns))
+	for i := range blk.Txns {
+		var txid [32]byte
+		txid, err = utils.GetHash(&blk.Txns[i])
+		if err != nil {
+			return
+		}
+		match[i] = f.MatchTx(&blk.Txns[i], txid)
+	}
+	msg, err := message.NewMerkleBlock(&blk, match)
+	if err != nil {
+		return
+	}
+	data, err := utils.GetBytes(&msg)
+	if err != nil {
+		return
+	}
+	err = c.sendMessage("merkleblock", data)
+	if err != nil {
+		return
+	}
+	for i := range blk.Txns {
+		if !match[i] {
+			continue
+		}
+		data, err = utils.GetBytes(&blk.Txns[i])
+		if err != nil {
+			return
+		}
+		err = c.sendMessage("tx", data)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Check a merkleblock against its header
+func (c *PeerConnection) onMerkleBlock(data []byte) (err error) {
+	var msg message.MerkleBlockMsg
+	err = decodePayload("merkleblock", data, &msg)
+	if err != nil {
+		return
+	}
+	hash, err := utils.GetHash(&msg.Header)
+	if err != nil {
+		return
+	}
+	if utils.EasierThan(msg.Header.NBits, c.peer.Config.MaxNBits) || !utils.HasValidHash(hash, msg.Header.NBits) {
+		return &misbehavior{scoreInvalidBlock, "merkleblock with invalid proof of work"}
+	}
+	matched, err := msg.MatchedTxns()
+	if err != nil {
+		return &misbehavior{scoreInvalidBlock, "invalid merkleblock: " + err.Error()}
+	}
+	c.known.add(hash)
+	err = c.requestDone(hash)
+	if err != nil {
+		return
+	}
+	netLog.Debug("Received merkle block", "addr", c.Conn.RemoteAddr(), "block", utils.HashToString(hash), "matched", len(matched))
+	if c.peer.Headers != nil {
+		return c.onSPVMerkleBlock(&msg.Header, hash, matched)
+	}
+	return
+}
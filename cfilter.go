@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Basic block filters of BIP158, served with BIP157 messages.
+// The filter of a block has the scripts of its outputs and of the outputs it spends,
+// so a client can test it for its own scripts without telling us what they are.
+
+var errNoCFilters = errors.New("noCFilters")
+
+// Filters and filter headers of the active chain by height
+type CFilterIndex struct {
+	filters [][]byte
+	headers [][32]byte
+}
+
+func NewCFilterIndex() *CFilterIndex {
+	idx := new(CFilterIndex)
+	idx.Reset()
+	return idx
+}
+
+func (idx *CFilterIndex) Name() string {
+	return "blockfilterindex"
+}
+
+func (idx *CFilterIndex) Reset() {
+	idx.filters = make([][]byte, 0)
+	idx.headers = make([][32]byte, 0)
+}
+
+// The scripts a basic filter is made of.
+// Empty scripts and OP RETURN outputs cannot be spent, so they are left out.
+func cfilterItems(b *BlockChain, blk *message.SerializedBlock) (items [][]byte) {
+	for i := range blk.Txns {
+		tx := &blk.Txns[i]
+		for j := 0; j < len(tx.Tx_in) && i != 0; j++ {
+			prev := tx.Tx_in[j].Previous_output
+			prevTx, ok := b.TX[prev.Hash]
+			if !ok || int(prev.Index) >= len(prevTx.Tx_out) {
+				continue
+			}
+			items = append(items, prevTx.Tx_out[prev.Index].Pk_script)
+		}
+		for _, out := range tx.Tx_out {
+			if len(out.Pk_script) == 0 || strings.HasPrefix(string(out.Pk_script), "OP RETURN") {
+				continue
+			}
+			items = append(items, out.Pk_script)
+		}
+	}
+	return
+}
+
+func (idx *CFilterIndex) ConnectBlock(b *BlockChain, blk *message.SerializedBlock, height int) {
+	filter := message.BuildBasicFilter(blk.HeaderHash, cfilterItems(b, blk))
+	var prev [32]byte
+	if height > 0 {
+		prev = idx.headers[height-1]
+	}
+	idx.filters = append(idx.filters[:height], filter)
+	idx.headers = append(idx.headers[:height], message.CFilterHeader(filter, prev))
+}
+
+func (idx *CFilterIndex) DisconnectBlock(b *BlockChain, blk *message.SerializedBlock, height int) {
+	idx.filters = idx.filters[:height]
+	idx.headers = idx.headers[:height]
+}
+
+func (idx *CFilterIndex) Filter(height int) (filter []byte, header [32]byte, ok bool) {
+	if height < 0 || height >= len(idx.filters) {
+		return
+	}
+	return idx.filters[height], idx.headers[height], true
+}
+
+func (b *BlockChain) GetCFilterIndex() *CFilterIndex {
+	for _, idx := range b.Indexes {
+		if ret, ok := idx.(*CFilterIndex); ok {
+			return ret
+		}
+	}
+	return nil
+}
+
+// Check a request for the filters from start to stopHash, and find the height of stopHash.
+// b.Mtx should be held
+func cfilterStop(b *BlockChain, filterType uint8, start int, stopHash [32]byte, max int) (stop int, idx *CFilterIndex, err error) {
+	if filterType != message.CFilterBasic {
+		return 0, nil, &misbehavior{scoreMalformed, "unknown filter type"}
+	}
+	idx = b.GetCFilterIndex()
+	if idx == nil {
+		return 0, nil, errNoCFilters
+	}
+	stop, ok := b.Height[stopHash]
+	if !ok {
+		// maybe reorganized away
+		return 0, nil, errNoCFilters
+	}
+	if start > stop || stop-start >= max {
+		return 0, nil, &misbehavior{scoreMalformed, "invalid filter range"}
+	}
+	return
+}
+
+func (c *PeerConnection) onGetCFilters(data []byte) (err error) {
+	var msg message.GetCFiltersMsg
+	err = decodePayload("getcfilters", data, &msg)
+	if err != nil {
+		return
+	}
+	b := c.peer.Chain
+	b.Mtx.Lock()
+	stop, idx, err := cfilterStop(b, msg.FilterType, int(msg.StartHeight), msg.StopHash, message.MaxGetCFilters)
+	if err != nil {
+		b.Mtx.Unlock()
+		return
+	}
+	resp := make([]message.CFilterMsg, 0, stop-int(msg.StartHeight)+1)
+	for height := int(msg.StartHeight); height <= stop; height++ {
+		filter, _, _ := idx.Filter(height)
+		resp = append(resp, message.CFilterMsg{FilterType: msg.FilterType, BlockHash: b.Block[height].HeaderHash, Filter: filter})
+	}
+	b.Mtx.Unlock()
+	for i := range resp {
+		var raw []byte
+		raw, err = utils.GetBytes(&resp[i])
+		if err != nil {
+			return
+		}
+		err = c.sendMessage("cfilter", raw)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *PeerConnection) onGetCFHeaders(data []byte) (err error) {
+	var msg message.GetCFiltersMsg
+	err = decodePayload("getcfheaders", data, &msg)
+	if err != nil {
+		return
+	}
+	b := c.peer.Chain
+	b.Mtx.Lock()
+	stop, idx, err := cfilterStop(b, msg.FilterType, int(msg.StartHeight), msg.StopHash, message.MaxGetCFHeaders)
+	if err != nil {
+		b.Mtx.Unlock()
+		return
+	}
+	resp := message.CFHeadersMsg{FilterType: msg.FilterType, StopHash: msg.StopHash}
+	_, resp.PrevHeader, _ = idx.Filter(int(msg.StartHeight) - 1)
+	for height := int(msg.StartHeight); height <= stop; height++ {
+		filter, _, _ := idx.Filter(height)
+		resp.FilterHashes = append(resp.FilterHashes, utils.Sha256Twice(filter))
+	}
+	b.Mtx.Unlock()
+	raw, err := utils.GetBytes(&resp)
+	if err != nil {
+		return
+	}
+	return c.sendMessage("cfheaders", raw)
+}
+
+func (c *PeerConnection) onGetCFCheckpt(data []byte) (err error) {
+	var msg message.GetCFCheckptMsg
+	err = decodePayload("getcfcheckpt", data, &msg)
+	if err != nil {
+		return
+	}
+	b := c.peer.Chain
+	b.Mtx.Lock()
+	stop, idx, err := cfilterStop(b, msg.FilterType, 0, msg.StopHash, len(b.Block))
+	if err != nil {
+		b.Mtx.Unlock()
+		return
+	}
+	resp := message.CFCheckptMsg{FilterType: msg.FilterType, StopHash: msg.StopHash, FilterHeaders: make([][32]byte, 0)}
+	for height := message.CFCheckptInterval; height <= stop; height += message.CFCheckptInterval {
+		_, header, _ := idx.Filter(height)
+		resp.FilterHeaders = append(resp.FilterHeaders, header)
+	}
+	b.Mtx.Unlock()
+	raw, err := utils.GetBytes(&resp)
+	if err != nil {
+		return
+	}
+	return c.sendMessage("cfcheckpt", raw)
+}
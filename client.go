@@ -2,44 +2,72 @@ package main
 
 import (
 	"bufio"
-	"crypto/dsa"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"net"
 	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/sshockwave/bitebi/message"
-	"github.com/sshockwave/bitebi/p2p"
+	"github.com/sshockwave/bitebi/logger"
 	"github.com/sshockwave/bitebi/utils"
 )
 
 type CmdApp struct {
 	isTerminal   bool
+	cfg          Config
 	LineScanner  *bufio.Scanner
 	TokenScanner *bufio.Scanner
 	blockchain   BlockChain
-	peer         *Peer
-	hasPeer      bool
 	Wallet       Wallet
+	// protects the servers below
+	mtx     sync.Mutex
+	peer    *Peer
+	hasPeer bool
+	stratum *StratumServer
+	rpc     *RPCServer
+	rest    *RESTServer
+	metrics *MetricsServer
 }
 
-func NewCmdApp() (app CmdApp) {
+const DefaultRPCPort = 8332
+
+func NewCmdApp() (app *CmdApp) {
+	app = new(CmdApp)
+	cfg, err := ParseConfig(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		nodeLog.Fatal("Invalid options", "err", err)
+	}
+	logger.SetJSON(cfg.LogJSON)
+	err = logger.SetLevels(cfg.LogLevel)
+	if err != nil {
+		nodeLog.Fatal("Invalid log level", "err", err)
+	}
+	err = os.MkdirAll(cfg.DataDir, 0700)
+	if err != nil {
+		nodeLog.Fatal("Cannot create the data directory", "err", err)
+	}
+	app.cfg = cfg
 	o, _ := os.Stdin.Stat()
-	var inputfile string
-	flag.StringVar(&inputfile, "input", "-", "Input File")
-	flag.Parse()
 	app.isTerminal = (o.Mode() & os.ModeCharDevice) != 0
-	if inputfile == "-" {
+	if cfg.Daemon {
+		app.isTerminal = false
+	} else if cfg.Input == "-" {
 		app.LineScanner = bufio.NewScanner(os.Stdin)
 	} else {
 		app.isTerminal = false
-		f, err := os.Open(inputfile)
+		f, err := os.Open(cfg.Input)
 		if err != nil {
-			log.Fatalf("[ERROR] cannot open " + inputfile + ", " + err.Error())
+			nodeLog.Fatal("Cannot open the input file", "file", cfg.Input, "err", err)
 		}
 		app.LineScanner = bufio.NewScanner(f)
 	}
@@ -47,12 +75,96 @@ func NewCmdApp() (app CmdApp) {
 	app.blockchain.init(&app.Wallet)
 	privateKey := GenPrivKey()
 	app.Wallet.AddPrivKey("self", privateKey)
-	log.Printf("[INFO] PrivKey: " + string(SK2Bytes(privateKey)))
-	log.Printf("[INFO] PubKey: " + string(PK2Bytes(privateKey.PublicKey)))
+	walletLog.Info("Generated key for self", "privkey", string(SK2Bytes(privateKey)))
+	walletLog.Info("Generated key for self", "pubkey", string(PK2Bytes(privateKey.PublicKey)))
+	err = app.applyConfig()
+	if err != nil {
+		nodeLog.Fatal("Startup failed", "err", err)
+	}
+	return
+}
+
+// Start whatever the config asks for
+func (c *CmdApp) applyConfig() (err error) {
+	cfg := &c.cfg
+	if cfg.TxIndex {
+		c.EnableIndex("txindex")
+	}
+	if cfg.AddrIndex {
+		c.EnableIndex("addrindex")
+	}
+	if cfg.CFilterIndex {
+		c.EnableIndex("blockfilterindex")
+	}
+	if cfg.Daemon || cfg.Port >= 0 {
+		err = c.StartServer(cfg.Port, cfg.Network)
+		if err != nil {
+			return
+		}
+		for _, addr := range cfg.Peers {
+			err = c.Connect(addr)
+			if err != nil {
+				netLog.Error("Cannot connect to peer", "addr", addr, "err", err)
+			}
+		}
+		if cfg.Mine {
+			err = c.StartMining(cfg.MineThreads)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if cfg.Server {
+		rpcCfg := cfg.RPC
+		rpcCfg.Addr = net.JoinHostPort(cfg.RPCBind, strconv.Itoa(cfg.RPCPort))
+		err = c.StartRPC(rpcCfg)
+		if err != nil {
+			return
+		}
+	}
+	if cfg.REST {
+		err = c.StartREST(net.JoinHostPort(cfg.RESTBind, strconv.Itoa(cfg.RESTPort)))
+		if err != nil {
+			return
+		}
+	}
+	if cfg.Metrics {
+		err = c.StartMetrics(net.JoinHostPort(cfg.MetricsBind, strconv.Itoa(cfg.MetricsPort)))
+	}
 	return
 }
 
+// Wait for a signal, then clean up
+func (c *CmdApp) runDaemon() {
+	nodeLog.Info("Running as a daemon")
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	nodeLog.Info("Shutting down")
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.rpc != nil {
+		c.rpc.Close()
+	}
+	if c.rest != nil {
+		c.rest.Close()
+	}
+	if c.metrics != nil {
+		c.metrics.Close()
+	}
+	if c.stratum != nil {
+		c.stratum.Close()
+	}
+	if c.hasPeer {
+		c.peer.saveAddrs()
+	}
+}
+
 func (c *CmdApp) Serve() {
+	if c.cfg.Daemon {
+		c.runDaemon()
+		return
+	}
 	if c.isTerminal {
 		fmt.Println("Welcome!")
 		fmt.Println("To get started, start a peer by 'serve <port>'")
@@ -64,9 +176,9 @@ func (c *CmdApp) Serve() {
 		}
 		if !c.LineScanner.Scan() {
 			if c.LineScanner.Err() != nil {
-				log.Println("[ERROR] During scanning, an error occurred:", c.LineScanner.Err().Error())
+				nodeLog.Error("Reading commands failed", "err", c.LineScanner.Err())
 			} else if !c.isTerminal {
-				log.Println("[INFO] Input completed. Entering infinite loop.")
+				nodeLog.Info("Input completed, entering infinite loop")
 				var wg sync.WaitGroup
 				wg.Add(1)
 				wg.Wait()
@@ -76,221 +188,320 @@ func (c *CmdApp) Serve() {
 		c.TokenScanner = bufio.NewScanner(strings.NewReader(c.LineScanner.Text()))
 		c.TokenScanner.Split(bufio.ScanWords)
 		if !c.TokenScanner.Scan() {
-			log.Println("[INFO] Empty command.")
+			nodeLog.Debug("Empty command")
 			continue
 		}
-		if !c.hasPeer && c.TokenScanner.Text() != "serve" {
-			log.Println("[ERROR] A peer has not been initiated.")
-			continue
+		err := c.runCommand(c.TokenScanner.Text())
+		if err != nil {
+			fmt.Println("Error:", err)
 		}
-		switch c.TokenScanner.Text() {
-		case "mine":
-			// create a goroutine that mines
-			// Examples: easiest(0x20ffffff), hardest(0x03000000)
-			pkscript := GenerateP2PKHPkScript(c.Wallet.Pubkey["self"])
-			go c.blockchain.mine(0, c.peer.Config.MaxNBits, c.peer, pkscript)
-		case "stopmining":
-			// stop all mining processes
-			c.blockchain.PauseMining()
-		case "resumemining":
-			// stop all mining processes
-			c.blockchain.ResumeMining()
-		case "peer": // sk
-			// add an address of a peer
-			if !c.TokenScanner.Scan() {
-				break
+	}
+}
+
+func (c *CmdApp) runCommand(command string) (err error) {
+	if _, err = c.getPeer(); err != nil && command != "serve" && command != "sleep" && command != "loglevel" {
+		return
+	}
+	err = nil
+	switch command {
+	case "mine":
+		// create goroutines that mine
+		threads := runtime.NumCPU()
+		if c.TokenScanner.Scan() {
+			threads, err = strconv.Atoi(c.TokenScanner.Text())
+			if err != nil || threads <= 0 {
+				return errors.New("Usage: mine [threads]")
 			}
-			addr := c.TokenScanner.Text()
-			conn, err := c.peer.Dial(addr)
+		}
+		err = c.StartMining(threads)
+	case "getblocktemplate":
+		var tmpl BlockTemplate
+		tmpl, err = c.GetBlockTemplate()
+		if err != nil {
+			return
+		}
+		var data []byte
+		data, err = json.Marshal(tmpl)
+		if err != nil {
+			return
+		}
+		fmt.Println(string(data))
+	case "submitblock":
+		if !c.TokenScanner.Scan() {
+			return errors.New("Usage: submitblock <hex>")
+		}
+		err = c.SubmitBlock(c.TokenScanner.Text())
+	case "generate":
+		// mine blocks synchronously, regtest only
+		usage := errors.New("Usage: generate <n> [name or public key]")
+		if !c.TokenScanner.Scan() {
+			return usage
+		}
+		var n int
+		n, err = strconv.Atoi(c.TokenScanner.Text())
+		if err != nil || n < 0 {
+			return usage
+		}
+		account := "self"
+		if c.TokenScanner.Scan() {
+			account = c.TokenScanner.Text()
+		}
+		var hashes [][32]byte
+		hashes, err = c.Generate(n, account)
+		for _, hash := range hashes {
+			fmt.Println(utils.HashToString(hash))
+		}
+	case "setmocktime":
+		if !c.TokenScanner.Scan() {
+			return errors.New("Usage: setmocktime <unix time>")
+		}
+		var t int64
+		t, err = strconv.ParseInt(c.TokenScanner.Text(), 10, 64)
+		if err != nil {
+			return errors.New("Usage: setmocktime <unix time>")
+		}
+		err = c.SetMockTime(t)
+	case "stratum":
+		// serve pooled miners
+		usage := errors.New("Usage: stratum <port> [share nbits in hex]")
+		if !c.TokenScanner.Scan() {
+			return usage
+		}
+		port := c.TokenScanner.Text()
+		shareNBits := uint64(DefaultShareNBits)
+		if c.TokenScanner.Scan() {
+			shareNBits, err = strconv.ParseUint(c.TokenScanner.Text(), 16, 32)
 			if err != nil {
-				log.Printf("[ERROR] Dialing address %v failed: %v", addr, err)
-			} else {
-				c.peer.NewConn(conn)
+				return usage
 			}
-		case "addpk":
-			var name string
-			var pkstring string
+		}
+		err = c.StartStratum(":"+port, uint32(shareNBits))
+	case "showworkers":
+		var stats map[string]WorkerStats
+		stats, err = c.GetWorkerStats()
+		for name, v := range stats {
+			fmt.Printf("%v: %v accepted, %v rejected, %v blocks\n", name, v.Accepted, v.Rejected, v.Blocks)
+		}
+	case "rpc":
+		// serve JSON-RPC, authenticated by a cookie file unless a user is given
+		usage := errors.New("Usage: rpc <port> [user password]")
+		var cfg RPCConfig
+		if !c.TokenScanner.Scan() {
+			return usage
+		}
+		cfg.Addr = "127.0.0.1:" + c.TokenScanner.Text()
+		if c.TokenScanner.Scan() {
+			cfg.User = c.TokenScanner.Text()
 			if !c.TokenScanner.Scan() {
-				log.Println("[ERROR] Usage: addpk <name> <public key>")
-				continue
+				return usage
 			}
+			cfg.Password = c.TokenScanner.Text()
+		} else {
+			cfg.CookieFile = c.cfg.RPC.CookieFile
+		}
+		err = c.StartRPC(cfg)
+	case "rest":
+		// serve the read-only block explorer API
+		port := strconv.Itoa(DefaultRESTPort)
+		if c.TokenScanner.Scan() {
+			port = c.TokenScanner.Text()
+		}
+		err = c.StartREST("127.0.0.1:" + port)
+	case "metrics":
+		// serve Prometheus metrics
+		port := strconv.Itoa(DefaultMetricsPort)
+		if c.TokenScanner.Scan() {
+			port = c.TokenScanner.Text()
+		}
+		err = c.StartMetrics("127.0.0.1:" + port)
+	case "stopmining":
+		// stop all mining processes
+		c.blockchain.PauseMining()
+	case "resumemining":
+		// resume the paused mining processes
+		err = c.blockchain.ResumeMining()
+	case "peer": // sk
+		// add an address of a peer
+		if !c.TokenScanner.Scan() {
+			break
+		}
+		err = c.Connect(c.TokenScanner.Text())
+	case "addpk":
+		var name string
+		var pkstring string
+		if !c.TokenScanner.Scan() {
+			return errors.New("Usage: addpk <name> <public key>")
+		}
+		name = c.TokenScanner.Text()
+		if !c.TokenScanner.Scan() {
+			return errors.New("Usage: addpk <name> <public key>")
+		}
+		pkstring = c.TokenScanner.Text()
+		err = c.AddPubKey(name, pkstring)
+	case "addsk":
+		var name string
+		var skstring string
+		if !c.TokenScanner.Scan() {
+			return errors.New("Usage: addsk <name> <private key>")
+		}
+		name = c.TokenScanner.Text()
+		if !c.TokenScanner.Scan() {
+			return errors.New("Usage: addsk <name> <private key>")
+		}
+		skstring = c.TokenScanner.Text()
+		err = c.AddPrivKey(name, skstring)
+	case "transfer":
+		var fromAccount string
+		var accountName string
+		usage := errors.New("Usage: transfer <from> <to> <amount>")
+		if !c.TokenScanner.Scan() {
+			return usage
+		}
+		fromAccount = c.TokenScanner.Text()
+		if !c.TokenScanner.Scan() {
+			return usage
+		}
+		accountName = c.TokenScanner.Text()
+		if !c.TokenScanner.Scan() {
+			return usage
+		}
+		var amount int64
+		amount, err = strconv.ParseInt(c.TokenScanner.Text(), 10, 64)
+		if err != nil {
+			return errors.New("Input amount is not an integer")
+		}
+		_, err = c.Transfer(fromAccount, accountName, amount)
+	case "showbalance":
+		chosen_account := "self"
+		if c.TokenScanner.Scan() {
+			chosen_account = c.TokenScanner.Text()
+		}
+		// display the balance of an account
+		val := c.Wallet.GetBalance(chosen_account)
+		fmt.Printf("Client %v has %v satoshis\n", chosen_account, val)
+	case "rescan":
+		// look for unspent outputs of an account again
+		name := "self"
+		if c.TokenScanner.Scan() {
 			name = c.TokenScanner.Text()
-			if !c.TokenScanner.Scan() {
-				log.Println("[ERROR] Usage: addpk <name> <public key>")
-				continue
-			}
-			pkstring = c.TokenScanner.Text()
-			pk := Bytes2PK([]byte(pkstring))
-			c.Wallet.AddPubKey(name, pk)
-		case "addsk":
-			var name string
-			var skstring string
-			if !c.TokenScanner.Scan() {
-				log.Println("[ERROR] Usage: addpk <name> <public key>")
-				continue
-			}
+		}
+		err = c.Rescan(name)
+	case "index":
+		// turn on txindex or addrindex
+		if !c.TokenScanner.Scan() {
+			return errors.New("Usage: index <txindex|addrindex|blockfilterindex>")
+		}
+		err = c.EnableIndex(c.TokenScanner.Text())
+	case "reindex":
+		c.Reindex()
+	case "history":
+		// list the outputs received and spent by an account
+		name := "self"
+		if c.TokenScanner.Scan() {
 			name = c.TokenScanner.Text()
-			if !c.TokenScanner.Scan() {
-				log.Println("[ERROR] Usage: addpk <name> <public key>")
-				continue
-			}
-			skstring = c.TokenScanner.Text()
-			sk := Bytes2SK([]byte(skstring))
-			c.Wallet.AddPrivKey(name, sk)
-		case "transfer":
-			// input extra
-			var fromAccount string
-			var fromAccount_SK dsa.PrivateKey
-			var accountName string
-			var accountName_PK dsa.PublicKey
-			var amount int64
-			var ok bool
-			if !c.TokenScanner.Scan() {
-				log.Println("[ERROR] Usage: transfer <from> <to> <amount>")
-				continue
-			}
-			fromAccount = c.TokenScanner.Text()
-			if !c.TokenScanner.Scan() {
-				log.Println("[ERROR] Usage: transfer <from> <to> <amount>")
-				continue
-			}
-			accountName = c.TokenScanner.Text()
-			if !c.TokenScanner.Scan() {
-				log.Println("[ERROR] Usage: transfer <from> <to> <amount>")
-				continue
+		}
+		var history []AddrEventJSON
+		history, err = c.GetAddressHistory(name, false)
+		for _, e := range history {
+			if e.SpentBy != "" {
+				fmt.Printf("%v spent %v:%v (%v) at height %v\n", e.SpentBy, e.Txid, e.Vout, e.Value, e.Height)
+			} else {
+				fmt.Printf("received %v:%v (%v) at height %v\n", e.Txid, e.Vout, e.Value, e.Height)
 			}
-			tmp, err := strconv.Atoi(c.TokenScanner.Text())
+		}
+	case "loglevel":
+		// show the levels, or change them like "loglevel warn,net=debug"
+		spec := ""
+		if c.TokenScanner.Scan() {
+			spec = c.TokenScanner.Text()
+		}
+		var levels map[string]string
+		levels, err = c.SetLogLevel(spec)
+		if err != nil {
+			return
+		}
+		for _, name := range logger.Subsystems() {
+			fmt.Printf("%v: %v\n", name, levels[name])
+		}
+	case "serve":
+		port := -1
+		network := c.cfg.Network
+		if c.TokenScanner.Scan() {
+			port, err = strconv.Atoi(c.TokenScanner.Text())
 			if err != nil {
-				log.Println("[ERROR] Input amount is not an integer")
-				continue
-			}
-			amount = int64(tmp)
-
-			accountName_PK, ok = c.Wallet.Pubkey[accountName]
-			if !ok {
-				log.Printf("[ERROR] No known pubkey for %v", accountName)
-				continue
-			}
-			fromAccount_SK, ok = c.Wallet.GetSK(fromAccount) // TODO: this line is not thread safe
-			if !ok {
-				log.Printf("[ERROR] No known privkey for %v", fromAccount)
-				continue
-			}
-			totalPayment, outpoints := c.Wallet.MakeTxIn(fromAccount, amount)
-			if totalPayment < amount {
-				log.Println("[ERROR] No transfer was made, because your don't have enough money.")
-				continue
-			}
-			tx_In := []message.TxIn{}
-			for _, o := range outpoints {
-				tx_In = append(tx_In, message.TxIn{ Previous_output: o })
+				return errors.New("the port number should be an integer")
 			}
-			oput := []message.TxOut{{Value: amount, Pk_script: GenerateP2PKHPkScript(accountName_PK)}}
-			if totalPayment > amount {
-				oput = append(oput, message.TxOut{
-					Value:                             totalPayment - amount,
-					Pk_script: GenerateP2PKHPkScript(fromAccount_SK.PublicKey),
-				})
-			}
-			if totalPayment >= amount {
-				transaction := message.Transaction{
-					Version:   0,
-					Tx_in:     tx_In,
-					Tx_out:    oput,
-					Lock_time: 0,
-				}
-
-				signature := SignTransaction(fromAccount_SK, transaction)
-				for i := 0; i < len(transaction.Tx_in); i++ {
-					transaction.Tx_in[i].Signature_script = signature
-				}
-
-				c.blockchain.Mtx.Lock()
-				c.blockchain.addTransaction(transaction)
-				mempool_size := len(c.blockchain.Mempool)
-				c.blockchain.Mtx.Unlock()
-				c.Wallet.RemoveUTXO(fromAccount, outpoints)
-				if mempool_size < 100 {
-					c.blockchain.refreshMining()
-				}
-				c.peer.BroadcastTransaction(transaction)
-			}
-
-		case "showbalance":
-			chosen_account := "self"
-			if c.TokenScanner.Scan() {
-				chosen_account = c.TokenScanner.Text()
-			}
-			// display the balance of an account
-			val := c.Wallet.GetBalance(chosen_account)
-			log.Printf("Client %v has %v satoshis", chosen_account, val)
-		case "serve":
-			if c.hasPeer {
-				log.Println("[ERROR] A server is already running!")
-			} else {
-				nc := p2p.GetBitebinet()
-				if c.TokenScanner.Scan() {
-					var err error
-					nc.DefaultPort, err = strconv.Atoi(c.TokenScanner.Text())
-					if err != nil {
-						log.Println("[ERROR] the port number should be an integer")
-						continue
-					}
-				}
-				var err error
-				c.peer, err = NewPeer(&c.blockchain, nc, "0.0.0.0", -1)
-				if err != nil {
-					fmt.Println("[ERROR]", err)
-				} else {
-					c.hasPeer = true
-				}
+		}
+		if c.TokenScanner.Scan() {
+			network = c.TokenScanner.Text()
+		}
+		err = c.StartServer(port, network)
+	case "sleep":
+		if !c.TokenScanner.Scan() {
+			break
+		}
+		var t int
+		t, err = strconv.Atoi(c.TokenScanner.Text())
+		if err != nil {
+			return fmt.Errorf("Time parsing error: %v", err)
+		}
+		time.Sleep(time.Duration(t) * time.Second)
+	default:
+		err = fmt.Errorf("Unknown command: \"%v\"", command)
+	case "showpeer":
+		var peers []PeerInfo
+		peers, err = c.GetPeerInfo()
+		for _, info := range peers {
+			direction := "outbound"
+			if info.Inbound {
+				direction = "inbound"
 			}
-		case "sleep":
-			if !c.TokenScanner.Scan() {
-				break
+			rtt := "unknown"
+			if info.RTT > 0 {
+				rtt = info.RTT.String()
 			}
-			t, err := strconv.Atoi(c.TokenScanner.Text())
+			fmt.Printf("%v %v rtt %v\n", info.Addr.String(), direction, rtt)
+		}
+	case "ban":
+		// ban <ip or subnet> [seconds]
+		if !c.TokenScanner.Scan() {
+			return errors.New("Usage: ban <ip or subnet> [seconds]")
+		}
+		subnet := c.TokenScanner.Text()
+		seconds := 0
+		if c.TokenScanner.Scan() {
+			seconds, err = strconv.Atoi(c.TokenScanner.Text())
 			if err != nil {
-				log.Println("[ERROR] Time parsing error:", err.Error())
-			}
-			time.Sleep(time.Duration(t) * time.Second)
-		default:
-			log.Printf("Unknown command: \"%v\"", c.TokenScanner.Text())
-		case "showpeer":
-			for _, addr := range c.peer.GetPeerList() {
-				fmt.Println(addr)
-			}
-		case "stat":
-			last_cnt := 0
-			time_int := 200 // ms
-			tot_cnt := 0
-			loop_cnt := 0
-			for {
-				c.peer.lock.Lock()
-				peer_cnt := len(c.peer.conns) + 1
-				c.peer.lock.Unlock()
-				c.blockchain.Mtx.Lock()
-				block_cnt := len(c.blockchain.Block)
-				unconfirmed_tx_cnt := len(c.blockchain.Mempool)
-				confirmed_tx_cnt := len(c.blockchain.TX) - unconfirmed_tx_cnt - len(c.blockchain.Block) + 1
-				if confirmed_tx_cnt > last_cnt {
-					tot_cnt += confirmed_tx_cnt - last_cnt
-				}
-				last_cnt = confirmed_tx_cnt
-				loop_cnt += 1
-				c.blockchain.Mtx.Unlock()
-				fmt.Printf(
-					"Stats: %v nodes; %v blocks; %v tx; %v unconfirmed tx; %v valid tx / sec\r",
-					peer_cnt,
-					block_cnt,
-					confirmed_tx_cnt,
-					unconfirmed_tx_cnt,
-					float64(tot_cnt)/float64(loop_cnt)*1000/float64(time_int),
-				)
-				time.Sleep(time.Duration(time_int) * time.Millisecond)
+				return errors.New("Usage: ban <ip or subnet> [seconds]")
 			}
 		}
+		err = c.Ban(subnet, seconds)
+	case "unban":
+		if !c.TokenScanner.Scan() {
+			return errors.New("Usage: unban <ip or subnet>")
+		}
+		err = c.Unban(c.TokenScanner.Text())
+	case "listbanned":
+		var bans []BanEntry
+		bans, err = c.ListBanned()
+		for _, e := range bans {
+			fmt.Printf("%v until %v: %v\n", e.Subnet, time.Unix(e.Until, 0).Format(time.RFC3339), e.Reason)
+		}
+	case "stat":
+		var stats ChainStats
+		stats, err = c.GetChainStats()
+		if err != nil {
+			return
+		}
+		fmt.Printf(
+			"Stats: %v nodes; %v blocks; %v tx; %v unconfirmed tx\n",
+			stats.Peers,
+			stats.Blocks,
+			stats.Confirmed,
+			stats.Unconfirmed,
+		)
 	}
+	return
 }
 
 func main() {
@@ -0,0 +1,242 @@
+// Command line client for a running bitebi node.
+// It sends each command to the node's JSON-RPC server and prints the result as JSON.
+//
+//	bitebi-cli [options] <command> [args...]
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// How the arguments of a command are sent
+const (
+	argString = 's'
+	argInt    = 'i'
+	argBool   = 'b'
+)
+
+type command struct {
+	method string
+	args   string // one argString, argInt or argBool per argument
+	usage  string
+}
+
+// Names follow the commands typed into the node
+var commands = map[string]command{
+	"mine":              {"mine", "i", "mine [threads]"},
+	"stopmining":        {"stopmining", "", "stopmining"},
+	"resumemining":      {"resumemining", "", "resumemining"},
+	"peer":              {"addnode", "s", "peer <addr>"},
+	"addpk":             {"addpk", "ss", "addpk <name> <public key>"},
+	"addsk":             {"addsk", "ss", "addsk <name> <private key>"},
+	"transfer":          {"transfer", "ssi", "transfer <from> <to> <amount>"},
+	"showbalance":       {"getbalance", "s", "showbalance [name]"},
+	"rescan":            {"rescan", "s", "rescan [name]"},
+	"history":           {"getaddresshistory", "sb", "history <name or public key> [unspent only]"},
+	"index":             {"enableindex", "s", "index <txindex|addrindex|blockfilterindex>"},
+	"reindex":           {"reindex", "", "reindex"},
+	"loglevel":          {"setloglevel", "s", "loglevel [level or subsystem=level,...]"},
+	"showpeer":          {"getpeerinfo", "", "showpeer"},
+	"ban":               {"ban", "si", "ban <ip or subnet> [seconds]"},
+	"unban":             {"unban", "s", "unban <ip or subnet>"},
+	"listbanned":        {"listbanned", "", "listbanned"},
+	"stat":              {"getchainstats", "", "stat"},
+	"showworkers":       {"getworkerstats", "", "showworkers"},
+	"generate":          {"generate", "is", "generate <n> [name or public key]"},
+	"setmocktime":       {"setmocktime", "i", "setmocktime <unix time>"},
+	"getblocktemplate":  {"getblocktemplate", "", "getblocktemplate"},
+	"submitblock":       {"submitblock", "s", "submitblock <hex>"},
+	"getblockcount":     {"getblockcount", "", "getblockcount"},
+	"getbestblockhash":  {"getbestblockhash", "", "getbestblockhash"},
+	"getblockhash":      {"getblockhash", "i", "getblockhash <height>"},
+	"getblock":          {"getblock", "s", "getblock <hash>"},
+	"getblockfilter":    {"getblockfilter", "s", "getblockfilter <hash>"},
+	"getrawtransaction": {"getrawtransaction", "sb", "getrawtransaction <txid> [verbose]"},
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+// Arguments of unknown commands are sent as JSON if they parse, as strings otherwise
+func guessParam(arg string) json.RawMessage {
+	if json.Valid([]byte(arg)) {
+		return json.RawMessage(arg)
+	}
+	data, _ := json.Marshal(arg)
+	return data
+}
+
+func makeParams(name string, args []string) (method string, params []json.RawMessage, err error) {
+	cmd, ok := commands[name]
+	if !ok {
+		method = name
+		for _, arg := range args {
+			params = append(params, guessParam(arg))
+		}
+		return
+	}
+	method = cmd.method
+	if len(args) > len(cmd.args) {
+		return "", nil, errors.New("Usage: " + cmd.usage)
+	}
+	for i, arg := range args {
+		var data []byte
+		switch cmd.args[i] {
+		case argInt:
+			var v int64
+			v, err = strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return "", nil, errors.New("Usage: " + cmd.usage)
+			}
+			data, err = json.Marshal(v)
+		case argBool:
+			var v bool
+			v, err = strconv.ParseBool(arg)
+			if err != nil {
+				return "", nil, errors.New("Usage: " + cmd.usage)
+			}
+			data, err = json.Marshal(v)
+		default:
+			data, err = json.Marshal(arg)
+		}
+		if err != nil {
+			return
+		}
+		params = append(params, data)
+	}
+	return
+}
+
+func readCookie(path string) (user string, password string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(data)), ":", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("malformed cookie file " + path)
+	}
+	return parts[0], parts[1], nil
+}
+
+func call(url string, user string, password string, method string, params []json.RawMessage) (resp rpcResponse, err error) {
+	if params == nil {
+		params = []json.RawMessage{}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return
+	}
+	req.SetBasicAuth(user, password)
+	req.Header.Set("Content-Type", "application/json")
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode == http.StatusUnauthorized {
+		return resp, errors.New("incorrect rpcuser or rpcpassword")
+	}
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	return
+}
+
+func fail(v interface{}) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Fprintln(os.Stderr, string(data))
+	os.Exit(1)
+}
+
+func main() {
+	var datadir, conf, connect, user, password, cookie string
+	var port int
+	flag.StringVar(&datadir, "datadir", utils.DefaultDataDir(), "Data directory of the node")
+	flag.StringVar(&conf, "conf", "", "Config file shared with the node, defaults to "+utils.ConfigFileName+" in the data directory")
+	flag.StringVar(&connect, "rpcconnect", "127.0.0.1", "Host of the node's JSON-RPC server")
+	flag.IntVar(&port, "rpcport", 8332, "Port of the node's JSON-RPC server")
+	flag.StringVar(&user, "rpcuser", "", "User for JSON-RPC connections, the cookie file is read if empty")
+	flag.StringVar(&password, "rpcpassword", "", "Password for JSON-RPC connections")
+	flag.StringVar(&cookie, "rpccookiefile", "", "Cookie file written by the node, defaults to the data directory")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: bitebi-cli [options] <command> [args...]")
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "Commands:")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+		}
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	confGiven := conf != ""
+	if !confGiven {
+		conf = filepath.Join(datadir, utils.ConfigFileName)
+	}
+	// options meant for the node are skipped
+	err := utils.ApplyConfigFile(flag.CommandLine, conf, true)
+	if err != nil && (confGiven || !os.IsNotExist(err)) {
+		fail(rpcError{-1, err.Error()})
+	}
+	if cookie == "" {
+		cookie = filepath.Join(datadir, ".cookie")
+	}
+	if user == "" {
+		user, password, err = readCookie(cookie)
+		if err != nil {
+			fail(rpcError{-1, err.Error()})
+		}
+	}
+	method, params, err := makeParams(flag.Arg(0), flag.Args()[1:])
+	if err != nil {
+		fail(rpcError{-1, err.Error()})
+	}
+	resp, err := call("http://"+net.JoinHostPort(connect, strconv.Itoa(port)), user, password, method, params)
+	if err != nil {
+		fail(rpcError{-1, err.Error()})
+	}
+	if resp.Error != nil {
+		fail(resp.Error)
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, resp.Result, "", "  ") != nil {
+		out.Reset()
+		out.Write(resp.Result)
+	}
+	fmt.Println(out.String())
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMakeParams(t *testing.T) {
+	method, params, err := makeParams("transfer", []string{"self", "Alice", "3"})
+	if err != nil || method != "transfer" || len(params) != 3 {
+		t.Fatalf("Unexpected result: %v %v %v", method, params, err)
+	}
+	if string(params[1]) != `"Alice"` || string(params[2]) != "3" {
+		t.Fatalf("Unexpected params: %s %s", params[1], params[2])
+	}
+	if _, _, err = makeParams("transfer", []string{"self", "Alice", "three"}); err == nil {
+		t.Fatalf("Amount should be an integer")
+	}
+	method, params, err = makeParams("unknowncommand", []string{"12", "abc"})
+	if err != nil || method != "unknowncommand" || string(params[0]) != "12" || string(params[1]) != `"abc"` {
+		t.Fatalf("Unexpected result: %v %v %v", method, params, err)
+	}
+}
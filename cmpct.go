@@ -0,0 +1,234 @@
+package main
+
+import (
+	"math/rand"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Compact block relay, BIP152 version 1.
+// A compact block carries the header and short ids of the transactions,
+// which the receiver looks up in its mempool. Transactions it does not have
+// are asked for with getblocktxn, and if that cannot work the full block is requested.
+const cmpctVersion = 1
+
+// Blocks deeper than this are sent in full when asked for as compact blocks
+const maxCmpctDepth = 5
+
+// A compact block waiting for the transactions we asked for
+type partialBlock struct {
+	header  message.Block
+	hash    [32]byte
+	txns    []message.Transaction
+	missing []uint64
+}
+
+// Tell the peer we understand compact blocks. Only the peers we chose to
+// connect to may push them before announcing, like Bitcoin Core's high-bandwidth mode.
+func (c *PeerConnection) sendSendCmpct() error {
+	msg := message.SendCmpctMsg{Announce: !c.Inbound, Version: cmpctVersion}
+	data, err := utils.GetBytes(&msg)
+	if err != nil {
+		return err
+	}
+	return c.sendMessage("sendcmpct", data)
+}
+
+func (c *PeerConnection) onSendCmpct(data []byte) (err error) {
+	var msg message.SendCmpctMsg
+	err = decodePayload("sendcmpct", data, &msg)
+	if err != nil || msg.Version != cmpctVersion {
+		return
+	}
+	c.mtx.Lock()
+	c.cmpct = true
+	c.cmpctAnnounce = msg.Announce
+	c.mtx.Unlock()
+	return
+}
+
+func (c *PeerConnection) cmpctModes() (supported bool, announce bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.cmpct, c.cmpctAnnounce
+}
+
+// Answer a getdata for a compact block, old blocks are sent in full
+func (c *PeerConnection) sendCmpctBlock(hash [32]byte) (err error) {
+	blk, depth, ok := c.peer.findBlock(hash)
+	if !ok {
+		return
+	}
+	supported, _ := c.cmpctModes()
+	if !supported || depth < 0 || depth > maxCmpctDepth {
+		data, err := utils.GetBytes(&blk)
+		if err != nil {
+			return err
+		}
+		return c.sendMessage("block", data)
+	}
+	msg, err := message.NewCmpctBlock(&blk, rand.Uint64())
+	if err != nil {
+		return
+	}
+	data, err := utils.GetBytes(&msg)
+	if err != nil {
+		return
+	}
+	return c.sendMessage("cmpctblock", data)
+}
+
+func (c *PeerConnection) requestBlock(hash [32]byte) error {
+	msg := message.InvMsg{Inv: []message.Inventory{{Type: message.MSG_BLOCK, Hash: hash}}}
+	data, err := utils.GetBytes(&msg)
+	if err != nil {
+		return err
+	}
+	return c.sendMessage("getdata", data)
+}
+
+func (c *PeerConnection) onCmpctBlock(data []byte) (err error) {
+	var msg message.CmpctBlockMsg
+	err = decodePayload("cmpctblock", data, &msg)
+	if err != nil {
+		return
+	}
+	hash, err := utils.GetHash(&msg.Header)
+	if err != nil {
+		return
+	}
+	if utils.EasierThan(msg.Header.NBits, c.peer.Config.MaxNBits) || !utils.HasValidHash(hash, msg.Header.NBits) {
+		return &misbehavior{scoreInvalidBlock, "compact block with invalid proof of work"}
+	}
+	c.known.add(hash)
+	if _, _, ok := c.peer.findBlock(hash); ok {
+		return
+	}
+	if _, _, ok := c.peer.findBlock(msg.Header.Previous_block_header_hash); !ok {
+		// we are further behind than the announcement
+		return c.doBlockSync()
+	}
+	n := msg.TxCount()
+	if n == 0 {
+		return &misbehavior{scoreInvalidBlock, "compact block without transactions"}
+	}
+	pb := &partialBlock{header: msg.Header, hash: hash, txns: make([]message.Transaction, n)}
+	filled := make([]bool, n)
+	for _, v := range msg.Prefilled {
+		if v.Index >= uint64(n) || filled[v.Index] {
+			return &misbehavior{scoreInvalidBlock, "invalid prefilled transaction index"}
+		}
+		pb.txns[v.Index] = v.Tx
+		filled[v.Index] = true
+	}
+	// the short ids take the remaining positions in order
+	positions := make(map[uint64]int, len(msg.ShortIDs))
+	for i, j := 0, 0; i < n; i++ {
+		if filled[i] {
+			continue
+		}
+		id := msg.ShortIDs[j]
+		j++
+		if _, ok := positions[id]; ok {
+			// two transactions with one short id, only the full block can tell them apart
+			metricCmpctBlocks.With("fallback").Inc()
+			return c.requestBlock(hash)
+		}
+		positions[id] = i
+	}
+	k0, k1, err := msg.SipKeys()
+	if err != nil {
+		return
+	}
+	collided := make(map[int]bool)
+	c.peer.Chain.Mtx.Lock()
+	for txid, tx := range c.peer.Chain.Mempool {
+		i, ok := positions[message.ShortTxID(k0, k1, txid)]
+		if !ok {
+			continue
+		}
+		if filled[i] {
+			// ask for it rather than guess
+			collided[i] = true
+			continue
+		}
+		pb.txns[i] = tx
+		filled[i] = true
+	}
+	c.peer.Chain.Mtx.Unlock()
+	for i := range filled {
+		if !filled[i] || collided[i] {
+			pb.missing = append(pb.missing, uint64(i))
+		}
+	}
+	if len(pb.missing) == 0 {
+		return c.finishCmpctBlock(pb, "mempool")
+	}
+	c.partial = pb
+	req := message.GetBlockTxnMsg{BlockHash: hash, Indexes: pb.missing}
+	raw, err := utils.GetBytes(&req)
+	if err != nil {
+		return
+	}
+	return c.sendMessage("getblocktxn", raw)
+}
+
+func (c *PeerConnection) onGetBlockTxn(data []byte) (err error) {
+	var msg message.GetBlockTxnMsg
+	err = decodePayload("getblocktxn", data, &msg)
+	if err != nil {
+		return
+	}
+	blk, _, ok := c.peer.findBlock(msg.BlockHash)
+	if !ok {
+		netLog.Debug("Transactions asked for an unknown block", "addr", c.Conn.RemoteAddr(), "block", utils.HashToString(msg.BlockHash))
+		return
+	}
+	resp := message.BlockTxnMsg{BlockHash: msg.BlockHash, Txns: make([]message.Transaction, len(msg.Indexes))}
+	for i, index := range msg.Indexes {
+		if index >= uint64(len(blk.Txns)) {
+			return &misbehavior{scoreMalformed, "getblocktxn index out of range"}
+		}
+		resp.Txns[i] = blk.Txns[index]
+	}
+	raw, err := utils.GetBytes(&resp)
+	if err != nil {
+		return
+	}
+	return c.sendMessage("blocktxn", raw)
+}
+
+func (c *PeerConnection) onBlockTxn(data []byte) (err error) {
+	var msg message.BlockTxnMsg
+	err = decodePayload("blocktxn", data, &msg)
+	if err != nil {
+		return
+	}
+	pb := c.partial
+	if pb == nil || pb.hash != msg.BlockHash {
+		netLog.Debug("Unexpected blocktxn", "addr", c.Conn.RemoteAddr(), "block", utils.HashToString(msg.BlockHash))
+		return
+	}
+	c.partial = nil
+	if len(msg.Txns) != len(pb.missing) {
+		return &misbehavior{scoreInvalidBlock, "blocktxn does not match the compact block"}
+	}
+	for i, index := range pb.missing {
+		pb.txns[index] = msg.Txns[i]
+	}
+	return c.finishCmpctBlock(pb, "blocktxn")
+}
+
+// Process a reconstructed block. A short id may have matched the wrong
+// transaction, so the full block is asked for if the merkle root is off.
+func (c *PeerConnection) finishCmpctBlock(pb *partialBlock, result string) error {
+	if message.MakeMerkleTree(pb.txns) != pb.header.Merkle_root_hash {
+		netLog.Debug("Compact block reconstruction failed", "addr", c.Conn.RemoteAddr(), "block", utils.HashToString(pb.hash))
+		metricCmpctBlocks.With("fallback").Inc()
+		return c.requestBlock(pb.hash)
+	}
+	metricCmpctBlocks.With(result).Inc()
+	blk := message.SerializedBlock{Header: pb.header, HeaderHash: pb.hash, Txns: pb.txns}
+	return c.processBlock(&blk)
+}
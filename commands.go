@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/sshockwave/bitebi/logger"
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/p2p"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Operations shared by the command loop and the RPC server.
+// They report problems as errors instead of logging them.
+
+var errNoPeer = errors.New("A peer has not been initiated.")
+var errPeerRunning = errors.New("A server is already running!")
+var errStratumRunning = errors.New("A stratum server is already running!")
+var errNoStratum = errors.New("The stratum server is not running.")
+var errRPCRunning = errors.New("An RPC server is already running!")
+var errRESTRunning = errors.New("A REST server is already running!")
+var errMetricsRunning = errors.New("A metrics server is already running!")
+var errNoAddrIndex = errors.New("The address index is not enabled, start with -addrindex.")
+var errNoCFilterIndex = errors.New("The block filter index is not enabled, start with -blockfilterindex.")
+var errBadAmount = errors.New("The amount to transfer must be positive.")
+var errNotEnoughMoney = errors.New("No transfer was made, because your don't have enough money.")
+var errSPVMode = errors.New("Not available in lightweight mode, which keeps no blocks.")
+
+func (c *CmdApp) getPeer() (*Peer, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.hasPeer {
+		return nil, errNoPeer
+	}
+	return c.peer, nil
+}
+
+// Start listening for peers, a negative port means the default one
+func (c *CmdApp) StartServer(port int, network string) (err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.hasPeer {
+		return errPeerRunning
+	}
+	nc, ok := p2p.GetNetConfig(network)
+	if !ok {
+		return fmt.Errorf("Unknown network %v", network)
+	}
+	if port >= 0 {
+		nc.DefaultPort = port
+	}
+	whitelist := make([]*net.IPNet, len(c.cfg.Whitelist))
+	for i, s := range c.cfg.Whitelist {
+		whitelist[i], err = ParseSubnet(s)
+		if err != nil {
+			return
+		}
+	}
+	if c.cfg.SPV {
+		c.peer, err = NewSPVPeer(&c.blockchain, nc, c.cfg.Listen, -1)
+	} else {
+		c.peer, err = NewPeer(&c.blockchain, nc, c.cfg.Listen, -1)
+	}
+	if err != nil {
+		return
+	}
+	for _, subnet := range whitelist {
+		c.peer.Bans.Whitelist(subnet)
+	}
+	c.peer.SetLimits(ConnLimits{
+		MaxConnections: c.cfg.MaxConnections,
+		MaxOutbound:    c.cfg.MaxOutbound,
+		MaxPerIP:       c.cfg.MaxPerIP,
+	})
+	err = c.peer.Addrs.Load(filepath.Join(c.cfg.DataDir, "peers-"+nc.Name+".json"))
+	if err != nil {
+		netLog.Error("Cannot read the peer database, starting empty", "err", err)
+		err = nil
+	}
+	err = c.peer.Bans.Load(filepath.Join(c.cfg.DataDir, "banlist-"+nc.Name+".json"))
+	if err != nil {
+		netLog.Error("Cannot read the ban list, starting empty", "err", err)
+		err = nil
+	}
+	c.hasPeer = true
+	return
+}
+
+// Examples: easiest(0x20ffffff), hardest(0x03000000)
+func (c *CmdApp) StartMining(threads int) error {
+	peer, err := c.getPeer()
+	if err != nil {
+		return err
+	}
+	if peer.Headers != nil {
+		return errSPVMode
+	}
+	pk, err := c.lookupPK(c.cfg.MiningAddress)
+	if err != nil {
+		return err
+	}
+	go c.blockchain.mine(0, peer.Config.MaxNBits, peer, GenerateP2PKHPkScript(pk), threads)
+	return nil
+}
+
+func (c *CmdApp) Connect(addr string) error {
+	peer, err := c.getPeer()
+	if err != nil {
+		return err
+	}
+	err = peer.ConnectTo(addr)
+	if err != nil {
+		return fmt.Errorf("Dialing address %v failed: %v", addr, err)
+	}
+	return nil
+}
+
+func (c *CmdApp) AddPubKey(name string, pkstring string) error {
+	pk := Bytes2PK([]byte(pkstring))
+	if pk.Y == nil {
+		return fmt.Errorf("Invalid public key %v", pkstring)
+	}
+	c.Wallet.AddPubKey(name, pk)
+	return nil
+}
+
+func (c *CmdApp) AddPrivKey(name string, skstring string) error {
+	sk := Bytes2SK([]byte(skstring))
+	if sk.X == nil {
+		return fmt.Errorf("Invalid private key %v", skstring)
+	}
+	c.Wallet.AddPrivKey(name, sk)
+	if peer, err := c.getPeer(); err == nil {
+		// lightweight clients only hear of transactions matching their filter
+		peer.ReloadFilter()
+	}
+	return nil
+}
+
+// Resolve a wallet name or an encoded public key
+func (c *CmdApp) lookupPK(name string) (pk dsa.PublicKey, err error) {
+	pk, ok := c.Wallet.GetPK(name)
+	if ok {
+		return
+	}
+	pk = Bytes2PK([]byte(name))
+	if pk.Y == nil {
+		err = fmt.Errorf("No known pubkey for %v", name)
+	}
+	return
+}
+
+func (c *CmdApp) Transfer(fromAccount string, accountName string, amount int64) (txid [32]byte, err error) {
+	if amount <= 0 {
+		err = errBadAmount
+		return
+	}
+	peer, err := c.getPeer()
+	if err != nil {
+		return
+	}
+	accountName_PK, ok := c.Wallet.GetPK(accountName)
+	if !ok {
+		err = fmt.Errorf("No known pubkey for %v", accountName)
+		return
+	}
+	fromAccount_SK, ok := c.Wallet.GetSK(fromAccount)
+	if !ok {
+		err = fmt.Errorf("No known privkey for %v", fromAccount)
+		return
+	}
+	totalPayment, outpoints := c.Wallet.MakeTxIn(fromAccount, amount)
+	if totalPayment < amount {
+		err = errNotEnoughMoney
+		return
+	}
+	tx_In := []message.TxIn{}
+	for _, o := range outpoints {
+		tx_In = append(tx_In, message.TxIn{Previous_output: o})
+	}
+	oput := []message.TxOut{{Value: amount, Pk_script: GenerateP2PKHPkScript(accountName_PK)}}
+	if totalPayment > amount {
+		oput = append(oput, message.TxOut{
+			Value:     totalPayment - amount,
+			Pk_script: GenerateP2PKHPkScript(fromAccount_SK.PublicKey),
+		})
+	}
+	transaction := message.Transaction{
+		Version:   0,
+		Tx_in:     tx_In,
+		Tx_out:    oput,
+		Lock_time: 0,
+	}
+
+	signature := SignTransaction(fromAccount_SK, transaction)
+	for i := 0; i < len(transaction.Tx_in); i++ {
+		transaction.Tx_in[i].Signature_script = signature
+	}
+	txid, err = utils.GetHash(&transaction)
+	if err != nil {
+		return
+	}
+
+	c.blockchain.Mtx.Lock()
+	c.blockchain.acceptTransaction(transaction)
+	mempool_size := len(c.blockchain.Mempool)
+	c.blockchain.Mtx.Unlock()
+	c.Wallet.RemoveUTXO(fromAccount, outpoints)
+	if mempool_size < 100 {
+		c.blockchain.refreshMining()
+	}
+	peer.BroadcastTransaction(transaction)
+	return
+}
+
+// Ban an IP address or subnet for some seconds, 0 means the default ban time
+func (c *CmdApp) Ban(subnet string, seconds int) error {
+	peer, err := c.getPeer()
+	if err != nil {
+		return err
+	}
+	ipnet, err := ParseSubnet(subnet)
+	if err != nil {
+		return err
+	}
+	d := DefaultBanTime
+	if seconds > 0 {
+		d = time.Duration(seconds) * time.Second
+	}
+	peer.Ban(ipnet, d, "manually banned")
+	return nil
+}
+
+func (c *CmdApp) Unban(subnet string) error {
+	peer, err := c.getPeer()
+	if err != nil {
+		return err
+	}
+	ipnet, err := ParseSubnet(subnet)
+	if err != nil {
+		return err
+	}
+	ok, err := peer.Bans.Unban(ipnet)
+	if err == nil && !ok {
+		err = fmt.Errorf("%v is not banned", ipnet)
+	}
+	return err
+}
+
+func (c *CmdApp) ListBanned() ([]BanEntry, error) {
+	peer, err := c.getPeer()
+	if err != nil {
+		return nil, err
+	}
+	return peer.Bans.List(), nil
+}
+
+func (c *CmdApp) GetPeerInfo() ([]PeerInfo, error) {
+	peer, err := c.getPeer()
+	if err != nil {
+		return nil, err
+	}
+	return peer.GetPeerInfo(), nil
+}
+
+type ChainStats struct {
+	Peers       int `json:"peers"`
+	Blocks      int `json:"blocks"`
+	Confirmed   int `json:"confirmed"`
+	Unconfirmed int `json:"unconfirmed"`
+}
+
+func (c *CmdApp) GetChainStats() (s ChainStats, err error) {
+	peer, err := c.getPeer()
+	if err != nil {
+		return
+	}
+	peer.lock.RLock()
+	s.Peers = len(peer.conns) + 1
+	peer.lock.RUnlock()
+	c.blockchain.Mtx.Lock()
+	s.Blocks = len(c.blockchain.Block)
+	if peer.Headers != nil {
+		_, height := peer.Headers.Tip()
+		s.Blocks = height + 1
+	}
+	s.Unconfirmed = len(c.blockchain.Mempool)
+	s.Confirmed = len(c.blockchain.TX) - s.Unconfirmed - len(c.blockchain.Block) + 1
+	c.blockchain.Mtx.Unlock()
+	return
+}
+
+func (c *CmdApp) GetBlockTemplate() (tmpl BlockTemplate, err error) {
+	peer, err := c.getPeer()
+	if err != nil {
+		return
+	}
+	if peer.Headers != nil {
+		err = errSPVMode
+		return
+	}
+	return c.blockchain.GetBlockTemplate(0, peer.Config.MaxNBits), nil
+}
+
+func (c *CmdApp) SubmitBlock(hexstr string) error {
+	peer, err := c.getPeer()
+	if err != nil {
+		return err
+	}
+	if peer.Headers != nil {
+		return errSPVMode
+	}
+	data, err := hex.DecodeString(hexstr)
+	if err != nil {
+		return fmt.Errorf("Block is not a hex string: %v", err)
+	}
+	var blk message.SerializedBlock
+	err = blk.LoadBuffer(utils.NewBufReader(bytes.NewBuffer(data)))
+	if err != nil {
+		return fmt.Errorf("Decoding block: %v", err)
+	}
+	return peer.SubmitBlock(blk)
+}
+
+// Mine n blocks paying to a wallet name or an encoded public key
+func (c *CmdApp) Generate(n int, account string) ([][32]byte, error) {
+	peer, err := c.getPeer()
+	if err != nil {
+		return nil, err
+	}
+	if peer.Headers != nil {
+		return nil, errSPVMode
+	}
+	pk, err := c.lookupPK(account)
+	if err != nil {
+		return nil, err
+	}
+	return peer.Generate(n, 0, GenerateP2PKHPkScript(pk))
+}
+
+var mockTimeNotRegtest = errors.New("mockTimeNotRegtest")
+
+// Freeze the clock, 0 goes back to the system clock.
+// Only allowed on regtest, like generate.
+func (c *CmdApp) SetMockTime(t int64) error {
+	peer, err := c.getPeer()
+	if err != nil {
+		return err
+	}
+	if !peer.Config.Regtest {
+		return mockTimeNotRegtest
+	}
+	if t == 0 {
+		utils.SetClock(nil)
+	} else {
+		utils.SetClock(utils.NewMockClock(time.Unix(t, 0)))
+	}
+	return nil
+}
+
+func (c *CmdApp) StartStratum(addr string, shareNBits uint32) (err error) {
+	peer, err := c.getPeer()
+	if err != nil {
+		return
+	}
+	if peer.Headers != nil {
+		return errSPVMode
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.stratum != nil {
+		return errStratumRunning
+	}
+	pk, err := c.lookupPK(c.cfg.MiningAddress)
+	if err != nil {
+		return
+	}
+	c.stratum, err = NewStratumServer(peer, GenerateP2PKHPkScript(pk), addr, shareNBits)
+	if err != nil {
+		c.stratum = nil
+	}
+	return
+}
+
+func (c *CmdApp) GetWorkerStats() (map[string]WorkerStats, error) {
+	c.mtx.Lock()
+	stratum := c.stratum
+	c.mtx.Unlock()
+	if stratum == nil {
+		return nil, errNoStratum
+	}
+	return stratum.GetWorkerStats(), nil
+}
+
+func (c *CmdApp) StartRPC(cfg RPCConfig) (err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.rpc != nil {
+		return errRPCRunning
+	}
+	c.rpc, err = NewRPCServer(c, cfg)
+	if err != nil {
+		c.rpc = nil
+	}
+	return
+}
+
+func (c *CmdApp) StartREST(addr string) (err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.rest != nil {
+		return errRESTRunning
+	}
+	c.rest, err = NewRESTServer(c, addr)
+	if err != nil {
+		c.rest = nil
+	}
+	return
+}
+
+func (c *CmdApp) StartMetrics(addr string) (err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.metrics != nil {
+		return errMetricsRunning
+	}
+	c.metrics, err = NewMetricsServer(c, addr)
+	if err != nil {
+		c.metrics = nil
+	}
+	return
+}
+
+// Turn on an index by name, building it from the current chain
+func (c *CmdApp) EnableIndex(name string) error {
+	b := &c.blockchain
+	b.Mtx.Lock()
+	defer b.Mtx.Unlock()
+	for _, idx := range b.Indexes {
+		if idx.Name() == name {
+			return nil
+		}
+	}
+	switch name {
+	case "txindex":
+		b.AddIndex(NewTxIndex())
+	case "addrindex":
+		b.AddIndex(NewAddrIndex())
+	case "blockfilterindex":
+		b.AddIndex(NewCFilterIndex())
+	default:
+		return fmt.Errorf("Unknown index %v", name)
+	}
+	return nil
+}
+
+func (c *CmdApp) Reindex() {
+	c.blockchain.Mtx.Lock()
+	c.blockchain.Reindex()
+	c.blockchain.Mtx.Unlock()
+}
+
+// Change log levels with a spec like "debug" or "warn,net=debug"
+// and return the levels now in effect
+func (c *CmdApp) SetLogLevel(spec string) (map[string]string, error) {
+	err := logger.SetLevels(spec)
+	if err != nil {
+		return nil, err
+	}
+	return logger.Levels(), nil
+}
+
+func (c *CmdApp) Rescan(name string) error {
+	if !c.Wallet.Rescan(name) {
+		return fmt.Errorf("No known privkey for %v", name)
+	}
+	return nil
+}
+
+// Outputs received and spent by a wallet name or an encoded public key
+func (c *CmdApp) GetAddressHistory(account string, unspentOnly bool) ([]AddrEventJSON, error) {
+	addr := account
+	if pk, ok := c.Wallet.GetPK(account); ok {
+		addr = string(PK2Bytes(pk))
+	}
+	c.blockchain.Mtx.Lock()
+	defer c.blockchain.Mtx.Unlock()
+	idx := c.blockchain.GetAddrIndex()
+	if idx == nil {
+		return nil, errNoAddrIndex
+	}
+	events := idx.History(addr)
+	if unspentOnly {
+		events = idx.Unspent(addr)
+	}
+	ret := make([]AddrEventJSON, len(events))
+	for i := range events {
+		ret[i] = events[i].JSON()
+	}
+	return ret, nil
+}
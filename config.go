@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
+const DefaultMaxConnections = 125
+const DefaultMaxOutbound = 8
+const DefaultMaxPerIP = 4
+
+// Startup options of the node.
+// Every option can be given as a flag or as a line in the config file,
+// flags take precedence.
+type Config struct {
+	DataDir        string
+	ConfigFile     string
+	Input          string
+	Daemon         bool
+	Network        string
+	Listen         string
+	Port           int
+	Peers          []string
+	MaxConnections int
+	MaxOutbound    int
+	MaxPerIP       int
+	Whitelist      []string
+	SPV            bool
+	Mine           bool
+	MineThreads    int
+	MiningAddress  string
+	LogLevel       string
+	LogJSON        bool
+	Server         bool
+	RPC            RPCConfig
+	RPCBind        string
+	RPCPort        int
+	TxIndex        bool
+	AddrIndex      bool
+	CFilterIndex   bool
+	REST           bool
+	RESTBind       string
+	RESTPort       int
+	Metrics        bool
+	MetricsBind    string
+	MetricsPort    int
+}
+
+// A flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func ParseConfig(name string, args []string) (cfg Config, err error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&cfg.DataDir, "datadir", utils.DefaultDataDir(), "Directory for the config file and node data")
+	fs.StringVar(&cfg.ConfigFile, "conf", "", "Config file, defaults to "+utils.ConfigFileName+" in the data directory")
+	fs.StringVar(&cfg.Input, "input", "-", "Input File")
+	fs.BoolVar(&cfg.Daemon, "daemon", false, "Run in the background without reading commands, implies -server")
+	fs.StringVar(&cfg.Network, "network", "bitebinet", "Network to join: mainnet, testnet, regtest or bitebinet")
+	fs.StringVar(&cfg.Listen, "listen", "0.0.0.0", "Address to listen for peers on")
+	fs.IntVar(&cfg.Port, "port", -1, "Start listening for peers on this port at startup")
+	fs.Var((*stringList)(&cfg.Peers), "addnode", "Connect to this peer at startup, can be repeated")
+	fs.IntVar(&cfg.MaxConnections, "maxconnections", DefaultMaxConnections, "Maximum number of peer connections, those not used by -maxoutbound take inbound connections")
+	fs.IntVar(&cfg.MaxOutbound, "maxoutbound", DefaultMaxOutbound, "Outbound connections opened to known peer addresses, 0 to only connect to -addnode")
+	fs.IntVar(&cfg.MaxPerIP, "maxperip", DefaultMaxPerIP, "Maximum inbound connections from one IP address, 0 for no limit")
+	fs.Var((*stringList)(&cfg.Whitelist), "whitelist", "Never ban peers from this IP address or subnet, only disconnect them, can be repeated")
+	fs.BoolVar(&cfg.SPV, "spv", false, "Keep only block headers, and follow wallet transactions with filtered blocks")
+	fs.BoolVar(&cfg.Mine, "mine", false, "Start mining at startup")
+	fs.IntVar(&cfg.MineThreads, "minethreads", 0, "Number of mining threads, 0 for one per CPU")
+	fs.StringVar(&cfg.MiningAddress, "miningaddress", "self", "Wallet name or public key receiving mined coins")
+	fs.StringVar(&cfg.LogLevel, "loglevel", "info", "Least severe log level shown: debug, info, warn, error or off, per subsystem like warn,net=debug")
+	fs.BoolVar(&cfg.LogJSON, "logjson", false, "Write logs as JSON lines")
+	fs.BoolVar(&cfg.Server, "server", false, "Accept JSON-RPC commands")
+	fs.StringVar(&cfg.RPCBind, "rpcbind", "127.0.0.1", "Address of the JSON-RPC server")
+	fs.IntVar(&cfg.RPCPort, "rpcport", DefaultRPCPort, "Port of the JSON-RPC server")
+	fs.StringVar(&cfg.RPC.User, "rpcuser", "", "User for JSON-RPC connections, a cookie file is used if empty")
+	fs.StringVar(&cfg.RPC.Password, "rpcpassword", "", "Password for JSON-RPC connections")
+	fs.StringVar(&cfg.RPC.CookieFile, "rpccookiefile", "", "Where the JSON-RPC cookie is written, defaults to the data directory")
+	fs.BoolVar(&cfg.TxIndex, "txindex", false, "Index transactions by id")
+	fs.BoolVar(&cfg.AddrIndex, "addrindex", false, "Index the outputs and spends of every address")
+	fs.BoolVar(&cfg.CFilterIndex, "blockfilterindex", false, "Build compact block filters and serve them to peers")
+	fs.BoolVar(&cfg.REST, "rest", false, "Serve the read-only block explorer API")
+	fs.StringVar(&cfg.RESTBind, "restbind", "127.0.0.1", "Address of the REST server")
+	fs.IntVar(&cfg.RESTPort, "restport", DefaultRESTPort, "Port of the REST server")
+	fs.BoolVar(&cfg.Metrics, "metrics", false, "Serve Prometheus metrics at /metrics")
+	fs.StringVar(&cfg.MetricsBind, "metricsbind", "127.0.0.1", "Address of the metrics server")
+	fs.IntVar(&cfg.MetricsPort, "metricsport", DefaultMetricsPort, "Port of the metrics server")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	confGiven := cfg.ConfigFile != ""
+	if !confGiven {
+		cfg.ConfigFile = filepath.Join(cfg.DataDir, utils.ConfigFileName)
+	}
+	err = utils.ApplyConfigFile(fs, cfg.ConfigFile, false)
+	if os.IsNotExist(err) && !confGiven {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	if cfg.RPC.CookieFile == "" {
+		cfg.RPC.CookieFile = filepath.Join(cfg.DataDir, DefaultCookieFile)
+	}
+	if cfg.Daemon {
+		cfg.Server = true
+	}
+	return
+}
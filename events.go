@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sshockwave/bitebi/websocket"
+)
+
+// Topics published on the event bus
+const (
+	TopicBlockConnected    = "blockconnected"
+	TopicBlockDisconnected = "blockdisconnected"
+	TopicTxAccepted        = "txaccepted"
+	TopicTxRemoved         = "txremoved"
+	TopicWalletBalance     = "walletbalance"
+	TopicPeerConnected     = "peerconnected"
+	TopicPeerDisconnected  = "peerdisconnected"
+)
+
+var AllTopics = []string{
+	TopicBlockConnected,
+	TopicBlockDisconnected,
+	TopicTxAccepted,
+	TopicTxRemoved,
+	TopicWalletBalance,
+	TopicPeerConnected,
+	TopicPeerDisconnected,
+}
+
+// Events a subscriber has not read yet, more are dropped
+const EventQueueSize = 256
+
+type Event struct {
+	Topic string      `json:"topic"`
+	Data  interface{} `json:"data"`
+}
+
+type BlockEvent struct {
+	Hash   string `json:"hash"`
+	Height int    `json:"height"`
+}
+
+type TxEvent struct {
+	Txid string `json:"txid"`
+	// accepted: "new" or "reorg", removed: "confirmed" or "invalid"
+	Reason string `json:"reason"`
+}
+
+type BalanceEvent struct {
+	Account string `json:"account"`
+	Balance int64  `json:"balance"`
+}
+
+type PeerEvent struct {
+	Addr string `json:"addr"`
+}
+
+// Publish never blocks, so it is safe to call with any lock held
+type EventBus struct {
+	mtx  sync.Mutex
+	subs map[*Subscription]void
+}
+
+type Subscription struct {
+	C       chan Event
+	bus     *EventBus
+	topics  map[string]bool // protected by bus.mtx
+	dropped uint64
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*Subscription]void)}
+}
+
+func (bus *EventBus) Subscribe(topics ...string) *Subscription {
+	s := &Subscription{
+		C:      make(chan Event, EventQueueSize),
+		bus:    bus,
+		topics: make(map[string]bool),
+	}
+	for _, t := range topics {
+		s.topics[t] = true
+	}
+	bus.mtx.Lock()
+	bus.subs[s] = void_null
+	bus.mtx.Unlock()
+	return s
+}
+
+// Does nothing on a nil bus
+func (bus *EventBus) Publish(topic string, data interface{}) {
+	if bus == nil {
+		return
+	}
+	bus.mtx.Lock()
+	defer bus.mtx.Unlock()
+	for s := range bus.subs {
+		if !s.topics[topic] {
+			continue
+		}
+		select {
+		case s.C <- Event{topic, data}:
+		default:
+			if atomic.AddUint64(&s.dropped, 1) == 1 {
+				rpcLog.Warn("Event subscriber is too slow, dropping events")
+			}
+		}
+	}
+}
+
+func (s *Subscription) Add(topics ...string) {
+	s.bus.mtx.Lock()
+	defer s.bus.mtx.Unlock()
+	for _, t := range topics {
+		s.topics[t] = true
+	}
+}
+
+func (s *Subscription) Remove(topics ...string) {
+	s.bus.mtx.Lock()
+	defer s.bus.mtx.Unlock()
+	for _, t := range topics {
+		delete(s.topics, t)
+	}
+}
+
+// Number of events that did not fit in the queue
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) Close() {
+	s.bus.mtx.Lock()
+	defer s.bus.mtx.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.C)
+	}
+}
+
+func IsTopic(name string) bool {
+	for _, t := range AllTopics {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Sent by WebSocket clients to change their topics, "all" stands for every topic
+type eventRequest struct {
+	Subscribe   []string `json:"subscribe"`
+	Unsubscribe []string `json:"unsubscribe"`
+}
+
+type eventReply struct {
+	Topics []string `json:"topics,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+func expandTopics(names []string) ([]string, error) {
+	var ret []string
+	for _, name := range names {
+		if name == "all" {
+			ret = append(ret, AllTopics...)
+		} else if IsTopic(name) {
+			ret = append(ret, name)
+		} else {
+			return nil, fmt.Errorf("Unknown topic %v", name)
+		}
+	}
+	return ret, nil
+}
+
+func (s *Subscription) Topics() (ret []string) {
+	s.bus.mtx.Lock()
+	defer s.bus.mtx.Unlock()
+	for _, t := range AllTopics {
+		if s.topics[t] {
+			ret = append(ret, t)
+		}
+	}
+	return
+}
+
+// Stream events to a WebSocket client.
+// Initial topics can be given as ?topics=blockconnected,txaccepted
+func ServeEvents(bus *EventBus, w http.ResponseWriter, r *http.Request) {
+	var initial []string
+	if q := r.URL.Query().Get("topics"); q != "" {
+		var err error
+		initial, err = expandTopics(strings.Split(q, ","))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	rpcLog.Info("Event subscriber connected", "addr", conn.RemoteAddr())
+	sub := bus.Subscribe(initial...)
+	go func() {
+		defer sub.Close()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var req eventRequest
+			var reply eventReply
+			err = json.Unmarshal(data, &req)
+			var add, remove []string
+			if err == nil {
+				add, err = expandTopics(req.Subscribe)
+			}
+			if err == nil {
+				remove, err = expandTopics(req.Unsubscribe)
+			}
+			if err != nil {
+				reply.Error = err.Error()
+			} else {
+				sub.Add(add...)
+				sub.Remove(remove...)
+				reply.Topics = sub.Topics()
+			}
+			data, _ = json.Marshal(reply)
+			if conn.WriteText(data) != nil {
+				return
+			}
+		}
+	}()
+	for ev := range sub.C {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			rpcLog.Error("Encoding event failed", "topic", ev.Topic, "err", err)
+			continue
+		}
+		if conn.WriteText(data) != nil {
+			break
+		}
+	}
+	sub.Close()
+	conn.Close()
+	rpcLog.Info("Event subscriber disconnected", "addr", conn.RemoteAddr())
+}
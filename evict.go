@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sort"
+	"time"
+)
+
+type ConnLimits struct {
+	// inbound and outbound together, 0 means no limit
+	MaxConnections int
+	// opened to known addresses, the rest of MaxConnections is left for inbound
+	MaxOutbound int
+	// inbound connections from one IP, 0 means no limit.
+	// Loopback addresses are not limited, local test networks share them.
+	MaxPerIP int
+}
+
+// Kept when choosing a connection to evict, in each category below
+const evictProtect = 4
+
+// Makes the order of network groups unpredictable
+var evictSalt = func() (salt [16]byte) {
+	rand.Read(salt[:])
+	return
+}()
+
+func groupRank(group string) uint64 {
+	h := sha256.Sum256(append(evictSalt[:], group...))
+	return binary.LittleEndian.Uint64(h[:])
+}
+
+func (p *Peer) SetLimits(l ConnLimits) {
+	p.lock.Lock()
+	p.limits = l
+	p.lock.Unlock()
+}
+
+func (p *Peer) maxInbound() int {
+	if p.limits.MaxConnections <= 0 {
+		return -1
+	}
+	n := p.limits.MaxConnections - p.limits.MaxOutbound
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// Whether a new inbound connection from addr may be served,
+// an existing one is evicted if the inbound slots are full
+func (p *Peer) acceptInbound(addr *net.TCPAddr) bool {
+	p.lock.RLock()
+	inbound, sameIP := 0, 0
+	for c := range p.conns {
+		if !c.Inbound {
+			continue
+		}
+		inbound++
+		if ConnectionToAddr(c.Conn.RemoteAddr()).IP.Equal(addr.IP) {
+			sameIP++
+		}
+	}
+	max := p.maxInbound()
+	perIP := p.limits.MaxPerIP
+	var victim *PeerConnection
+	if max >= 0 && inbound >= max {
+		victim = p.selectEviction()
+	}
+	p.lock.RUnlock()
+	if perIP > 0 && sameIP >= perIP && !addr.IP.IsLoopback() {
+		netLog.Info("Refusing connection, too many connections from this address", "addr", addr.String())
+		return false
+	}
+	if max >= 0 && inbound >= max {
+		if victim == nil {
+			netLog.Info("Refusing connection, too many connections", "addr", addr.String())
+			return false
+		}
+		netLog.Info("Evicting a connection to make room", "addr", victim.Conn.RemoteAddr(), "for", addr.String())
+		// Serve notices and cleans up
+		victim.Conn.Close()
+	}
+	return true
+}
+
+type evictCandidate struct {
+	conn      *PeerConnection
+	group     string
+	connected time.Time
+	rtt       time.Duration
+	lastBlock time.Time
+	lastTx    time.Time
+}
+
+// Drop the first n candidates after sorting with less,
+// ties go to the connection that has been up longer
+func protect(list []evictCandidate, n int, less func(a, b *evictCandidate) bool) []evictCandidate {
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := &list[i], &list[j]
+		if less(a, b) || less(b, a) {
+			return less(a, b)
+		}
+		return a.connected.Before(b.connected)
+	})
+	if n > len(list) {
+		n = len(list)
+	}
+	return list[n:]
+}
+
+// Pick an inbound connection to drop, following Bitcoin Core: connections that are
+// fast, recently useful, long-lived or from rare network groups are kept, and the
+// newest connection of the group with the most connections is chosen.
+// Returns nil if every connection is protected. p.lock should be held.
+func (p *Peer) selectEviction() *PeerConnection {
+	var list []evictCandidate
+	for c := range p.conns {
+		if !c.Inbound {
+			continue
+		}
+		cand := evictCandidate{conn: c, group: addrGroup(ConnectionToAddr(c.Conn.RemoteAddr()).IP)}
+		c.mtx.Lock()
+		cand.connected = c.connectedAt
+		cand.rtt = c.rtt
+		cand.lastBlock = c.lastBlock
+		cand.lastTx = c.lastTx
+		c.mtx.Unlock()
+		list = append(list, cand)
+	}
+	// groups an attacker is unlikely to have
+	list = protect(list, evictProtect, func(a, b *evictCandidate) bool {
+		return groupRank(a.group) < groupRank(b.group)
+	})
+	// lowest ping time, unknown ones last
+	list = protect(list, evictProtect, func(a, b *evictCandidate) bool {
+		if a.rtt == 0 || b.rtt == 0 {
+			return a.rtt != 0
+		}
+		return a.rtt < b.rtt
+	})
+	list = protect(list, evictProtect, func(a, b *evictCandidate) bool {
+		return a.lastTx.After(b.lastTx)
+	})
+	list = protect(list, evictProtect, func(a, b *evictCandidate) bool {
+		return a.lastBlock.After(b.lastBlock)
+	})
+	// half of the rest that have been connected longest
+	list = protect(list, len(list)/2, func(a, b *evictCandidate) bool {
+		return a.connected.Before(b.connected)
+	})
+	if len(list) == 0 {
+		return nil
+	}
+	groups := make(map[string][]evictCandidate)
+	for _, cand := range list {
+		groups[cand.group] = append(groups[cand.group], cand)
+	}
+	var worst []evictCandidate
+	var worstNewest time.Time
+	for _, g := range groups {
+		newest := g[0].connected
+		for _, cand := range g {
+			if cand.connected.After(newest) {
+				newest = cand.connected
+			}
+		}
+		if len(g) > len(worst) || (len(g) == len(worst) && newest.After(worstNewest)) {
+			worst, worstNewest = g, newest
+		}
+	}
+	victim := worst[0]
+	for _, cand := range worst {
+		if cand.connected.After(victim.connected) {
+			victim = cand
+		}
+	}
+	return victim.conn
+}
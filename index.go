@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Optional indexes over the active chain.
+// They follow addBlock as blocks are connected and disconnected,
+// and can be rebuilt from the stored blocks at any time.
+// All methods must be called with the Mtx of the chain held.
+type Indexer interface {
+	Name() string
+	// Blocks are connected in increasing height
+	ConnectBlock(b *BlockChain, blk *message.SerializedBlock, height int)
+	// Blocks are disconnected from the tip
+	DisconnectBlock(b *BlockChain, blk *message.SerializedBlock, height int)
+	Reset()
+}
+
+// Where a confirmed transaction is
+type TxLocation struct {
+	BlockHash [32]byte
+	Height    int
+	// Position in the block
+	Index int
+}
+
+// txid -> location in the active chain
+type TxIndex struct {
+	locations map[[32]byte]TxLocation
+}
+
+func NewTxIndex() *TxIndex {
+	idx := new(TxIndex)
+	idx.Reset()
+	return idx
+}
+
+func (idx *TxIndex) Name() string {
+	return "txindex"
+}
+
+func (idx *TxIndex) Reset() {
+	idx.locations = make(map[[32]byte]TxLocation)
+}
+
+func (idx *TxIndex) ConnectBlock(b *BlockChain, blk *message.SerializedBlock, height int) {
+	for i := range blk.Txns {
+		txid, _ := utils.GetHash(&blk.Txns[i])
+		idx.locations[txid] = TxLocation{blk.HeaderHash, height, i}
+	}
+}
+
+func (idx *TxIndex) DisconnectBlock(b *BlockChain, blk *message.SerializedBlock, height int) {
+	for i := range blk.Txns {
+		txid, _ := utils.GetHash(&blk.Txns[i])
+		delete(idx.locations, txid)
+	}
+}
+
+func (idx *TxIndex) Lookup(txid [32]byte) (loc TxLocation, ok bool) {
+	loc, ok = idx.locations[txid]
+	return
+}
+
+// An output paying to an address, or an input spending such an output
+type AddrEvent struct {
+	Outpoint message.Outpoint
+	// The transaction creating or spending the output
+	Txid   [32]byte
+	Spend  bool
+	Value  int64
+	Height int
+}
+
+type AddrEventJSON struct {
+	Txid   string `json:"txid"`
+	Vout   uint32 `json:"vout"`
+	Value  int64  `json:"value"`
+	Height int    `json:"height"`
+	// Spends have the spending transaction here, and the output spent above
+	SpentBy string `json:"spentby,omitempty"`
+}
+
+func (e AddrEvent) JSON() (j AddrEventJSON) {
+	j = AddrEventJSON{
+		Txid:   utils.HashToString(e.Outpoint.Hash),
+		Vout:   e.Outpoint.Index,
+		Value:  e.Value,
+		Height: e.Height,
+	}
+	if e.Spend {
+		j.SpentBy = utils.HashToString(e.Txid)
+	}
+	return
+}
+
+// address -> outputs received and spent, in chain order
+type AddrIndex struct {
+	events map[string][]AddrEvent
+}
+
+// The address of a P2PKH script is the encoded public key,
+// other scripts are identified by their hex.
+func ScriptAddress(pk_script []byte) string {
+	operations := strings.FieldsFunc(string(pk_script), split)
+	if len(operations) == 2 && operations[1] == "OP CHECKSIG" {
+		return operations[0]
+	}
+	return hex.EncodeToString(pk_script)
+}
+
+func NewAddrIndex() *AddrIndex {
+	idx := new(AddrIndex)
+	idx.Reset()
+	return idx
+}
+
+func (idx *AddrIndex) Name() string {
+	return "addrindex"
+}
+
+func (idx *AddrIndex) Reset() {
+	idx.events = make(map[string][]AddrEvent)
+}
+
+func (idx *AddrIndex) ConnectBlock(b *BlockChain, blk *message.SerializedBlock, height int) {
+	for i := range blk.Txns {
+		tx := &blk.Txns[i]
+		txid, _ := utils.GetHash(tx)
+		for j := 0; j < len(tx.Tx_in) && i != 0; j++ {
+			prev := tx.Tx_in[j].Previous_output
+			prevTx, ok := b.TX[prev.Hash]
+			if !ok || int(prev.Index) >= len(prevTx.Tx_out) {
+				continue
+			}
+			out := prevTx.Tx_out[prev.Index]
+			addr := ScriptAddress(out.Pk_script)
+			idx.events[addr] = append(idx.events[addr], AddrEvent{prev, txid, true, out.Value, height})
+		}
+		for j, out := range tx.Tx_out {
+			addr := ScriptAddress(out.Pk_script)
+			o := message.NewOutPoint(txid, uint32(j))
+			idx.events[addr] = append(idx.events[addr], AddrEvent{o, txid, false, out.Value, height})
+		}
+	}
+}
+
+func (idx *AddrIndex) DisconnectBlock(b *BlockChain, blk *message.SerializedBlock, height int) {
+	trim := func(addr string) {
+		events := idx.events[addr]
+		n := len(events)
+		for n > 0 && events[n-1].Height >= height {
+			n--
+		}
+		if n == 0 {
+			delete(idx.events, addr)
+		} else {
+			idx.events[addr] = events[:n]
+		}
+	}
+	for i := range blk.Txns {
+		tx := &blk.Txns[i]
+		for j := 0; j < len(tx.Tx_in) && i != 0; j++ {
+			prev := tx.Tx_in[j].Previous_output
+			if prevTx, ok := b.TX[prev.Hash]; ok && int(prev.Index) < len(prevTx.Tx_out) {
+				trim(ScriptAddress(prevTx.Tx_out[prev.Index].Pk_script))
+			}
+		}
+		for _, out := range tx.Tx_out {
+			trim(ScriptAddress(out.Pk_script))
+		}
+	}
+}
+
+func (idx *AddrIndex) History(addr string) []AddrEvent {
+	return idx.events[addr]
+}
+
+// Outputs paid to the address and not spent in the chain
+func (idx *AddrIndex) Unspent(addr string) (ret []AddrEvent) {
+	spent := make(map[message.Outpoint]bool)
+	for _, e := range idx.events[addr] {
+		if e.Spend {
+			spent[e.Outpoint] = true
+		}
+	}
+	for _, e := range idx.events[addr] {
+		if !e.Spend && !spent[e.Outpoint] {
+			ret = append(ret, e)
+		}
+	}
+	return
+}
+
+type txInfo struct {
+	message.TransactionJSON
+	// Empty for transactions in the mempool
+	BlockHash     string `json:"blockhash,omitempty"`
+	Confirmations int    `json:"confirmations"`
+}
+
+// Find the block containing a confirmed transaction, -1 if it is not in the chain.
+// Without a transaction index all blocks are searched.
+// Must be called with Mtx held.
+func (b *BlockChain) findTxBlock(txid [32]byte) int {
+	if _, ok := b.Mempool[txid]; ok {
+		return -1
+	}
+	if idx := b.GetTxIndex(); idx != nil {
+		loc, ok := idx.Lookup(txid)
+		if !ok {
+			return -1
+		}
+		return loc.Height
+	}
+	for height := len(b.Block) - 1; height >= 0; height-- {
+		for i := range b.Block[height].Txns {
+			hash, _ := utils.GetHash(&b.Block[height].Txns[i])
+			if hash == txid {
+				return height
+			}
+		}
+	}
+	return -1
+}
+
+// Must be called with Mtx held
+func (b *BlockChain) getTxInfo(txid [32]byte) (ret txInfo, ok bool) {
+	tx, ok := b.TX[txid]
+	if !ok {
+		return
+	}
+	ret.TransactionJSON = tx.JSON()
+	if height := b.findTxBlock(txid); height >= 0 {
+		ret.BlockHash = utils.HashToString(b.Block[height].HeaderHash)
+		ret.Confirmations = len(b.Block) - height
+	}
+	return
+}
+
+// Build an index from the blocks of the chain and keep it updated
+func (b *BlockChain) AddIndex(idx Indexer) {
+	idx.Reset()
+	for height := range b.Block {
+		idx.ConnectBlock(b, &b.Block[height], height)
+	}
+	b.Indexes = append(b.Indexes, idx)
+}
+
+func (b *BlockChain) Reindex() {
+	for _, idx := range b.Indexes {
+		idx.Reset()
+		for height := range b.Block {
+			idx.ConnectBlock(b, &b.Block[height], height)
+		}
+	}
+}
+
+func (b *BlockChain) GetTxIndex() *TxIndex {
+	for _, idx := range b.Indexes {
+		if ret, ok := idx.(*TxIndex); ok {
+			return ret
+		}
+	}
+	return nil
+}
+
+func (b *BlockChain) GetAddrIndex() *AddrIndex {
+	for _, idx := range b.Indexes {
+		if ret, ok := idx.(*AddrIndex); ok {
+			return ret
+		}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/sshockwave/bitebi/logger"
+)
+
+// Loggers of the subsystems, levels can be changed with the loglevel command
+var (
+	nodeLog    = logger.New("node")
+	netLog     = logger.New("net")
+	chainLog   = logger.New("chain")
+	mempoolLog = logger.New("mempool")
+	walletLog  = logger.New("wallet")
+	minerLog   = logger.New("miner")
+	rpcLog     = logger.New("rpc")
+)
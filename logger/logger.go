@@ -0,0 +1,266 @@
+// Leveled logging with subsystem tags and key/value fields.
+//
+//	var netLog = logger.New("net")
+//	netLog.Info("Connection ended", "addr", conn.RemoteAddr())
+//
+// prints
+//
+//	2022/05/01 12:00:00 [INFO] [net] Connection ended addr=127.0.0.1:8333
+//
+// or, with JSON output turned on,
+//
+//	{"time":"2022-05-01T12:00:00Z","level":"info","subsystem":"net","msg":"Connection ended","addr":"127.0.0.1:8333"}
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	// Only used to silence a subsystem
+	LevelOff
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "off"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "warning":
+		return LevelWarn, nil
+	case "fatal":
+		return LevelError, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %v", s)
+}
+
+var ErrUnknownSubsystem = errors.New("unknown subsystem")
+
+var (
+	mtx          sync.Mutex
+	out          io.Writer = os.Stderr
+	jsonOutput   bool
+	defaultLevel = LevelInfo
+	subsystems   = make(map[string]*Logger)
+)
+
+// Messages of one subsystem
+type Logger struct {
+	subsystem string
+	level     Level // protected by mtx
+}
+
+// Loggers with the same subsystem are shared
+func New(subsystem string) *Logger {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if l, ok := subsystems[subsystem]; ok {
+		return l
+	}
+	l := &Logger{subsystem: subsystem, level: defaultLevel}
+	subsystems[subsystem] = l
+	return l
+}
+
+func SetOutput(w io.Writer) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	out = w
+}
+
+func SetJSON(on bool) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	jsonOutput = on
+}
+
+// Change the level of one subsystem, or of all of them if subsystem is empty
+func SetLevel(subsystem string, level Level) error {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if subsystem == "" {
+		defaultLevel = level
+		for _, l := range subsystems {
+			l.level = level
+		}
+		return nil
+	}
+	l, ok := subsystems[subsystem]
+	if !ok {
+		return fmt.Errorf("%w %v", ErrUnknownSubsystem, subsystem)
+	}
+	l.level = level
+	return nil
+}
+
+// Apply a level spec like "info" or "warn,net=debug,miner=error"
+func SetLevels(spec string) error {
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem := ""
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			subsystem, part = part[:i], part[i+1:]
+		}
+		level, err := ParseLevel(part)
+		if err != nil {
+			return err
+		}
+		err = SetLevel(subsystem, level)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Current level of every subsystem
+func Levels() map[string]string {
+	mtx.Lock()
+	defer mtx.Unlock()
+	ret := make(map[string]string)
+	for name, l := range subsystems {
+		ret[name] = l.level.String()
+	}
+	return ret
+}
+
+func Subsystems() []string {
+	mtx.Lock()
+	defer mtx.Unlock()
+	ret := make([]string, 0, len(subsystems))
+	for name := range subsystems {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	mtx.Lock()
+	defer mtx.Unlock()
+	return level >= l.level
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return v
+}
+
+func formatText(now time.Time, level Level, subsystem string, msg string, kv []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+	buf.WriteString("[" + strings.ToUpper(level.String()) + "] [" + subsystem + "] ")
+	buf.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		s := fmt.Sprint(fieldValue(kv[i+1]))
+		if s == "" || strings.ContainsAny(s, " \"=\n") {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(&buf, " %v=%v", kv[i], s)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func formatJSON(now time.Time, level Level, subsystem string, msg string, kv []interface{}) []byte {
+	// keep the fixed keys first
+	var buf bytes.Buffer
+	field := func(key string, v interface{}) {
+		k, _ := json.Marshal(key)
+		data, err := json.Marshal(v)
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(v))
+		}
+		buf.WriteByte(',')
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(data)
+	}
+	field("time", now.UTC().Format(time.RFC3339Nano))
+	field("level", level.String())
+	field("subsystem", subsystem)
+	field("msg", msg)
+	for i := 0; i < len(kv); i += 2 {
+		field(fmt.Sprint(kv[i]), fieldValue(kv[i+1]))
+	}
+	data := buf.Bytes()
+	data[0] = '{'
+	return append(data, '}', '\n')
+}
+
+// Key/value pairs follow the message, a missing last value is shown as "!MISSING"
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if len(kv)%2 == 1 {
+		kv = append(kv, "!MISSING")
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if level < l.level {
+		return
+	}
+	now := time.Now()
+	var line []byte
+	if jsonOutput {
+		line = formatJSON(now, level, l.subsystem, msg, kv)
+	} else {
+		line = formatText(now, level, l.subsystem, msg, kv)
+	}
+	out.Write(line)
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+// Log at error level and exit, only for problems at startup
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
@@ -0,0 +1,60 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	kv := []interface{}{"addr", "127.0.0.1:8333", "err", errors.New("connection reset"), "n", 3}
+	line := string(formatText(now, LevelWarn, "net", "Connection ended", kv))
+	expect := "2022/05/01 12:00:00 [WARN] [net] Connection ended addr=127.0.0.1:8333 err=\"connection reset\" n=3\n"
+	if line != expect {
+		t.Fatalf("Unexpected text line: %q", line)
+	}
+	line = string(formatJSON(now, LevelWarn, "net", "Connection ended", kv))
+	expect = `{"time":"2022-05-01T12:00:00Z","level":"warn","subsystem":"net","msg":"Connection ended","addr":"127.0.0.1:8333","err":"connection reset","n":3}` + "\n"
+	if line != expect {
+		t.Fatalf("Unexpected JSON line: %q", line)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetJSON(true)
+	a := New("test-a")
+	b := New("test-b")
+	if New("test-a") != a {
+		t.Fatal("Loggers of one subsystem should be shared")
+	}
+	err := SetLevels("warn,test-b=debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Info("hidden")
+	a.Warn("shown", "k", "v")
+	b.Debug("shown")
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", buf.String())
+	}
+	var entry map[string]interface{}
+	err = json.Unmarshal(lines[0], &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry["subsystem"] != "test-a" || entry["level"] != "warn" || entry["k"] != "v" {
+		t.Fatalf("Unexpected entry %v", entry)
+	}
+	if Levels()["test-b"] != "debug" {
+		t.Fatalf("Unexpected levels %v", Levels())
+	}
+	if SetLevels("nosuch=debug") == nil || SetLevels("loud") == nil {
+		t.Fatal("Invalid specs should be rejected")
+	}
+}
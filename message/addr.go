@@ -1,22 +1,30 @@
 package message
 
 import (
+	"errors"
+
 	"github.com/sshockwave/bitebi/utils"
 )
 
 type NetworkIPAddress struct {
-	time     uint32
-	services uint64
+	// when the address was last seen, unix time
+	Time     uint32
+	Services uint64
 	Ipv6     [16]byte
 	Port     uint16
 }
 
+// Larger addr messages are rejected
+const MaxAddrCount = 1000
+
+var errTooManyAddrs = errors.New("tooManyAddrs")
+
 func (a *NetworkIPAddress) LoadBuffer(reader utils.BufReader) (err error) {
-	a.time, err = reader.ReadUint32()
+	a.Time, err = reader.ReadUint32()
 	if err != nil {
 		return
 	}
-	a.services, err = reader.ReadUint64()
+	a.Services, err = reader.ReadUint64()
 	if err != nil {
 		return
 	}
@@ -29,11 +37,11 @@ func (a *NetworkIPAddress) LoadBuffer(reader utils.BufReader) (err error) {
 }
 
 func (a *NetworkIPAddress) PutBuffer(writer utils.BufWriter) (err error) {
-	err = writer.WriteUint32(a.time)
+	err = writer.WriteUint32(a.Time)
 	if err != nil {
 		return
 	}
-	err = writer.WriteUint64(a.services)
+	err = writer.WriteUint64(a.Services)
 	if err != nil {
 		return
 	}
@@ -55,6 +63,9 @@ func (a *AddrMsg) LoadBuffer(reader utils.BufReader) (err error) {
 	if err != nil {
 		return
 	}
+	if cnt > MaxAddrCount {
+		return errTooManyAddrs
+	}
 	a.Addrs = make([]NetworkIPAddress, cnt)
 	for i := range a.Addrs {
 		err = a.Addrs[i].LoadBuffer(reader)
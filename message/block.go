@@ -1,9 +1,7 @@
 package message
 
 import (
-	"encoding/hex"
 	"errors"
-	"time"
 
 	"github.com/sshockwave/bitebi/utils"
 )
@@ -77,7 +75,7 @@ func CreateBlock(version int32, previous_block_header_hash [32]byte, TS []Transa
 	block.Version = version
 	block.Previous_block_header_hash = previous_block_header_hash
 	block.Merkle_root_hash = MakeMerkleTree(TS)
-	block.Time = uint32(time.Now().Unix())
+	block.Time = uint32(utils.Now().Unix())
 	block.NBits = nBits
 	block.Nonce = nonce
 
@@ -135,9 +133,5 @@ func (b *SerializedBlock) LoadBuffer(reader utils.BufReader) (err error) {
 }
 
 func (b *SerializedBlock) HexString() string {
-	outputHash := b.HeaderHash
-	for a, b := 0, 31; a < b; a, b = a+1, b-1 {
-		outputHash[a], outputHash[b] = outputHash[b], outputHash[a]
-	}
-	return hex.EncodeToString(outputHash[:])
+	return utils.HashToString(b.HeaderHash)
 }
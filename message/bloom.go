@@ -0,0 +1,113 @@
+package message
+
+import (
+	"errors"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Bloom filters for lightweight clients
+// https://github.com/bitcoin/bips/blob/master/bip-0037.mediawiki
+
+const (
+	MaxBloomFilterSize = 36000
+	MaxBloomHashFuncs  = 50
+	// longest element filteradd takes
+	MaxFilterAddSize = 520
+)
+
+// What a filter adds to itself when an output matches
+const (
+	BloomUpdateNone = 0
+	// the outpoint of every matching output
+	BloomUpdateAll = 1
+	// only outpoints of outputs paying to public keys
+	BloomUpdateP2PubkeyOnly = 2
+	BloomUpdateMask         = 3
+)
+
+var bloomFilterTooLarge = errors.New("bloomFilterTooLarge")
+var bloomTooManyHashFuncs = errors.New("bloomTooManyHashFuncs")
+var filterAddTooLarge = errors.New("filterAddTooLarge")
+
+// https://developer.bitcoin.org/reference/p2p_networking.html#filterload
+type FilterLoadMsg struct {
+	Filter    []byte
+	HashFuncs uint32
+	Tweak     uint32
+	Flags     uint8
+}
+
+func (m *FilterLoadMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	var cnt uint64
+	cnt, err = reader.ReadCompactUint()
+	if err != nil {
+		return
+	}
+	if cnt > MaxBloomFilterSize {
+		return bloomFilterTooLarge
+	}
+	m.Filter, err = reader.ReadBytes(int(cnt))
+	if err != nil {
+		return
+	}
+	m.HashFuncs, err = reader.ReadUint32()
+	if err != nil {
+		return
+	}
+	if m.HashFuncs > MaxBloomHashFuncs {
+		return bloomTooManyHashFuncs
+	}
+	m.Tweak, err = reader.ReadUint32()
+	if err != nil {
+		return
+	}
+	m.Flags, err = reader.ReadUint8()
+	return
+}
+
+func (m *FilterLoadMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = writer.WriteCompactUint(uint64(len(m.Filter)))
+	if err != nil {
+		return
+	}
+	err = writer.WriteBytes(m.Filter)
+	if err != nil {
+		return
+	}
+	err = writer.WriteUint32(m.HashFuncs)
+	if err != nil {
+		return
+	}
+	err = writer.WriteUint32(m.Tweak)
+	if err != nil {
+		return
+	}
+	return writer.WriteUint8(m.Flags)
+}
+
+// https://developer.bitcoin.org/reference/p2p_networking.html#filteradd
+type FilterAddMsg struct {
+	Data []byte
+}
+
+func (m *FilterAddMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	var cnt uint64
+	cnt, err = reader.ReadCompactUint()
+	if err != nil {
+		return
+	}
+	if cnt > MaxFilterAddSize {
+		return filterAddTooLarge
+	}
+	m.Data, err = reader.ReadBytes(int(cnt))
+	return
+}
+
+func (m *FilterAddMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = writer.WriteCompactUint(uint64(len(m.Data)))
+	if err != nil {
+		return
+	}
+	return writer.WriteBytes(m.Data)
+}
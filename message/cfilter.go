@@ -0,0 +1,260 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Compact block filters for lightweight clients
+// https://github.com/bitcoin/bips/blob/master/bip-0157.mediawiki
+// https://github.com/bitcoin/bips/blob/master/bip-0158.mediawiki
+
+// The basic filter, the only type so far, with its Golomb-Rice parameters
+const (
+	CFilterBasic = 0
+	BasicFilterP = 19
+	BasicFilterM = 784931
+)
+
+const (
+	// Filters sent for one getcfilters
+	MaxGetCFilters = 1000
+	// Filter hashes sent for one getcfheaders
+	MaxGetCFHeaders = 2000
+	// Blocks between filter headers in cfcheckpt
+	CFCheckptInterval = 1000
+)
+
+// Nothing in a message is larger than this
+const maxCFilterSize = 0x02000000
+
+var cfTooManyHashes = errors.New("cfTooManyHashes")
+
+// The SipHash key of the filter of a block
+func CFilterKey(blockHash [32]byte) (k0, k1 uint64) {
+	return binary.LittleEndian.Uint64(blockHash[0:8]), binary.LittleEndian.Uint64(blockHash[8:16])
+}
+
+func BuildBasicFilter(blockHash [32]byte, items [][]byte) []byte {
+	k0, k1 := CFilterKey(blockHash)
+	return utils.BuildGCS(BasicFilterP, BasicFilterM, k0, k1, items)
+}
+
+func MatchBasicFilter(blockHash [32]byte, filter []byte, items [][]byte) (bool, error) {
+	k0, k1 := CFilterKey(blockHash)
+	return utils.MatchGCS(BasicFilterP, BasicFilterM, k0, k1, filter, items)
+}
+
+// Filter headers chain the filters like block headers chain blocks
+func CFilterHeader(filter []byte, prevHeader [32]byte) [32]byte {
+	hash := utils.Sha256Twice(filter)
+	return utils.Sha256Twice(append(hash[:], prevHeader[:]...))
+}
+
+// https://developer.bitcoin.org/reference/p2p_networking.html#getcfilters
+// getcfheaders takes the same fields
+type GetCFiltersMsg struct {
+	FilterType  uint8
+	StartHeight uint32
+	StopHash    [32]byte
+}
+
+func (m *GetCFiltersMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	m.FilterType, err = reader.ReadUint8()
+	if err != nil {
+		return
+	}
+	m.StartHeight, err = reader.ReadUint32()
+	if err != nil {
+		return
+	}
+	m.StopHash, err = reader.Read32Bytes()
+	return
+}
+
+func (m *GetCFiltersMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = writer.WriteUint8(m.FilterType)
+	if err != nil {
+		return
+	}
+	err = writer.WriteUint32(m.StartHeight)
+	if err != nil {
+		return
+	}
+	return writer.Write32Bytes(m.StopHash)
+}
+
+type CFilterMsg struct {
+	FilterType uint8
+	BlockHash  [32]byte
+	Filter     []byte
+}
+
+func (m *CFilterMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	m.FilterType, err = reader.ReadUint8()
+	if err != nil {
+		return
+	}
+	m.BlockHash, err = reader.Read32Bytes()
+	if err != nil {
+		return
+	}
+	var cnt uint64
+	cnt, err = reader.ReadCompactUint()
+	if err != nil {
+		return
+	}
+	if cnt > maxCFilterSize {
+		return maxSizeExceededError
+	}
+	m.Filter, err = reader.ReadBytes(int(cnt))
+	return
+}
+
+func (m *CFilterMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = writer.WriteUint8(m.FilterType)
+	if err != nil {
+		return
+	}
+	err = writer.Write32Bytes(m.BlockHash)
+	if err != nil {
+		return
+	}
+	err = writer.WriteCompactUint(uint64(len(m.Filter)))
+	if err != nil {
+		return
+	}
+	return writer.WriteBytes(m.Filter)
+}
+
+// The filter hashes of the blocks up to StopHash,
+// chained from the filter header before the first one
+type CFHeadersMsg struct {
+	FilterType   uint8
+	StopHash     [32]byte
+	PrevHeader   [32]byte
+	FilterHashes [][32]byte
+}
+
+func readHashes(reader utils.BufReader, max uint64) (hashes [][32]byte, err error) {
+	var cnt uint64
+	cnt, err = reader.ReadCompactUint()
+	if err != nil {
+		return
+	}
+	if cnt > max {
+		return nil, cfTooManyHashes
+	}
+	hashes = make([][32]byte, cnt)
+	for i := range hashes {
+		hashes[i], err = reader.Read32Bytes()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writeHashes(writer utils.BufWriter, hashes [][32]byte) (err error) {
+	err = writer.WriteCompactUint(uint64(len(hashes)))
+	if err != nil {
+		return
+	}
+	for _, h := range hashes {
+		err = writer.Write32Bytes(h)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (m *CFHeadersMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	m.FilterType, err = reader.ReadUint8()
+	if err != nil {
+		return
+	}
+	m.StopHash, err = reader.Read32Bytes()
+	if err != nil {
+		return
+	}
+	m.PrevHeader, err = reader.Read32Bytes()
+	if err != nil {
+		return
+	}
+	m.FilterHashes, err = readHashes(reader, MaxGetCFHeaders)
+	return
+}
+
+func (m *CFHeadersMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = writer.WriteUint8(m.FilterType)
+	if err != nil {
+		return
+	}
+	err = writer.Write32Bytes(m.StopHash)
+	if err != nil {
+		return
+	}
+	err = writer.Write32Bytes(m.PrevHeader)
+	if err != nil {
+		return
+	}
+	return writeHashes(writer, m.FilterHashes)
+}
+
+// https://developer.bitcoin.org/reference/p2p_networking.html#getcfcheckpt
+type GetCFCheckptMsg struct {
+	FilterType uint8
+	StopHash   [32]byte
+}
+
+func (m *GetCFCheckptMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	m.FilterType, err = reader.ReadUint8()
+	if err != nil {
+		return
+	}
+	m.StopHash, err = reader.Read32Bytes()
+	return
+}
+
+func (m *GetCFCheckptMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = writer.WriteUint8(m.FilterType)
+	if err != nil {
+		return
+	}
+	return writer.Write32Bytes(m.StopHash)
+}
+
+// Filter headers at every CFCheckptInterval blocks up to StopHash
+type CFCheckptMsg struct {
+	FilterType    uint8
+	StopHash      [32]byte
+	FilterHeaders [][32]byte
+}
+
+func (m *CFCheckptMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	m.FilterType, err = reader.ReadUint8()
+	if err != nil {
+		return
+	}
+	m.StopHash, err = reader.Read32Bytes()
+	if err != nil {
+		return
+	}
+	m.FilterHeaders, err = readHashes(reader, maxCFilterSize/32)
+	return
+}
+
+func (m *CFCheckptMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = writer.WriteUint8(m.FilterType)
+	if err != nil {
+		return
+	}
+	err = writer.Write32Bytes(m.StopHash)
+	if err != nil {
+		return
+	}
+	return writeHashes(writer, m.FilterHeaders)
+}
@@ -0,0 +1,327 @@
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Compact block relay
+// https://github.com/bitcoin/bips/blob/master/bip-0152.mediawiki
+
+// Sent to ask for compact blocks, with announce set to get them
+// in place of inv or headers announcements
+type SendCmpctMsg struct {
+	Announce bool
+	Version  uint64
+}
+
+func (m *SendCmpctMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	var b uint8
+	b, err = reader.ReadUint8()
+	if err != nil {
+		return
+	}
+	m.Announce = b != 0
+	m.Version, err = reader.ReadUint64()
+	return
+}
+
+func (m *SendCmpctMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	var b uint8
+	if m.Announce {
+		b = 1
+	}
+	err = writer.WriteUint8(b)
+	if err != nil {
+		return
+	}
+	return writer.WriteUint64(m.Version)
+}
+
+// Short ids are 6 bytes
+const ShortIDMask = 1<<48 - 1
+
+// Transactions in one block can never take more than this many ids
+const MaxCmpctTxCount = 1 << 20
+
+var cmpctTooManyTxns = errors.New("cmpctTooManyTxns")
+var cmpctIndexOverflow = errors.New("cmpctIndexOverflow")
+
+// Transactions sent in full, usually just the coinbase
+type PrefilledTx struct {
+	// absolute position in the block, sent as the difference to the previous one
+	Index uint64
+	Tx    Transaction
+}
+
+type CmpctBlockMsg struct {
+	Header    Block
+	Nonce     uint64
+	ShortIDs  []uint64
+	Prefilled []PrefilledTx
+}
+
+// The SipHash key for the short ids of this block
+func (m *CmpctBlockMsg) SipKeys() (k0, k1 uint64, err error) {
+	data, err := utils.GetBytes(&m.Header)
+	if err != nil {
+		return
+	}
+	var nonce [8]byte
+	binary.LittleEndian.PutUint64(nonce[:], m.Nonce)
+	h := sha256.Sum256(append(data, nonce[:]...))
+	return binary.LittleEndian.Uint64(h[0:8]), binary.LittleEndian.Uint64(h[8:16]), nil
+}
+
+func ShortTxID(k0, k1 uint64, txid [32]byte) uint64 {
+	return utils.SipHash24(k0, k1, txid[:]) & ShortIDMask
+}
+
+// Number of transactions in the block
+func (m *CmpctBlockMsg) TxCount() int {
+	return len(m.ShortIDs) + len(m.Prefilled)
+}
+
+// Make a compact block that has only the coinbase prefilled
+func NewCmpctBlock(blk *SerializedBlock, nonce uint64) (m CmpctBlockMsg, err error) {
+	m.Header = blk.Header
+	m.Nonce = nonce
+	k0, k1, err := m.SipKeys()
+	if err != nil {
+		return
+	}
+	m.ShortIDs = make([]uint64, 0, len(blk.Txns))
+	for i := range blk.Txns {
+		if i == 0 {
+			m.Prefilled = append(m.Prefilled, PrefilledTx{0, blk.Txns[0]})
+			continue
+		}
+		var txid [32]byte
+		txid, err = utils.GetHash(&blk.Txns[i])
+		if err != nil {
+			return
+		}
+		m.ShortIDs = append(m.ShortIDs, ShortTxID(k0, k1, txid))
+	}
+	return
+}
+
+// Differentially encoded indexes, as in prefilled transactions and getblocktxn
+func readIndexes(reader utils.BufReader, n uint64, read func(i int, index uint64) error) (err error) {
+	var last uint64
+	for i := uint64(0); i < n; i++ {
+		var diff uint64
+		diff, err = reader.ReadCompactUint()
+		if err != nil {
+			return
+		}
+		index := last + diff
+		if i > 0 {
+			index++
+		}
+		if index < last || index >= MaxCmpctTxCount {
+			return cmpctIndexOverflow
+		}
+		err = read(int(i), index)
+		if err != nil {
+			return
+		}
+		last = index
+	}
+	return
+}
+
+func writeIndex(writer utils.BufWriter, i int, index, last uint64) error {
+	if i > 0 {
+		index -= last + 1
+	}
+	return writer.WriteCompactUint(index)
+}
+
+func (m *CmpctBlockMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	err = m.Header.LoadBuffer(reader)
+	if err != nil {
+		return
+	}
+	m.Nonce, err = reader.ReadUint64()
+	if err != nil {
+		return
+	}
+	var cnt uint64
+	cnt, err = reader.ReadCompactUint()
+	if err != nil {
+		return
+	}
+	if cnt > MaxCmpctTxCount {
+		return cmpctTooManyTxns
+	}
+	m.ShortIDs = make([]uint64, cnt)
+	for i := range m.ShortIDs {
+		var low uint32
+		var high uint16
+		low, err = reader.ReadUint32()
+		if err != nil {
+			return
+		}
+		high, err = reader.ReadUint16()
+		if err != nil {
+			return
+		}
+		m.ShortIDs[i] = uint64(high)<<32 | uint64(low)
+	}
+	cnt, err = reader.ReadCompactUint()
+	if err != nil {
+		return
+	}
+	if cnt+uint64(len(m.ShortIDs)) > MaxCmpctTxCount {
+		return cmpctTooManyTxns
+	}
+	m.Prefilled = make([]PrefilledTx, cnt)
+	return readIndexes(reader, cnt, func(i int, index uint64) error {
+		m.Prefilled[i].Index = index
+		return m.Prefilled[i].Tx.LoadBuffer(reader)
+	})
+}
+
+func (m *CmpctBlockMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = m.Header.PutBuffer(writer)
+	if err != nil {
+		return
+	}
+	err = writer.WriteUint64(m.Nonce)
+	if err != nil {
+		return
+	}
+	err = writer.WriteCompactUint(uint64(len(m.ShortIDs)))
+	if err != nil {
+		return
+	}
+	for _, id := range m.ShortIDs {
+		err = writer.WriteUint32(uint32(id))
+		if err != nil {
+			return
+		}
+		err = writer.WriteUint16(uint16(id >> 32))
+		if err != nil {
+			return
+		}
+	}
+	err = writer.WriteCompactUint(uint64(len(m.Prefilled)))
+	if err != nil {
+		return
+	}
+	for i := range m.Prefilled {
+		var last uint64
+		if i > 0 {
+			last = m.Prefilled[i-1].Index
+		}
+		err = writeIndex(writer, i, m.Prefilled[i].Index, last)
+		if err != nil {
+			return
+		}
+		err = m.Prefilled[i].Tx.PutBuffer(writer)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Asks for the transactions of a compact block that could not be found
+type GetBlockTxnMsg struct {
+	BlockHash [32]byte
+	// absolute positions, sent as differences
+	Indexes []uint64
+}
+
+func (m *GetBlockTxnMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	m.BlockHash, err = reader.Read32Bytes()
+	if err != nil {
+		return
+	}
+	var cnt uint64
+	cnt, err = reader.ReadCompactUint()
+	if err != nil {
+		return
+	}
+	if cnt > MaxCmpctTxCount {
+		return cmpctTooManyTxns
+	}
+	m.Indexes = make([]uint64, cnt)
+	return readIndexes(reader, cnt, func(i int, index uint64) error {
+		m.Indexes[i] = index
+		return nil
+	})
+}
+
+func (m *GetBlockTxnMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = writer.Write32Bytes(m.BlockHash)
+	if err != nil {
+		return
+	}
+	err = writer.WriteCompactUint(uint64(len(m.Indexes)))
+	if err != nil {
+		return
+	}
+	for i := range m.Indexes {
+		var last uint64
+		if i > 0 {
+			last = m.Indexes[i-1]
+		}
+		err = writeIndex(writer, i, m.Indexes[i], last)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// The answer to getblocktxn, in the order they were asked for
+type BlockTxnMsg struct {
+	BlockHash [32]byte
+	Txns      []Transaction
+}
+
+func (m *BlockTxnMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	m.BlockHash, err = reader.Read32Bytes()
+	if err != nil {
+		return
+	}
+	var cnt uint64
+	cnt, err = reader.ReadCompactUint()
+	if err != nil {
+		return
+	}
+	if cnt > MaxCmpctTxCount {
+		return cmpctTooManyTxns
+	}
+	m.Txns = make([]Transaction, cnt)
+	for i := range m.Txns {
+		err = m.Txns[i].LoadBuffer(reader)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (m *BlockTxnMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = writer.Write32Bytes(m.BlockHash)
+	if err != nil {
+		return
+	}
+	err = writer.WriteCompactUint(uint64(len(m.Txns)))
+	if err != nil {
+		return
+	}
+	for i := range m.Txns {
+		err = m.Txns[i].PutBuffer(writer)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
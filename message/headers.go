@@ -1,8 +1,72 @@
 package message
 
+import (
+	"errors"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
 // The “getheaders” message is nearly identical to the “getblocks” message,
 // with one minor difference:
 // the inv reply to the “getblocks” message will include no more than 500 block header hashes;
 // the headers reply to the “getheaders” message will include as many as 2,000 block headers.
 
-// TODO: This is not yet implemented since it can be replaced by getblocks
+// TODO: getheaders is not yet implemented since it can be replaced by getblocks
+
+// Headers
+// https://developer.bitcoin.org/reference/p2p_networking.html#headers
+// Also sent to announce new blocks to peers that asked with “sendheaders”
+type HeadersMsg struct {
+	Headers []Block
+}
+
+const MaxHeadersCount = 2000
+
+var headersCountExceeded = errors.New("headersCountExceeded")
+var headersHaveTransactions = errors.New("headersHaveTransactions")
+
+func (m *HeadersMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	var cnt uint64
+	cnt, err = reader.ReadCompactUint()
+	if err != nil {
+		return
+	}
+	if cnt > MaxHeadersCount {
+		return headersCountExceeded
+	}
+	m.Headers = make([]Block, cnt)
+	for i := range m.Headers {
+		err = m.Headers[i].LoadBuffer(reader)
+		if err != nil {
+			return
+		}
+		// the transaction count, always zero
+		var txns uint64
+		txns, err = reader.ReadCompactUint()
+		if err != nil {
+			return
+		}
+		if txns != 0 {
+			return headersHaveTransactions
+		}
+	}
+	return
+}
+
+func (m *HeadersMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = writer.WriteCompactUint(uint64(len(m.Headers)))
+	if err != nil {
+		return
+	}
+	for i := range m.Headers {
+		err = m.Headers[i].PutBuffer(writer)
+		if err != nil {
+			return
+		}
+		err = writer.WriteCompactUint(0)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,149 @@
+package message
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// JSON encodings for explorers and RPC clients.
+// Hashes are written in display byte order, scripts are decoded into operations.
+
+type ScriptJSON struct {
+	Asm []string `json:"asm"`
+	Hex string   `json:"hex"`
+}
+
+type TxInJSON struct {
+	// Only set for coinbase inputs, which spend nothing
+	Coinbase  string      `json:"coinbase,omitempty"`
+	Txid      string      `json:"txid,omitempty"`
+	Vout      *uint32     `json:"vout,omitempty"`
+	ScriptSig *ScriptJSON `json:"scriptSig,omitempty"`
+	Sequence  uint32      `json:"sequence"`
+}
+
+type TxOutJSON struct {
+	Value        int64      `json:"value"`
+	N            int        `json:"n"`
+	ScriptPubKey ScriptJSON `json:"scriptPubKey"`
+}
+
+type TransactionJSON struct {
+	Txid     string      `json:"txid"`
+	Version  int32       `json:"version"`
+	Size     int         `json:"size"`
+	LockTime uint32      `json:"locktime"`
+	Vin      []TxInJSON  `json:"vin"`
+	Vout     []TxOutJSON `json:"vout"`
+}
+
+type BlockJSON struct {
+	Hash              string            `json:"hash"`
+	Version           int32             `json:"version"`
+	PreviousBlockHash string            `json:"previousblockhash"`
+	MerkleRoot        string            `json:"merkleroot"`
+	Time              uint32            `json:"time"`
+	Bits              string            `json:"bits"`
+	Difficulty        float64           `json:"difficulty"`
+	Nonce             uint32            `json:"nonce"`
+	Size              int               `json:"size"`
+	Tx                []TransactionJSON `json:"tx"`
+}
+
+// Scripts are operations joined by '*', binary ones are only shown in hex
+func DecodeScript(script []byte) (s ScriptJSON) {
+	s.Hex = hex.EncodeToString(script)
+	s.Asm = []string{}
+	for _, c := range script {
+		if c < 0x20 || c > 0x7e {
+			return
+		}
+	}
+	s.Asm = strings.FieldsFunc(string(script), func(r rune) bool {
+		return r == '*'
+	})
+	return
+}
+
+func (t TxIn) IsCoinbase() bool {
+	return t.Previous_output.Hash == [32]byte{}
+}
+
+func (t TxIn) JSON() (j TxInJSON) {
+	j.Sequence = t.Sequence
+	if t.IsCoinbase() {
+		j.Coinbase = hex.EncodeToString(t.Signature_script)
+		return
+	}
+	vout := t.Previous_output.Index
+	script := DecodeScript(t.Signature_script)
+	j.Txid = utils.HashToString(t.Previous_output.Hash)
+	j.Vout = &vout
+	j.ScriptSig = &script
+	return
+}
+
+func (t TxIn) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.JSON())
+}
+
+// There is no MarshalJSON for TxOut, as only the transaction knows n
+func (t TxOut) JSON(n int) TxOutJSON {
+	return TxOutJSON{
+		Value:        t.Value,
+		N:            n,
+		ScriptPubKey: DecodeScript(t.Pk_script),
+	}
+}
+
+func (t Transaction) JSON() (j TransactionJSON) {
+	data, _ := utils.GetBytes(&t)
+	txid := utils.Sha256Twice(data)
+	j = TransactionJSON{
+		Txid:     utils.HashToString(txid),
+		Version:  t.Version,
+		Size:     len(data),
+		LockTime: t.Lock_time,
+		Vin:      make([]TxInJSON, len(t.Tx_in)),
+		Vout:     make([]TxOutJSON, len(t.Tx_out)),
+	}
+	for i := range t.Tx_in {
+		j.Vin[i] = t.Tx_in[i].JSON()
+	}
+	for i := range t.Tx_out {
+		j.Vout[i] = t.Tx_out[i].JSON(i)
+	}
+	return
+}
+
+func (t Transaction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.JSON())
+}
+
+func (b SerializedBlock) JSON() (j BlockJSON) {
+	data, _ := utils.GetBytes(&b)
+	j = BlockJSON{
+		Hash:              utils.HashToString(b.HeaderHash),
+		Version:           b.Header.Version,
+		PreviousBlockHash: utils.HashToString(b.Header.Previous_block_header_hash),
+		MerkleRoot:        utils.HashToString(b.Header.Merkle_root_hash),
+		Time:              b.Header.Time,
+		Bits:              fmt.Sprintf("%08x", b.Header.NBits),
+		Difficulty:        utils.Difficulty(b.Header.NBits),
+		Nonce:             b.Header.Nonce,
+		Size:              len(data),
+		Tx:                make([]TransactionJSON, len(b.Txns)),
+	}
+	for i := range b.Txns {
+		j.Tx[i] = b.Txns[i].JSON()
+	}
+	return
+}
+
+func (b SerializedBlock) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.JSON())
+}
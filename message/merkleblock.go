@@ -21,82 +21,207 @@ type merkleTreeBuilder struct {
 	Hashes           [][32]byte
 	Flags            []byte
 	PosHash, PosFlag int
+	TxCount          int
+	// leaves with the flag set, in order
+	Matched [][32]byte
 }
 
 var childrenSameHashError = errors.New("childrenSameHashError")
 var MerkleBlockNotEnoughFlags = errors.New("MerkleBlockNotEnoughFlags")
 var MerkleBlockNotEnoughHash = errors.New("MerkleBlockNotEnoughHash")
 
+// Nodes at a height of the tree, the last one may have no right sibling
+func treeWidth(txCount int, height int) int {
+	return (txCount + (1 << height) - 1) >> height
+}
+
+func treeHeight(txCount int) (height int) {
+	for treeWidth(txCount, height) > 1 {
+		height++
+	}
+	return
+}
+
+func hashPair(l, r [32]byte) [32]byte {
+	return utils.Sha256Twice(bytes.Join([][]byte{l[:], r[:]}, []byte{}))
+}
+
 // https://developer.bitcoin.org/reference/p2p_networking.html#parsing-a-merkleblock-message
-func (b *merkleTreeBuilder) BuildMerkleTree(depth int) (node *MerkleTree, err error) {
+// Build the node at pos of the given height, 0 being the leaves
+func (b *merkleTreeBuilder) BuildMerkleTree(height int, pos int) (node *MerkleTree, err error) {
 	if b.PosFlag == len(b.Flags)*8 {
 		return nil, MerkleBlockNotEnoughFlags
 	}
 	flag := ((b.Flags[b.PosFlag>>3] >> (b.PosFlag & 7)) & 1) == 1
 	b.PosFlag += 1
 	node = new(MerkleTree)
-	if !(depth > 0 && flag) {
-		// the only case that hash is not needed:
-		// non root and both children are accessed
+	if height == 0 || !flag {
+		// the hash is given unless some transactions below are matched
 		if b.PosHash == len(b.Hashes) {
 			return nil, MerkleBlockNotEnoughHash
 		}
 		node.Hash = b.Hashes[b.PosHash]
 		b.PosHash += 1
-	}
-	if depth == 0 {
-		node.IsLeaf = true
-		node.Used = flag
-	} else {
-		if flag {
-			node.Lson, err = b.BuildMerkleTree(depth - 1)
-			if err != nil {
-				return
+		if height == 0 {
+			node.IsLeaf = true
+			node.Used = flag
+			if flag {
+				b.Matched = append(b.Matched, node.Hash)
 			}
-			node.Rson, err = b.BuildMerkleTree(depth - 1)
-			if err != nil {
-				return
-			}
-			// CVE-2012-2459
-			if node.Lson.Hash == node.Rson.Hash {
-				return node, childrenSameHashError
-			}
-			node.Hash = utils.Sha256Twice(bytes.Join([][]byte{node.Lson.Hash[:], node.Rson.Hash[:]}, []byte{}))
-		} else {
-			if b.PosHash == len(b.Hashes) {
-				return nil, MerkleBlockNotEnoughHash
-			}
-			node.Hash = b.Hashes[b.PosHash]
-			b.PosHash += 1
 		}
+		return
+	}
+	node.Lson, err = b.BuildMerkleTree(height-1, pos*2)
+	if err != nil {
+		return
+	}
+	if pos*2+1 < treeWidth(b.TxCount, height-1) {
+		node.Rson, err = b.BuildMerkleTree(height-1, pos*2+1)
+		if err != nil {
+			return
+		}
+		// CVE-2012-2459
+		if node.Lson.Hash == node.Rson.Hash {
+			return node, childrenSameHashError
+		}
+		node.Hash = hashPair(node.Lson.Hash, node.Rson.Hash)
+	} else {
+		// the last node of a level is paired with itself
+		node.Hash = hashPair(node.Lson.Hash, node.Lson.Hash)
 	}
 	return
 }
 
+// https://developer.bitcoin.org/reference/p2p_networking.html#merkleblock
 type MerkleBlockMsg struct {
-	// TODO: Block header
+	Header  Block
 	TxCount uint32
-	root    *MerkleTree
+	Hashes  [][32]byte
+	// one bit per visited node, least significant bit first
+	Flags []byte
 }
 
+// The largest block a message can carry, like Bitcoin Core's MAX_SIZE
+const MaxBlockSize = 32 << 20
+
+// A transaction with one input and one output and empty scripts
+const minTxSize = 60
+
+// No block can have more transactions than fit in it
+const MaxMerkleBlockTxCount = MaxBlockSize / minTxSize
+
+var MerkleBlockTooManyTxns = errors.New("MerkleBlockTooManyTxns")
 var MerkleBlockTooManyHashes = errors.New("MerkleBlockTooManyHashes")
 var MerkleBlockTooManyFlags = errors.New("MerkleBlockTooManyFlags")
+var MerkleBlockNoTransactions = errors.New("MerkleBlockNoTransactions")
+var MerkleBlockRootMismatch = errors.New("MerkleBlockRootMismatch")
+
+// Make a merkleblock proving the transactions of blk where match is true
+func NewMerkleBlock(blk *SerializedBlock, match []bool) (m MerkleBlockMsg, err error) {
+	m.Header = blk.Header
+	m.TxCount = uint32(len(blk.Txns))
+	txids := make([][32]byte, len(blk.Txns))
+	for i := range blk.Txns {
+		txids[i], err = utils.GetHash(&blk.Txns[i])
+		if err != nil {
+			return
+		}
+	}
+	n := len(txids)
+	var calcHash func(height, pos int) [32]byte
+	calcHash = func(height, pos int) [32]byte {
+		if height == 0 {
+			return txids[pos]
+		}
+		l := calcHash(height-1, pos*2)
+		if pos*2+1 < treeWidth(n, height-1) {
+			return hashPair(l, calcHash(height-1, pos*2+1))
+		}
+		return hashPair(l, l)
+	}
+	bit := 0
+	var build func(height, pos int)
+	build = func(height, pos int) {
+		parentOfMatch := false
+		for i := pos << height; i < (pos+1)<<height && i < n; i++ {
+			parentOfMatch = parentOfMatch || match[i]
+		}
+		if bit%8 == 0 {
+			m.Flags = append(m.Flags, 0)
+		}
+		if parentOfMatch {
+			m.Flags[bit/8] |= 1 << (bit % 8)
+		}
+		bit++
+		if height == 0 || !parentOfMatch {
+			m.Hashes = append(m.Hashes, calcHash(height, pos))
+			return
+		}
+		build(height-1, pos*2)
+		if pos*2+1 < treeWidth(n, height-1) {
+			build(height-1, pos*2+1)
+		}
+	}
+	if n > 0 {
+		build(treeHeight(n), 0)
+	}
+	return
+}
 
-func NewMerkleBlockMsg(reader utils.BufReader) (ret MerkleBlockMsg, err error) {
-	// TODO: parse block header, 80 bytes
-	ret.TxCount, err = reader.ReadUint32()
+// Check the partial merkle tree against the header,
+// and return the hashes of the transactions it proves in block order
+func (m *MerkleBlockMsg) MatchedTxns() (matched [][32]byte, err error) {
+	if m.TxCount == 0 {
+		return nil, MerkleBlockNoTransactions
+	}
+	if uint64(len(m.Hashes)) > uint64(m.TxCount) {
+		return nil, MerkleBlockTooManyHashes
+	}
+	builder := merkleTreeBuilder{Hashes: m.Hashes, Flags: m.Flags, TxCount: int(m.TxCount)}
+	root, err := builder.BuildMerkleTree(treeHeight(int(m.TxCount)), 0)
+	if err != nil {
+		return
+	}
+	if builder.PosHash < len(m.Hashes) {
+		return nil, MerkleBlockTooManyHashes
+	}
+	if (builder.PosFlag+7)/8 != len(m.Flags) {
+		// only the last flag byte may have unused bits
+		return nil, MerkleBlockTooManyFlags
+	}
+	if root.Hash != m.Header.Merkle_root_hash {
+		return nil, MerkleBlockRootMismatch
+	}
+	return builder.Matched, nil
+}
+
+func (m *MerkleBlockMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	err = m.Header.LoadBuffer(reader)
+	if err != nil {
+		return
+	}
+	m.TxCount, err = reader.ReadUint32()
 	if err != nil {
 		return
 	}
-	var builder merkleTreeBuilder
+	if m.TxCount > MaxMerkleBlockTxCount {
+		return MerkleBlockTooManyTxns
+	}
 	var hash_cnt uint64
 	hash_cnt, err = reader.ReadCompactUint()
 	if err != nil {
 		return
 	}
-	builder.Hashes = make([][32]byte, hash_cnt)
+	if hash_cnt > uint64(m.TxCount) {
+		return MerkleBlockTooManyHashes
+	}
+	// the payload must hold them before they are allocated
+	if left, ok := reader.Remaining(); ok && hash_cnt > uint64(left/32) {
+		return MerkleBlockTooManyHashes
+	}
+	m.Hashes = make([][32]byte, hash_cnt)
 	for i := uint64(0); i < hash_cnt; i++ {
-		builder.Hashes[i], err = reader.Read32Bytes()
+		m.Hashes[i], err = reader.Read32Bytes()
 		if err != nil {
 			return
 		}
@@ -106,19 +231,36 @@ func NewMerkleBlockMsg(reader utils.BufReader) (ret MerkleBlockMsg, err error) {
 	if err != nil {
 		return
 	}
-	builder.Flags = make([]byte, flag_cnt)
-	builder.Flags, err = reader.ReadBytes(int(flag_cnt))
+	// one flag per node at most
+	if flag_cnt > (2*uint64(m.TxCount)+7)/8 {
+		return MerkleBlockTooManyFlags
+	}
+	m.Flags, err = reader.ReadBytes(int(flag_cnt))
+	return
+}
+
+func (m *MerkleBlockMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = m.Header.PutBuffer(writer)
 	if err != nil {
 		return
 	}
-	// node.root = builder.BuildMerkleTree(depth)
-	if uint64(builder.PosHash) < hash_cnt {
-		return ret, MerkleBlockTooManyHashes
+	err = writer.WriteUint32(m.TxCount)
+	if err != nil {
+		return
 	}
-	if builder.PosFlag < int(flag_cnt*8)-8 {
-		// Last flag byte is not used
-		return ret, MerkleBlockTooManyFlags
+	err = writer.WriteCompactUint(uint64(len(m.Hashes)))
+	if err != nil {
+		return
 	}
-	// TODO: check if root hash matches the block merkle root
-	return
+	for _, h := range m.Hashes {
+		err = writer.Write32Bytes(h)
+		if err != nil {
+			return
+		}
+	}
+	err = writer.WriteCompactUint(uint64(len(m.Flags)))
+	if err != nil {
+		return
+	}
+	return writer.WriteBytes(m.Flags)
 }
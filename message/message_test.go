@@ -2,7 +2,9 @@ package message
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"reflect"
 	"testing"
 
@@ -27,14 +29,14 @@ func doSerializationTest(in utils.BinaryWritable, out utils.BinaryReadable, t *t
 func TestAddr(t *testing.T) {
 	addrs := AddrMsg{Addrs: []NetworkIPAddress{
 		{
-			time:     123456,
-			services: 434432,
+			Time:     123456,
+			Services: 434432,
 			Ipv6:     [16]byte{0x7f, 0x00, 0x00, 0, 0, 3, 4, 2},
 			Port:     8333,
 		},
 		{
-			time:     4433,
-			services: 9929292,
+			Time:     4433,
+			Services: 9929292,
 			Ipv6:     [16]byte{0x00, 0x00, 0x00, 0, 0, 3, 4, 0x33},
 			Port:     18333,
 		},
@@ -172,6 +174,99 @@ func TestInventorySerialization(t *testing.T) {
 	doSerializationTest(&invmsg, &new_msg, t)
 }
 
+func TestHeadersSerialization(t *testing.T) {
+	msg := HeadersMsg{Headers: []Block{blk1, blk1}}
+	var new_msg HeadersMsg
+	doSerializationTest(&msg, &new_msg, t)
+}
+
+func TestCmpctBlockSerialization(t *testing.T) {
+	sb, err := CreateSerialBlock(blk1, []Transaction{tx2, tx1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cmpct, err := NewCmpctBlock(&sb, 77)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(cmpct.ShortIDs) != 1 || cmpct.ShortIDs[0] > ShortIDMask || cmpct.TxCount() != 2 {
+		t.Fatalf("Unexpected compact block %+v", cmpct)
+	}
+	cmpct.Prefilled = append(cmpct.Prefilled, PrefilledTx{Index: 5, Tx: tx1})
+	var new_cmpct CmpctBlockMsg
+	doSerializationTest(&cmpct, &new_cmpct, t)
+	get := GetBlockTxnMsg{BlockHash: sb.HeaderHash, Indexes: []uint64{1, 2, 7}}
+	var new_get GetBlockTxnMsg
+	doSerializationTest(&get, &new_get, t)
+	txn := BlockTxnMsg{BlockHash: sb.HeaderHash, Txns: []Transaction{tx1, tx2}}
+	var new_txn BlockTxnMsg
+	doSerializationTest(&txn, &new_txn, t)
+	send := SendCmpctMsg{Announce: true, Version: 1}
+	var new_send SendCmpctMsg
+	doSerializationTest(&send, &new_send, t)
+}
+
+func TestMerkleBlock(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		txns := make([]Transaction, n)
+		for i := range txns {
+			txns[i] = tx2
+			txns[i].Lock_time = uint32(i)
+		}
+		sb, err := CreateSerialBlock(CreateBlock(1, [32]byte{}, txns, 0, 0), txns)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// every third transaction, and the last one
+		match := make([]bool, n)
+		var expect [][32]byte
+		for i := range match {
+			match[i] = i%3 == 0 || i == n-1
+			if match[i] {
+				hash, _ := utils.GetHash(&txns[i])
+				expect = append(expect, hash)
+			}
+		}
+		mb, err := NewMerkleBlock(&sb, match)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var new_mb MerkleBlockMsg
+		doSerializationTest(&mb, &new_mb, t)
+		matched, err := new_mb.MatchedTxns()
+		if err != nil {
+			t.Fatalf("Unexpected error with %v transactions: %v", n, err)
+		}
+		if !reflect.DeepEqual(matched, expect) {
+			t.Fatalf("Expect %v matched, %v found", expect, matched)
+		}
+		new_mb.Header.Merkle_root_hash[0] ^= 1
+		if _, err := new_mb.MatchedTxns(); err != MerkleBlockRootMismatch {
+			t.Fatalf("Expect %v, %v found", MerkleBlockRootMismatch, err)
+		}
+	}
+}
+
+func TestMerkleBlockForgedCount(t *testing.T) {
+	mb := MerkleBlockMsg{TxCount: 0xffffffff}
+	data, _ := utils.GetBytes(&mb)
+	var new_mb MerkleBlockMsg
+	if err := new_mb.LoadBuffer(utils.NewBufReader(bytes.NewBuffer(data))); err != MerkleBlockTooManyTxns {
+		t.Fatalf("Expect %v, %v found", MerkleBlockTooManyTxns, err)
+	}
+	// claims far more hashes than the payload has
+	mb = MerkleBlockMsg{TxCount: MaxMerkleBlockTxCount}
+	header, _ := utils.GetBytes(&mb.Header)
+	data, _ = utils.GetBytes(&mb)
+	cnt := make([]byte, 5)
+	cnt[0] = 0xfe
+	binary.LittleEndian.PutUint32(cnt[1:], MaxMerkleBlockTxCount)
+	data = append(append(data[:len(header)+4], cnt...), make([]byte, 64)...)
+	if err := new_mb.LoadBuffer(utils.NewBufReader(bytes.NewBuffer(data))); err != MerkleBlockTooManyHashes {
+		t.Fatalf("Expect %v, %v found", MerkleBlockTooManyHashes, err)
+	}
+}
+
 func bytesReverse(arr []byte) {
 	for i, j := 0, len(arr)-1; i < j; i, j = i+1, j-1 {
 		arr[i], arr[j] = arr[j], arr[i]
@@ -239,3 +334,102 @@ func TestMerkleHashUneven(t *testing.T) {
 		t,
 	)
 }
+
+func TestMerkleBranch(t *testing.T) {
+	for n := 1; n <= 7; n++ {
+		TS := make([]Transaction, n)
+		hashes := make([][32]byte, n)
+		for i := range TS {
+			TS[i] = tx2
+			TS[i].Lock_time = uint32(i)
+			hashes[i], _ = utils.GetHash(&TS[i])
+		}
+		branch := MerkleBranch(append([][32]byte{{}}, hashes[1:]...))
+		root := MerkleRootFromBranch(hashes[0], branch)
+		if root != MakeMerkleTree(TS) {
+			t.Fatalf("Merkle root mismatch with %v transactions", n)
+		}
+	}
+}
+
+func TestTransactionJSON(t *testing.T) {
+	prev := [32]byte{1, 2, 3}
+	tx := Transaction{
+		Version: 1,
+		Tx_in: []TxIn{
+			{Previous_output: Outpoint{Index: 0xffff}, Signature_script: []byte{0x03, 1, 0, 0}},
+			{Previous_output: Outpoint{Hash: prev, Index: 2}, Signature_script: []byte("12#34")},
+		},
+		Tx_out: []TxOut{{Value: 5, Pk_script: []byte("pubkey*OP CHECKSIG")}, {Value: 6}},
+	}
+	data, err := json.Marshal(tx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var j TransactionJSON
+	if err = json.Unmarshal(data, &j); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	txid, _ := utils.GetHash(&tx)
+	if j.Txid != utils.HashToString(txid) || j.Version != 1 || len(j.Vin) != 2 || len(j.Vout) != 2 {
+		t.Fatalf("Unexpected transaction: %s", data)
+	}
+	if j.Vin[0].Coinbase != "03010000" || j.Vin[0].Vout != nil {
+		t.Fatalf("Unexpected coinbase input: %+v", j.Vin[0])
+	}
+	if j.Vin[1].Txid != utils.HashToString(prev) || *j.Vin[1].Vout != 2 || j.Vin[1].ScriptSig.Asm[0] != "12#34" {
+		t.Fatalf("Unexpected input: %+v", j.Vin[1])
+	}
+	asm := j.Vout[0].ScriptPubKey.Asm
+	if j.Vout[0].Value != 5 || !reflect.DeepEqual(asm, []string{"pubkey", "OP CHECKSIG"}) {
+		t.Fatalf("Unexpected output: %+v", j.Vout[0])
+	}
+	if j.Vout[1].N != 1 || j.Vout[1].Value != 6 {
+		t.Fatalf("Unexpected output: %+v", j.Vout[1])
+	}
+	if s := DecodeScript([]byte{0, 1, 2}); len(s.Asm) != 0 || s.Hex != "000102" {
+		t.Fatalf("Unexpected binary script: %+v", s)
+	}
+}
+
+// The basic filter of the testnet genesis block, from the BIP158 test vectors
+func TestBasicFilter(t *testing.T) {
+	blockHash, _ := utils.StringToHash("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
+	script, _ := hex.DecodeString("4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac")
+	filter := BuildBasicFilter(blockHash, [][]byte{script})
+	if hex.EncodeToString(filter) != "019dfca8" {
+		t.Fatalf("Unexpected filter %x", filter)
+	}
+	header := CFilterHeader(filter, [32]byte{})
+	if utils.HashToString(header) != "21584579b7eb08997773e5aeff3a7f932700042d0ed2a6129012b7d7ae81b750" {
+		t.Fatalf("Unexpected filter header %v", utils.HashToString(header))
+	}
+	if ok, err := MatchBasicFilter(blockHash, filter, [][]byte{[]byte("nothing"), script}); !ok || err != nil {
+		t.Fatalf("The script should match, %v %v found", ok, err)
+	}
+	if ok, err := MatchBasicFilter(blockHash, filter, [][]byte{[]byte("nothing")}); ok || err != nil {
+		t.Fatalf("Nothing else should match, %v %v found", ok, err)
+	}
+
+	// many items
+	items := make([][]byte, 100)
+	for i := range items {
+		items[i] = []byte{byte(i), 1, 2}
+	}
+	filter = BuildBasicFilter(blockHash, items)
+	for _, item := range items {
+		if ok, err := MatchBasicFilter(blockHash, filter, [][]byte{item}); !ok || err != nil {
+			t.Fatalf("%x should match, %v %v found", item, ok, err)
+		}
+	}
+	doSerializationTest(&CFilterMsg{CFilterBasic, blockHash, filter}, new(CFilterMsg), t)
+	doSerializationTest(&CFHeadersMsg{CFilterBasic, blockHash, header, [][32]byte{header, blockHash}}, new(CFHeadersMsg), t)
+	doSerializationTest(&CFCheckptMsg{CFilterBasic, blockHash, [][32]byte{header}}, new(CFCheckptMsg), t)
+	doSerializationTest(&GetCFiltersMsg{CFilterBasic, 3, blockHash}, new(GetCFiltersMsg), t)
+	doSerializationTest(&GetCFCheckptMsg{CFilterBasic, blockHash}, new(GetCFCheckptMsg), t)
+}
+
+func TestReject(t *testing.T) {
+	doSerializationTest(&RejectMsg{"tx", REJECT_INVALID, "txBadScript", [32]byte{1, 2}}, new(RejectMsg), t)
+	doSerializationTest(&RejectMsg{Message: "version", CCode: REJECT_OBSOLETE, Reason: "old"}, new(RejectMsg), t)
+}
@@ -0,0 +1,20 @@
+package message
+
+import (
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Payload of both "ping" and "pong", a pong echoes the nonce of the ping
+// https://developer.bitcoin.org/reference/p2p_networking.html#ping
+type PingMsg struct {
+	Nonce uint64
+}
+
+func (m *PingMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	m.Nonce, err = reader.ReadUint64()
+	return
+}
+
+func (m *PingMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	return writer.WriteUint64(m.Nonce)
+}
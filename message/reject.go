@@ -0,0 +1,96 @@
+package message
+
+import (
+	"errors"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// https://developer.bitcoin.org/reference/p2p_networking.html#reject
+const (
+	REJECT_MALFORMED       = 0x01
+	REJECT_INVALID         = 0x10
+	REJECT_OBSOLETE        = 0x11
+	REJECT_DUPLICATE       = 0x12
+	REJECT_NONSTANDARD     = 0x40
+	REJECT_DUST            = 0x41
+	REJECT_INSUFFICIENTFEE = 0x42
+	REJECT_CHECKPOINT      = 0x43
+)
+
+// Longest reason sent, like Bitcoin Core
+const MaxRejectReasonLength = 111
+
+var rejectStringTooLong = errors.New("rejectStringTooLong")
+
+// Tells the peer why a message it sent was rejected
+type RejectMsg struct {
+	// the command rejected
+	Message string
+	CCode   uint8
+	Reason  string
+	// the hash of the transaction or block, only sent for tx and block
+	Data [32]byte
+}
+
+func (m *RejectMsg) hasData() bool {
+	return m.Message == "tx" || m.Message == "block"
+}
+
+func readString(reader utils.BufReader, max uint64) (s string, err error) {
+	var cnt uint64
+	cnt, err = reader.ReadCompactUint()
+	if err != nil {
+		return
+	}
+	if cnt > max {
+		return "", rejectStringTooLong
+	}
+	data, err := reader.ReadBytes(int(cnt))
+	return string(data), err
+}
+
+func writeString(writer utils.BufWriter, s string) (err error) {
+	err = writer.WriteCompactUint(uint64(len(s)))
+	if err != nil {
+		return
+	}
+	return writer.WriteBytes([]byte(s))
+}
+
+func (m *RejectMsg) LoadBuffer(reader utils.BufReader) (err error) {
+	m.Message, err = readString(reader, 12)
+	if err != nil {
+		return
+	}
+	m.CCode, err = reader.ReadUint8()
+	if err != nil {
+		return
+	}
+	m.Reason, err = readString(reader, MaxRejectReasonLength)
+	if err != nil || !m.hasData() {
+		return
+	}
+	m.Data, err = reader.Read32Bytes()
+	return
+}
+
+func (m *RejectMsg) PutBuffer(writer utils.BufWriter) (err error) {
+	err = writeString(writer, m.Message)
+	if err != nil {
+		return
+	}
+	err = writer.WriteUint8(m.CCode)
+	if err != nil {
+		return
+	}
+	reason := m.Reason
+	if len(reason) > MaxRejectReasonLength {
+		reason = reason[:MaxRejectReasonLength]
+	}
+	err = writeString(writer, reason)
+	if err != nil || !m.hasData() {
+		return
+	}
+	return writer.Write32Bytes(m.Data)
+}
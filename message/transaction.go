@@ -106,3 +106,37 @@ func (tx *Transaction) LoadBuffer(reader utils.BufReader) (err error) {
 	tx.Lock_time, err = reader.ReadUint32()
 	return
 }
+
+// Hashes needed to compute the merkle root from the first transaction,
+// bottom-up. The first element of hashes is never read, so a placeholder
+// can be used for a coinbase that is yet to be built.
+func MerkleBranch(hashes [][32]byte) (branch [][32]byte) {
+	level := make([][32]byte, len(hashes))
+	copy(level, hashes)
+	buf := make([]byte, 2*HashL)
+	for len(level) > 1 {
+		branch = append(branch, level[1])
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([][32]byte, len(level)/2)
+		for i := 1; i < len(next); i++ {
+			copy(buf[:HashL], level[2*i][:])
+			copy(buf[HashL:], level[2*i+1][:])
+			next[i] = utils.Sha256Twice(buf)
+		}
+		level = next
+	}
+	return
+}
+
+// Merkle root of a tree whose first transaction has the given hash
+func MerkleRootFromBranch(hash [32]byte, branch [][32]byte) [32]byte {
+	buf := make([]byte, 2*HashL)
+	for _, v := range branch {
+		copy(buf[:HashL], hash[:])
+		copy(buf[HashL:], v[:])
+		hash = utils.Sha256Twice(buf)
+	}
+	return hash
+}
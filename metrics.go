@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sshockwave/bitebi/metrics"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+const DefaultMetricsPort = 9332
+
+var nodeMetrics = metrics.NewRegistry()
+
+// Updated as things happen
+var (
+	metricBytesSent       = nodeMetrics.NewCounterVec("bitebi_p2p_sent_bytes_total", "Bytes sent to peers, by command.", "command")
+	metricBytesReceived   = nodeMetrics.NewCounterVec("bitebi_p2p_received_bytes_total", "Bytes received from peers, by command.", "command")
+	metricMsgsSent        = nodeMetrics.NewCounterVec("bitebi_p2p_sent_messages_total", "Messages sent to peers, by command.", "command")
+	metricMsgsReceived    = nodeMetrics.NewCounterVec("bitebi_p2p_received_messages_total", "Messages received from peers, by command.", "command")
+	metricReorgs          = nodeMetrics.NewCounter("bitebi_chain_reorgs_total", "Times blocks of the active chain were replaced.")
+	metricBlockVerify     = nodeMetrics.NewHistogram("bitebi_block_validation_seconds", "Time spent validating a block.", metrics.DefaultBuckets)
+	metricTxVerify        = nodeMetrics.NewHistogram("bitebi_tx_validation_seconds", "Time spent validating a transaction.", metrics.DefaultBuckets)
+	metricCmpctBlocks     = nodeMetrics.NewCounterVec("bitebi_p2p_compact_blocks_total", "Compact blocks received, by how they were completed.", "result")
+	metricRequestTimeouts = nodeMetrics.NewCounterVec("bitebi_p2p_request_timeouts_total", "Requests peers did not deliver in time, by inventory type.", "type")
+)
+
+// Read from the node when scraped
+var (
+	metricHeight       = nodeMetrics.NewGauge("bitebi_chain_height", "Height of the best block.")
+	metricMempoolSize  = nodeMetrics.NewGauge("bitebi_mempool_transactions", "Transactions in the mempool.")
+	metricMempoolBytes = nodeMetrics.NewGauge("bitebi_mempool_bytes", "Serialized size of the mempool.")
+	metricPeers        = nodeMetrics.NewGaugeVec("bitebi_peers", "Connected peers, by direction.", "direction")
+	metricHashRate     = nodeMetrics.NewGauge("bitebi_miner_hash_rate", "Hashes per second of the local miner.")
+	metricOrphans      = nodeMetrics.NewGauge("bitebi_orphan_blocks", "Blocks waiting for their parents.")
+	metricOrphanTxs    = nodeMetrics.NewGauge("bitebi_orphan_transactions", "Transactions waiting for their parents.")
+)
+
+type MetricsServer struct {
+	app    *CmdApp
+	ln     net.Listener
+	server *http.Server
+}
+
+func NewMetricsServer(app *CmdApp, addr string) (s *MetricsServer, err error) {
+	s = &MetricsServer{app: app}
+	s.ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s)
+	s.server = &http.Server{Handler: mux}
+	rpcLog.Info("Metrics server listening", "addr", s.ln.Addr())
+	go func() {
+		err := s.server.Serve(s.ln)
+		if err != nil && err != http.ErrServerClosed {
+			rpcLog.Error("Metrics server stopped", "err", err)
+		}
+	}()
+	return
+}
+
+func (s *MetricsServer) Close() error {
+	return s.server.Close()
+}
+
+func (s *MetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.app.updateMetrics()
+	nodeMetrics.ServeHTTP(w, r)
+}
+
+func (c *CmdApp) updateMetrics() {
+	b := &c.blockchain
+	b.Mtx.Lock()
+	metricHeight.Set(float64(len(b.Block) - 1))
+	metricMempoolSize.Set(float64(len(b.Mempool)))
+	size := 0
+	for _, tx := range b.Mempool {
+		data, _ := utils.GetBytes(&tx)
+		size += len(data)
+	}
+	metricMempoolBytes.Set(float64(size))
+	b.Mtx.Unlock()
+	metricHashRate.Set(b.GetHashRate())
+	peer, err := c.getPeer()
+	if err != nil {
+		return
+	}
+	inbound, outbound := 0, 0
+	peer.lock.RLock()
+	for conn := range peer.conns {
+		if conn.Inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+	peer.lock.RUnlock()
+	metricPeers.With("inbound").Set(float64(inbound))
+	metricPeers.With("outbound").Set(float64(outbound))
+	metricOrphans.Set(float64(peer.orphans.Count()))
+	metricOrphanTxs.Set(float64(peer.orphanTxs.Count()))
+}
+
+// The commands dispatchMessage handles. Peers may send any other name,
+// so those are counted together to keep the number of series bounded.
+var metricCommands = map[string]bool{
+	"getheaders": true, "headers": true, "getblocks": true, "mempool": true,
+	"inv": true, "getdata": true, "tx": true, "block": true, "merkleblock": true,
+	"notfound": true, "cmpctblock": true, "getblocktxn": true, "blocktxn": true,
+	"getcfilters": true, "getcfheaders": true, "getcfcheckpt": true,
+	"version": true, "verack": true, "ping": true, "pong": true,
+	"getaddr": true, "addr": true, "addrv2": true,
+	"filterload": true, "filteradd": true, "filterclear": true,
+	"sendaddrv2": true, "sendheaders": true, "sendcmpct": true, "reject": true,
+}
+
+func commandLabel(command string) string {
+	if metricCommands[command] {
+		return command
+	}
+	return "other"
+}
+
+func observeSince(h *metrics.Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,252 @@
+// A small metrics registry exported in the Prometheus text format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Buckets suited to timings in seconds, from 100us to 10s
+var DefaultBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mtx     sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+func (r *Registry) register(m metric) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.metrics[m.name()]; ok {
+		panic("metric registered twice: " + m.name())
+	}
+	r.metrics[m.name()] = m
+}
+
+// Write all metrics, sorted by name
+func (r *Registry) Write(w io.Writer) {
+	r.mtx.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]metric, len(names))
+	for i, name := range names {
+		list[i] = r.metrics[name]
+	}
+	r.mtx.Unlock()
+	for _, m := range list {
+		m.write(w)
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.Write(w)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i := range names {
+		parts[i] = names[i] + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+type desc struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.metricName, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.metricName, d.kind)
+}
+
+// A value that can be set, or only increased for counters
+type Value struct {
+	mtx sync.Mutex
+	v   float64
+}
+
+func (v *Value) Set(x float64) {
+	v.mtx.Lock()
+	v.v = x
+	v.mtx.Unlock()
+}
+
+func (v *Value) Add(x float64) {
+	v.mtx.Lock()
+	v.v += x
+	v.mtx.Unlock()
+}
+
+func (v *Value) Inc() {
+	v.Add(1)
+}
+
+func (v *Value) Get() float64 {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return v.v
+}
+
+// Values with the same name told apart by labels
+type Vec struct {
+	desc
+	mtx    sync.Mutex
+	values map[string]*Value
+	keys   map[string][]string
+}
+
+func newVec(r *Registry, kind string, name string, help string, labels []string) *Vec {
+	v := &Vec{
+		desc:   desc{name, help, kind, labels},
+		values: make(map[string]*Value),
+		keys:   make(map[string][]string),
+	}
+	r.register(v)
+	return v
+}
+
+func (r *Registry) NewCounter(name string, help string) *Value {
+	return newVec(r, "counter", name, help, nil).With()
+}
+
+func (r *Registry) NewGauge(name string, help string) *Value {
+	return newVec(r, "gauge", name, help, nil).With()
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *Vec {
+	return newVec(r, "counter", name, help, labels)
+}
+
+func (r *Registry) NewGaugeVec(name string, help string, labels ...string) *Vec {
+	return newVec(r, "gauge", name, help, labels)
+}
+
+// The value for some label values, given in the order of the label names
+func (v *Vec) With(labelValues ...string) *Value {
+	if len(labelValues) != len(v.labels) {
+		panic("wrong number of labels for " + v.metricName)
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	val, ok := v.values[key]
+	if !ok {
+		val = new(Value)
+		v.values[key] = val
+		v.keys[key] = append([]string{}, labelValues...)
+	}
+	return val
+}
+
+// Forget all label values, for gauges recomputed from scratch
+func (v *Vec) Reset() {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.values = make(map[string]*Value)
+	v.keys = make(map[string][]string)
+}
+
+func (v *Vec) write(w io.Writer) {
+	v.writeHeader(w)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.metricName, formatLabels(v.labels, v.keys[key]), formatValue(v.values[key].Get()))
+	}
+}
+
+type Histogram struct {
+	desc
+	mtx     sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Buckets are upper bounds in increasing order, +Inf is implied
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		desc:    desc{name, help, "histogram", nil},
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(x float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	i := sort.SearchFloat64s(h.buckets, x)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += x
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.writeHeader(w)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.metricName, formatValue(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.metricName, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, h.count)
+}
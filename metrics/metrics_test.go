@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_messages_total", "Messages.", "command")
+	c.With("inv").Add(2)
+	c.With("block").Inc()
+	r.NewGauge("test_height", "Height.").Set(7)
+	h := r.NewHistogram("test_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(3)
+	var buf bytes.Buffer
+	r.Write(&buf)
+	expect := `# HELP test_height Height.
+# TYPE test_height gauge
+test_height 7
+# HELP test_messages_total Messages.
+# TYPE test_messages_total counter
+test_messages_total{command="block"} 1
+test_messages_total{command="inv"} 2
+# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 3.15
+test_seconds_count 3
+`
+	if buf.String() != expect {
+		t.Fatalf("Unexpected output:\n%v", buf.String())
+	}
+}
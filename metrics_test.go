@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+func TestCommandLabel(t *testing.T) {
+	if commandLabel("inv") != "inv" || commandLabel("reject") != "reject" {
+		t.Fatalf("Handled commands should keep their label")
+	}
+	if commandLabel("made up") != "other" || commandLabel("") != "other" {
+		t.Fatalf("Unknown commands should be counted as other")
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Bytes of extranonce appended after the height in the coinbase script
+const ExtraNonceSize = 8
+
+// Coinbase scripts are limited to 100 bytes, same as bitcoin
+const MaxCoinbaseScriptSize = 100
+
+// How often the miner reports its hash rate
+var HashRateInterval = 10 * time.Second
+
+// How many hashes a worker computes before publishing its count
+const hashCountBatch = 1 << 10
+
+// The part of a block that every mining worker shares
+type mineTemplate struct {
+	version  int // MineVersion at the time the template was made
+	height   int
+	previous [32]byte
+	txns     []message.Transaction // excluding the coinbase
+}
+
+// Select transactions from the mempool for the next block.
+// The caller must hold b.Mtx.
+func (b *BlockChain) makeMineTemplate() (t mineTemplate) {
+	t.version = b.MineVersion
+	t.height = len(b.Block)
+	t.previous = b.Block[t.height-1].HeaderHash
+	t.txns = []message.Transaction{}
+	for _, hash := range b.sortedMempool() {
+		value := b.Mempool[hash]
+		if b.verifyTransaction(value, false) && b.confirmTransaction(value, false) {
+			t.txns = append(t.txns, value)
+		} else {
+			b.delTransaction(value)
+		}
+	}
+	// rollback
+	for _, value := range t.txns {
+		b.cancelTransaction(value, false)
+	}
+	return
+}
+
+// https://developer.bitcoin.org/reference/transactions.html?highlight=coinbase
+func makeCoinbase(height int, extraNonce uint64, Pk_script []byte) message.Transaction {
+	script := make([]byte, 4+ExtraNonceSize)
+	script[0] = 0x03 // number of bytes in the height
+	script[1] = byte(height & 255)
+	script[2] = byte((height >> 8) & 255)
+	script[3] = byte((height >> 16) & 255)
+	binary.LittleEndian.PutUint64(script[4:], extraNonce)
+	return message.Transaction{
+		Tx_in: []message.TxIn{
+			{
+				Previous_output:  message.Outpoint{Index: 0xffff},
+				Signature_script: script,
+			},
+		},
+		Tx_out: []message.TxOut{
+			{
+				Value:     CoinBaseReward, // How many bitcoins to use for reward?
+				Pk_script: Pk_script,
+			},
+		},
+	}
+}
+
+// Start mining with the given number of worker goroutines.
+// Each worker owns a slice of the nonce space and takes a fresh extranonce
+// whenever its slice is exhausted.
+// This function does not return; it reports the hash rate periodically.
+func (b *BlockChain) mine(version int32, nBits uint32, peer *Peer, Pk_script []byte, threads int) {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	minerLog.Info("Mining started", "threads", threads)
+	for i := 0; i < threads; i++ {
+		go b.mineWorker(i, threads, version, nBits, peer, Pk_script)
+	}
+	last := atomic.LoadUint64(&b.hashCount)
+	for {
+		time.Sleep(HashRateInterval)
+		cur := atomic.LoadUint64(&b.hashCount)
+		rate := float64(cur-last) / HashRateInterval.Seconds()
+		last = cur
+		atomic.StoreUint64(&b.hashRate, math.Float64bits(rate))
+		if rate > 0 {
+			minerLog.Info("Hash rate", "hps", fmt.Sprintf("%.2f", rate))
+		}
+	}
+}
+
+// Hashes per second during the last report interval
+func (b *BlockChain) GetHashRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&b.hashRate))
+}
+
+func (b *BlockChain) mineWorker(id int, threads int, version int32, nBits uint32, peer *Peer, Pk_script []byte) {
+	step := (uint64(1) << 32) / uint64(threads)
+	first := uint32(uint64(id) * step)
+	last := uint32(uint64(id)*step + step - 1)
+	if id == threads-1 {
+		last = math.MaxUint32
+	}
+	ver := -1
+	var tmpl mineTemplate
+	var TS []message.Transaction
+	var block message.Block
+	var header []byte
+	nonce := last
+	exhausted := true
+	cnt := uint64(0)
+	for {
+		if ver < b.MineVersion {
+			b.MineBarrier.Lock() // sync progress
+			b.MineBarrier.Unlock()
+			b.Mtx.Lock()
+			tmpl = b.makeMineTemplate()
+			b.Mtx.Unlock()
+			ver = tmpl.version
+			exhausted = true
+		}
+		if exhausted {
+			// Wrapped around: a new extranonce changes the merkle root,
+			// which gives us a fresh nonce space
+			extraNonce := atomic.AddUint64(&b.extraNonce, 1)
+			TS = append([]message.Transaction{makeCoinbase(tmpl.height, extraNonce, Pk_script)}, tmpl.txns...)
+			block = message.CreateBlock(version, tmpl.previous, TS, nBits, first)
+			var err error
+			header, err = utils.GetBytes(&block)
+			if err != nil {
+				minerLog.Error("Serializing block header failed", "err", err)
+				continue
+			}
+			nonce = first
+			exhausted = false
+		}
+		// The nonce is the last field of the 80-byte header
+		binary.LittleEndian.PutUint32(header[len(header)-4:], nonce)
+		hash := utils.Sha256Twice(header)
+		cnt++
+		if cnt == hashCountBatch {
+			atomic.AddUint64(&b.hashCount, cnt)
+			cnt = 0
+		}
+		if utils.HasValidHash(hash, nBits) {
+			minerLog.Info("A new block is mined", "hash", utils.HashToString(hash))
+			block.Nonce = nonce
+			serializedBlock := message.SerializedBlock{Header: block, HeaderHash: hash, Txns: TS}
+			ok := b.addBlock(len(b.Block), []message.SerializedBlock{serializedBlock})
+			if ok {
+				peer.BroadcastBlock(serializedBlock)
+			} else {
+				minerLog.Warn("A mined block is discarded", "hash", utils.HashToString(hash))
+			}
+			// the chain has moved on, start over with a new template
+			ver = -1
+			continue
+		}
+		if nonce == last {
+			exhausted = true
+		} else {
+			nonce++
+		}
+	}
+}
+
+// Everything an external miner needs to build a block on top of our tip.
+// The miner is responsible for the coinbase, which must pay at most
+// CoinbaseValue and start its script with the height (see makeCoinbase).
+type BlockTemplate struct {
+	Version       int32
+	PreviousHash  [32]byte
+	NBits         uint32
+	Height        int
+	CoinbaseValue int64
+	CurTime       uint32
+	Txns          []message.Transaction
+	mineVersion   int // MineVersion when the template was made
+}
+
+func (b *BlockChain) GetBlockTemplate(version int32, nBits uint32) BlockTemplate {
+	b.Mtx.Lock()
+	tmpl := b.makeMineTemplate()
+	b.Mtx.Unlock()
+	return BlockTemplate{
+		Version:       version,
+		PreviousHash:  tmpl.previous,
+		NBits:         nBits,
+		Height:        tmpl.height,
+		CoinbaseValue: CoinBaseReward,
+		CurTime:       uint32(utils.Now().Unix()),
+		Txns:          tmpl.txns,
+		mineVersion:   tmpl.version,
+	}
+}
+
+type templateTxJSON struct {
+	Data string `json:"data"`
+	TxID string `json:"txid"`
+}
+
+// Field names follow bitcoind's getblocktemplate
+func (t BlockTemplate) MarshalJSON() ([]byte, error) {
+	txns := make([]templateTxJSON, len(t.Txns))
+	for i := range t.Txns {
+		data, err := utils.GetBytes(&t.Txns[i])
+		if err != nil {
+			return nil, err
+		}
+		txns[i].Data = hex.EncodeToString(data)
+		txns[i].TxID = utils.HashToString(utils.Sha256Twice(data))
+	}
+	return json.Marshal(struct {
+		Version           int32            `json:"version"`
+		PreviousBlockHash string           `json:"previousblockhash"`
+		Bits              string           `json:"bits"`
+		Height            int              `json:"height"`
+		CoinbaseValue     int64            `json:"coinbasevalue"`
+		CurTime           uint32           `json:"curtime"`
+		Transactions      []templateTxJSON `json:"transactions"`
+	}{
+		Version:           t.Version,
+		PreviousBlockHash: utils.HashToString(t.PreviousHash),
+		Bits:              fmt.Sprintf("%08x", t.NBits),
+		Height:            t.Height,
+		CoinbaseValue:     t.CoinbaseValue,
+		CurTime:           t.CurTime,
+		Transactions:      txns,
+	})
+}
+
+var blockHashMismatch = errors.New("blockHashMismatch")
+var blockPrevUnknown = errors.New("blockPrevUnknown")
+var blockRejected = errors.New("blockRejected")
+var blockTooEasy = errors.New("blockTooEasy")
+
+// Accept a block solved outside of this process.
+// It goes through addBlock and is relayed just like a block we mined.
+func (p *Peer) SubmitBlock(blk message.SerializedBlock) (err error) {
+	var hash [32]byte
+	hash, err = utils.GetHash(&blk.Header)
+	if err != nil {
+		return
+	}
+	if hash != blk.HeaderHash {
+		return blockHashMismatch
+	}
+	if utils.EasierThan(blk.Header.NBits, p.Config.MaxNBits) {
+		return blockTooEasy
+	}
+	p.Chain.Mtx.Lock()
+	height, ok := p.Chain.Height[blk.Header.Previous_block_header_hash]
+	p.Chain.Mtx.Unlock()
+	if !ok {
+		return blockPrevUnknown
+	}
+	err = p.Chain.acceptBlocks(height+1, []message.SerializedBlock{blk})
+	if err != nil {
+		return fmt.Errorf("%w: %v", blockRejected, err)
+	}
+	return p.BroadcastBlock(blk)
+}
+
+var generateNotRegtest = errors.New("generateNotRegtest")
+
+// Mine n blocks on top of the tip, one after another, in the calling goroutine.
+// This is only allowed on regtest, where the difficulty makes it instant.
+func (p *Peer) Generate(n int, version int32, Pk_script []byte) (hashes [][32]byte, err error) {
+	if !p.Config.Regtest {
+		return nil, generateNotRegtest
+	}
+	b := p.Chain
+	nBits := p.Config.MaxNBits
+	for len(hashes) < n {
+		b.Mtx.Lock()
+		tmpl := b.makeMineTemplate()
+		b.Mtx.Unlock()
+		var blk message.SerializedBlock
+		for found := false; !found; {
+			extraNonce := atomic.AddUint64(&b.extraNonce, 1)
+			TS := append([]message.Transaction{makeCoinbase(tmpl.height, extraNonce, Pk_script)}, tmpl.txns...)
+			block := message.CreateBlock(version, tmpl.previous, TS, nBits, 0)
+			for {
+				var hash [32]byte
+				hash, err = utils.GetHash(&block)
+				if err != nil {
+					return
+				}
+				if utils.HasValidHash(hash, nBits) {
+					blk = message.SerializedBlock{Header: block, HeaderHash: hash, Txns: TS}
+					found = true
+					break
+				}
+				if block.Nonce == math.MaxUint32 {
+					break
+				}
+				block.Nonce++
+			}
+		}
+		if !b.addBlock(tmpl.height, []message.SerializedBlock{blk}) {
+			return hashes, blockRejected
+		}
+		p.BroadcastBlock(blk)
+		hashes = append(hashes, blk.HeaderHash)
+	}
+	return
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/p2p"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+func TestSubmitBlockDifficulty(t *testing.T) {
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	p, err := NewPeer(&chain, p2p.GetBitebinet(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer p.ln.Close()
+	chain.Mtx.Lock()
+	tip := chain.Block[len(chain.Block)-1].HeaderHash
+	chain.Mtx.Unlock()
+	// the regtest target is far easier than the network's
+	header := message.CreateBlock(1, tip, []message.Transaction{tx1}, 0x207fffff, 0)
+	hash, _ := utils.GetHash(&header)
+	err = p.SubmitBlock(message.SerializedBlock{Header: header, HeaderHash: hash})
+	if err != blockTooEasy {
+		t.Fatalf("Expect blockTooEasy, %v found", err)
+	}
+}
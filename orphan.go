@@ -1,13 +1,16 @@
 package main
 
 import (
-	"log"
+	"errors"
 	"time"
 
 	"github.com/sshockwave/bitebi/message"
 	"github.com/sshockwave/bitebi/utils"
 )
 
+var errOrphanMissing = errors.New("orphanMissing")
+var errOrphanDiscarded = errors.New("orphanDiscarded")
+
 type orphanNode struct {
 	blk *message.SerializedBlock
 	successors map[[32]byte]void
@@ -59,9 +62,7 @@ func (o *Orphans) RemoveBlock(hash [32]byte, delay uint64) {
 		return
 	}
 	if node.blk == nil {
-		if len(node.successors) == 0 {
-			log.Fatalln("[FATAL] node.blk == nil should indicate that the block is only required by others")
-		}
+		// already removed, only kept for its successors
 		return
 	}
 	prev_hash := node.blk.Header.Previous_block_header_hash
@@ -76,54 +77,72 @@ func (o *Orphans) RemoveBlock(hash [32]byte, delay uint64) {
 	}
 }
 
-func (o *Orphans) dfsLongChain(hash [32]byte) (stk []*message.SerializedBlock) {
+func (o *Orphans) dfsLongChain(hash [32]byte) (stk []*message.SerializedBlock, err error) {
 	node, ok := o.nodes[hash]
 	if !ok {
-		log.Fatal("[FATAL] the node should have existed")
+		return nil, errOrphanMissing
 	}
 	for v := range node.successors {
-		tmp_stk := o.dfsLongChain(v)
+		tmp_stk, err := o.dfsLongChain(v)
+		if err != nil {
+			return nil, err
+		}
 		if len(tmp_stk) > len(stk) {
 			stk = tmp_stk
 		}
 	}
 	if node.blk == nil {
-		log.Fatal("[FATAL] The node should not have been discarded")
+		return nil, errOrphanDiscarded
 	}
 	stk = append(stk, node.blk)
 	return
 }
 
-func (o *Orphans) IsOrphaned(hash [32]byte) bool {
+// Number of blocks kept
+func (o *Orphans) Count() (cnt int) {
+	o.Chain.Mtx.Lock()
+	defer o.Chain.Mtx.Unlock()
+	for _, node := range o.nodes {
+		if node.blk != nil {
+			cnt++
+		}
+	}
+	return
+}
+
+func (o *Orphans) IsOrphaned(hash [32]byte) (bool, error) {
 	o.Chain.Mtx.Lock()
 	defer o.Chain.Mtx.Unlock()
 	node, ok := o.nodes[hash]
-	if !ok {
-		return true
+	if !ok || node.blk == nil {
+		return true, nil
 	}
 	for {
 		node, ok = o.nodes[node.blk.Header.Previous_block_header_hash]
 		if !ok {
-			log.Fatal("[FATAL] Assertion failure, previous node should exist when the orhpaned block exists")
+			return true, errOrphanMissing
 		}
 		if node.blk == nil {
-			return false
+			return false, nil
 		}
 		_, ok = o.Chain.Height[node.blk.HeaderHash]
 		if ok {
-			return true
+			return true, nil
 		}
 	}
 }
 
-func (o *Orphans) GetLongestChain(hash [32]byte) (stk []*message.SerializedBlock) {
+func (o *Orphans) GetLongestChain(hash [32]byte) (stk []*message.SerializedBlock, err error) {
 	o.Chain.Mtx.Lock()
 	defer o.Chain.Mtx.Unlock()
 	node, ok := o.nodes[hash]
 	if !ok {
 		return
 	}
-	stk = o.dfsLongChain(hash)
+	stk, err = o.dfsLongChain(hash)
+	if err != nil {
+		return nil, err
+	}
 	for {
 		if len(stk) == 0 {
 			return
@@ -137,7 +156,7 @@ func (o *Orphans) GetLongestChain(hash [32]byte) (stk []*message.SerializedBlock
 	for {
 		node, ok = o.nodes[stk[len(stk) - 1].Header.Previous_block_header_hash]
 		if !ok {
-			log.Fatal("[FATAL] Assertion failure, previous node should exist when the orhpaned block exists")
+			return nil, errOrphanMissing
 		}
 		if node.blk == nil {
 			break
@@ -151,5 +170,5 @@ func (o *Orphans) GetLongestChain(hash [32]byte) (stk []*message.SerializedBlock
 	for i, j := 0, len(stk) - 1; i < j; i, j = i + 1, j - 1 {
 		stk[i], stk[j] = stk[j], stk[i]
 	}
-	return stk
+	return stk, nil
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Transactions relayed before their parents wait here until the parents arrive,
+// then they are checked again like a new transaction.
+
+// Limits of the pool, like Bitcoin Core
+const (
+	MaxOrphanTxs = 100
+	// larger ones are not kept, so the pool stays small
+	maxOrphanTxSize = 100000
+	// so one peer cannot fill the pool
+	maxOrphanTxsPerPeer = 25
+)
+
+// How long an orphan waits for its parents
+var OrphanTxExpiry = 20 * time.Minute
+
+type orphanTx struct {
+	tx      message.Transaction
+	from    *PeerConnection
+	expires time.Time
+}
+
+// Protected by Chain.Mtx
+type OrphanTxs struct {
+	Chain *BlockChain
+	txs   map[[32]byte]*orphanTx
+	// orphans by the outputs they spend
+	byPrev map[message.Outpoint]map[[32]byte]void
+	byPeer map[*PeerConnection]int
+}
+
+func (o *OrphanTxs) Init(chain *BlockChain) {
+	o.Chain = chain
+	o.txs = make(map[[32]byte]*orphanTx)
+	o.byPrev = make(map[message.Outpoint]map[[32]byte]void)
+	o.byPeer = make(map[*PeerConnection]int)
+}
+
+func (o *OrphanTxs) Count() int {
+	o.Chain.Mtx.Lock()
+	defer o.Chain.Mtx.Unlock()
+	return len(o.txs)
+}
+
+// The parents of tx we do not have.
+// Must be called with Chain.Mtx held
+func (o *OrphanTxs) missingParents(tx *message.Transaction) (parents [][32]byte) {
+	seen := make(map[[32]byte]void)
+	for _, in := range tx.Tx_in {
+		hash := in.Previous_output.Hash
+		if _, ok := o.Chain.TX[hash]; ok {
+			continue
+		}
+		if _, ok := seen[hash]; !ok {
+			seen[hash] = void_null
+			parents = append(parents, hash)
+		}
+	}
+	return
+}
+
+// Keep tx until its parents arrive, false if it is not kept.
+// Must be called with Chain.Mtx held
+func (o *OrphanTxs) add(tx message.Transaction, hash [32]byte, from *PeerConnection, now time.Time) bool {
+	if _, ok := o.txs[hash]; ok {
+		return true
+	}
+	data, err := utils.GetBytes(&tx)
+	if err != nil || len(data) > maxOrphanTxSize || o.byPeer[from] >= maxOrphanTxsPerPeer {
+		return false
+	}
+	o.limit(MaxOrphanTxs-1, now)
+	o.txs[hash] = &orphanTx{tx: tx, from: from, expires: now.Add(OrphanTxExpiry)}
+	for _, in := range tx.Tx_in {
+		spends, ok := o.byPrev[in.Previous_output]
+		if !ok {
+			spends = make(map[[32]byte]void)
+			o.byPrev[in.Previous_output] = spends
+		}
+		spends[hash] = void_null
+	}
+	o.byPeer[from]++
+	return true
+}
+
+// Must be called with Chain.Mtx held
+func (o *OrphanTxs) remove(hash [32]byte) {
+	orphan, ok := o.txs[hash]
+	if !ok {
+		return
+	}
+	for _, in := range orphan.tx.Tx_in {
+		spends := o.byPrev[in.Previous_output]
+		delete(spends, hash)
+		if len(spends) == 0 {
+			delete(o.byPrev, in.Previous_output)
+		}
+	}
+	o.byPeer[orphan.from]--
+	if o.byPeer[orphan.from] <= 0 {
+		delete(o.byPeer, orphan.from)
+	}
+	delete(o.txs, hash)
+}
+
+// Drop the orphans whose parents did not arrive in time.
+// Must be called with Chain.Mtx held
+func (o *OrphanTxs) expire(now time.Time) {
+	for hash, orphan := range o.txs {
+		if now.After(orphan.expires) {
+			o.remove(hash)
+		}
+	}
+}
+
+// Drop the expired orphans, then others until at most max are left.
+// Must be called with Chain.Mtx held
+func (o *OrphanTxs) limit(max int, now time.Time) {
+	o.expire(now)
+	// map order is random enough to pick the ones to evict
+	for hash := range o.txs {
+		if len(o.txs) <= max {
+			break
+		}
+		o.remove(hash)
+	}
+}
+
+// The peer disconnected, what it sent is not worth waiting for.
+// Must be called with Chain.Mtx held
+func (o *OrphanTxs) removeForPeer(c *PeerConnection) {
+	if o.byPeer[c] == 0 {
+		return
+	}
+	for hash, orphan := range o.txs {
+		if orphan.from == c {
+			o.remove(hash)
+		}
+	}
+}
+
+// Accept the orphans that spend the outputs of the new transactions,
+// and then their own children. The accepted ones are returned.
+// Must be called with Chain.Mtx held
+func (o *OrphanTxs) acceptChildren(parents []message.Transaction) (accepted []message.Transaction) {
+	b := o.Chain
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+		parentHash, err := utils.GetHash(&parent)
+		if err != nil {
+			continue
+		}
+		for i := range parent.Tx_out {
+			for hash := range o.byPrev[message.NewOutPoint(parentHash, uint32(i))] {
+				orphan, ok := o.txs[hash]
+				if !ok {
+					continue
+				}
+				tx := orphan.tx
+				err := b.checkNewTransaction(tx)
+				if err == txMissingInputs && len(o.missingParents(&tx)) > 0 {
+					// still waiting for another parent
+					continue
+				}
+				o.remove(hash)
+				if err != nil {
+					mempoolLog.Debug("Orphan transaction rejected", "txid", utils.HashToString(hash), "reason", err)
+					continue
+				}
+				if _, ok := b.TX[hash]; ok {
+					continue
+				}
+				mempoolLog.Debug("Orphan transaction accepted", "txid", utils.HashToString(hash))
+				b.acceptTransaction(tx)
+				accepted = append(accepted, tx)
+				parents = append(parents, tx)
+			}
+		}
+	}
+	return
+}
+
+// The parents may also arrive in blocks, and orphans be confirmed.
+// Must be called with Chain.Mtx held
+func (o *OrphanTxs) connectBlocks(blocks []message.SerializedBlock) []message.Transaction {
+	if len(o.txs) == 0 {
+		return nil
+	}
+	parents := make([]message.Transaction, 0)
+	for _, blk := range blocks {
+		for _, tx := range blk.Txns {
+			hash, err := utils.GetHash(&tx)
+			if err == nil {
+				o.remove(hash)
+			}
+			parents = append(parents, tx)
+		}
+	}
+	return o.acceptChildren(parents)
+}
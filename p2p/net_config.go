@@ -6,19 +6,33 @@ type NetConfig struct {
     DefaultPort int
     StartString [4]byte
     MaxNBits uint32
+    Name string
+    // Blocks can be generated on demand at minimum difficulty
+    Regtest bool
 }
 
 // Constants taken from
 // https://github.com/bitcoin/bitcoin/blob/master/src/chainparams.cpp
 func GetMainnet() NetConfig {
-    return NetConfig{8333, [4]byte{0xf9, 0xbe, 0xb4, 0xd9}, 0x1d00ffff};
+    return NetConfig{8333, [4]byte{0xf9, 0xbe, 0xb4, 0xd9}, 0x1d00ffff, "mainnet", false};
 }
 func GetTestnet() NetConfig {
-    return NetConfig{18333, [4]byte{0x0b, 0x11, 0x09, 0x07}, 0x1d00ffff};
+    return NetConfig{18333, [4]byte{0x0b, 0x11, 0x09, 0x07}, 0x1d00ffff, "testnet", false};
 }
 func GetRegtest() NetConfig {
-    return NetConfig{18444, [4]byte{0xfa, 0xbf, 0xb5, 0xda}, 0x207fffff};
+    return NetConfig{18444, [4]byte{0xfa, 0xbf, 0xb5, 0xda}, 0x207fffff, "regtest", true};
 }
 func GetBitebinet() NetConfig {
-    return NetConfig{8333, [4]byte{0xf9, 0xbe, 0xb4, 0xd9}, 0x1E08ffff};
+    return NetConfig{8333, [4]byte{0xf9, 0xbe, 0xb4, 0xd9}, 0x1E08ffff, "bitebinet", false};
+}
+
+// Look up a network by its name
+func GetNetConfig(name string) (cfg NetConfig, ok bool) {
+    for _, get := range []func() NetConfig{GetMainnet, GetTestnet, GetRegtest, GetBitebinet} {
+        cfg = get()
+        if cfg.Name == name {
+            return cfg, true
+        }
+    }
+    return NetConfig{}, false
 }
@@ -5,10 +5,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"log"
 	"net"
 	"strconv"
 	"sync"
+	"time"
 
 	reuse "github.com/libp2p/go-reuseport"
 	"github.com/sshockwave/bitebi/message"
@@ -19,6 +19,10 @@ import (
 type void struct{}
 var void_null void
 
+var errBadChecksum = errors.New("badChecksum")
+var errInvalidStartString = errors.New("invalidStartString")
+var errPayloadTooLarge = errors.New("payloadTooLarge")
+
 type Peer struct {
 	Chain *BlockChain
 	Config p2p.NetConfig
@@ -26,12 +30,40 @@ type Peer struct {
 	conns map[*PeerConnection]void
 	lock sync.RWMutex
 	orphans Orphans
+	orphanTxs OrphanTxs
+	// what we asked peers for with getdata
+	requests *requestTracker
+	// protected by lock
+	limits ConnLimits
+	Addrs *AddrManager
+	Bans *BanList
+	// nil unless only headers are kept, as a lightweight client
+	Headers *HeaderChain
+	// closed when the listener stops
+	done chan void
+	// copied from the interval variables when the peer is created
+	inboundTrickle time.Duration
+	outboundTrickle time.Duration
+	pingInterval time.Duration
+	pingTimeout time.Duration
+	connectInterval time.Duration
+	blockRequestTimeout time.Duration
+	txRequestTimeout time.Duration
+	requestCheckInterval time.Duration
 }
 
+// How often outbound slots are filled and the address database saved,
+// ConnectInterval is read by NewPeer
+var (
+	ConnectInterval = 5 * time.Second
+	AddrSaveInterval = 15 * time.Minute
+	DialTimeout = 10 * time.Second
+)
+
 func ConnectionToAddr(c net.Addr) net.TCPAddr {
 	addr, ok := c.(*net.TCPAddr)
 	if !ok {
-		log.Fatalf("[ERROR] Listener should have been tcp")
+		netLog.Fatal("Listener should have been tcp", "addr", c)
 	}
 	return *addr
 }
@@ -40,47 +72,216 @@ func (c *PeerConnection) Serve() {
 	c.peer.lock.Lock()
 	c.peer.conns[c] = void_null
 	c.peer.lock.Unlock()
+	c.peer.Chain.Events.Publish(TopicPeerConnected, PeerEvent{c.Conn.RemoteAddr().String()})
+	go c.writeLoop()
 	// TODO: version message
 	c.sendMessage("getaddr", []byte{})
+	c.sendMessage("sendheaders", []byte{})
+	if c.peer.Headers != nil {
+		c.sendFilterLoad(c.peer.walletFilter())
+	} else {
+		c.sendSendCmpct()
+	}
 	c.doBlockSync()
+	go c.pingLoop()
+	go c.trickleLoop()
 	for {
+		// let a slow peer catch up before answering more of its requests
+		c.sendq.waitBelow(SendPauseBytes)
 		command, payload, err := c.readMessage()
 		if err == io.EOF {
-			log.Printf("[INFO] Connection to %v ended.", c.Conn.RemoteAddr())
+			netLog.Info("Connection ended", "addr", c.Conn.RemoteAddr())
 			break
+		} else if err == errBadChecksum {
+			c.Misbehaving(scoreBadChecksum, "checksum does not match in " + command)
+			continue
 		} else if err != nil {
-			log.Println("[ERROR]", err)
-			break
-		}
-		err = c.dispatchMessage(command, payload)
-		if err != nil {
-			log.Println("[ERROR]", err)
+			if err == errInvalidStartString || err == errPayloadTooLarge {
+				c.Misbehaving(scoreBadHeader, err.Error())
+			}
+			netLog.Error("Reading message failed", "addr", c.Conn.RemoteAddr(), "err", err)
 			break
 		}
+		c.dispatchMessage(command, payload)
 	}
+	close(c.quit)
+	c.sendq.close()
 	c.peer.lock.Lock()
 	delete(c.peer.conns, c)
 	c.peer.lock.Unlock()
 	c.Conn.Close()
+	resendRequests(c.peer.requests.drop(c, time.Now()))
+	c.peer.Chain.Mtx.Lock()
+	c.peer.orphanTxs.removeForPeer(c)
+	c.peer.Chain.Mtx.Unlock()
+	c.peer.Chain.Events.Publish(TopicPeerDisconnected, PeerEvent{c.Conn.RemoteAddr().String()})
 }
 
 func (p *Peer) messageLoop() {
 	for {
 		conn, err := p.ln.Accept()
 		if err != nil {
-			log.Println("[ERROR] Accepting TCP connections:", err)
+			netLog.Error("Accepting TCP connections failed", "err", err)
 			break
 		}
-		p.NewConn(conn)
+		addr := ConnectionToAddr(conn.RemoteAddr())
+		if p.Bans.IsBanned(addr.IP) {
+			netLog.Debug("Refusing connection from a banned address", "addr", addr.String())
+			conn.Close()
+			continue
+		}
+		if !p.acceptInbound(&addr) {
+			conn.Close()
+			continue
+		}
+		// peers dial from their listening port, so this address takes connections
+		p.Addrs.Add(&addr, addr.IP, utils.Now())
+		p.newConn(conn, true)
+	}
+	close(p.done)
+}
+
+// Keep the outbound slots filled until the listener stops
+func (p *Peer) connectionLoop() {
+	ticker := time.NewTicker(p.connectInterval)
+	defer ticker.Stop()
+	lastSave := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			p.saveAddrs()
+			return
+		}
+		p.fillOutbound()
+		if time.Since(lastSave) > AddrSaveInterval {
+			p.saveAddrs()
+			lastSave = time.Now()
+		}
+	}
+}
+
+func (p *Peer) saveAddrs() {
+	err := p.Addrs.Save()
+	if err != nil {
+		netLog.Error("Saving peer addresses failed", "err", err)
 	}
 }
 
+func (p *Peer) outboundCount() (n int) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for c := range p.conns {
+		if !c.Inbound {
+			n++
+		}
+	}
+	return
+}
+
+func (p *Peer) fillOutbound() {
+	p.lock.RLock()
+	max := p.limits.MaxOutbound
+	p.lock.RUnlock()
+	missing := max - p.outboundCount()
+	for i := 0; i < missing; i++ {
+		addr, ok := p.Addrs.Select(p.skipAddr)
+		if !ok {
+			return
+		}
+		err := p.ConnectTo(addr)
+		if err != nil {
+			netLog.Debug("Outbound connection failed", "addr", addr, "err", err)
+		}
+	}
+}
+
+// Whether addr is one of our own addresses
+func (p *Peer) isLocal(addr *net.TCPAddr) bool {
+	if addr.Port != ConnectionToAddr(p.ln.Addr()).Port {
+		return false
+	}
+	if addr.IP.IsLoopback() || addr.IP.IsUnspecified() {
+		return true
+	}
+	ifaces, _ := net.InterfaceAddrs()
+	for _, iface := range ifaces {
+		if ipnet, ok := iface.(*net.IPNet); ok && ipnet.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Addresses not worth dialing: our own, connected or banned
+func (p *Peer) skipAddr(addr string) bool {
+	tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil || p.isLocal(tcpaddr) || p.Bans.IsBanned(tcpaddr.IP) {
+		return true
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for c := range p.conns {
+		remote := ConnectionToAddr(c.Conn.RemoteAddr())
+		if remote.IP.Equal(tcpaddr.IP) && remote.Port == tcpaddr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// Dial an address and serve the connection, the address database is updated
+func (p *Peer) ConnectTo(addr string) error {
+	tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if p.Bans.IsBanned(tcpaddr.IP) {
+		return errBanned
+	}
+	p.Addrs.Attempt(addr)
+	conn, err := p.Dial(addr)
+	if err != nil {
+		return err
+	}
+	remote := ConnectionToAddr(conn.RemoteAddr())
+	p.Addrs.Good(&remote)
+	p.NewConn(conn)
+	return nil
+}
+
 func NewPeer(chain *BlockChain, cfg p2p.NetConfig, host string, port int) (p *Peer, err error) {
+	return newPeer(chain, cfg, host, port, nil)
+}
+
+// A peer that follows only the headers of the chain, see spv.go
+func NewSPVPeer(chain *BlockChain, cfg p2p.NetConfig, host string, port int) (p *Peer, err error) {
+	chain.Mtx.Lock()
+	genesis := chain.Block[0]
+	chain.Mtx.Unlock()
+	return newPeer(chain, cfg, host, port, NewHeaderChain(genesis, cfg.MaxNBits))
+}
+
+func newPeer(chain *BlockChain, cfg p2p.NetConfig, host string, port int, headers *HeaderChain) (p *Peer, err error) {
 	p = new(Peer)
 	p.Chain = chain
+	p.Headers = headers
 	p.Config = cfg
 	p.conns = make(map[*PeerConnection]void)
 	p.orphans.Init(chain)
+	p.orphanTxs.Init(chain)
+	p.requests = newRequestTracker()
+	p.Addrs = NewAddrManager()
+	p.Bans = NewBanList()
+	p.done = make(chan void)
+	p.inboundTrickle = InboundTrickleInterval
+	p.outboundTrickle = OutboundTrickleInterval
+	p.pingInterval = PingInterval
+	p.pingTimeout = PingTimeout
+	p.connectInterval = ConnectInterval
+	p.blockRequestTimeout = BlockRequestTimeout
+	p.txRequestTimeout = TxRequestTimeout
+	p.requestCheckInterval = RequestCheckInterval
 	if port < 0 {
 		port = cfg.DefaultPort
 	}
@@ -88,175 +289,187 @@ func NewPeer(chain *BlockChain, cfg p2p.NetConfig, host string, port int) (p *Pe
 	if err != nil {
 		return
 	}
-	log.Println("[INFO] Server listening on", p.ln.Addr())
+	netLog.Info("Server listening", "addr", p.ln.Addr(), "network", cfg.Name)
 	go p.messageLoop()
+	go p.connectionLoop()
+	go p.requestLoop()
 	return
 }
 
 func (p *Peer) Dial(addr string) (net.Conn, error) {
-	return reuse.Dial("tcp", p.ln.Addr().String(), addr)
-}
-
-func (p *Peer) BroadcastTransaction(tx message.Transaction) (err error) {
-	var b []byte
-	b, err = utils.GetBytes(&tx)
-	if err != nil {
-		log.Println("[ERROR] Serializing tx:", err)
-		return
+	// dial from the listening port so that the peer learns where to reach us
+	d := net.Dialer{
+		Control: reuse.Control,
+		Timeout: DialTimeout,
+		LocalAddr: p.ln.Addr(),
 	}
-	p.lock.RLock()
-	for c := range p.conns {
-		c.sendMessage("tx", b)
-	}
-	p.lock.RUnlock()
-	return
-}
-
-func (p *Peer) BroadcastBlock(blk message.SerializedBlock) (err error) {
-	var b []byte
-	b, err = utils.GetBytes(&blk)
-	if err != nil {
-		log.Println("[ERROR] Serializing tx:", err)
-		return
-	}
-	p.lock.RLock()
-	for c := range p.conns {
-		c.sendMessage("block", b)
-	}
-	p.lock.RUnlock()
-	return
+	return d.Dial("tcp", addr)
 }
 
 type PeerConnection struct {
 	Conn net.Conn
 	peer *Peer
+	// Whether the remote side dialed us
+	Inbound bool
+	// closed when Serve returns
+	quit chan void
+	// messages waiting for writeLoop
+	sendq *sendQueue
+	// protects the ping state below
+	mtx sync.Mutex
+	pingNonce uint64 // 0 if no ping is waiting for its pong
+	pingSent time.Time
+	rtt time.Duration
+	connectedAt time.Time
+	// when the peer last sent a block or transaction new to us
+	lastBlock time.Time
+	lastTx time.Time
+	// banned at BanThreshold
+	banScore int
+	// transactions waiting for the next trickle
+	txQueue map[[32]byte]void
+	// announce blocks with headers instead of inv
+	sendHeaders bool
+	// inventory the peer has, or that we sent or announced to it
+	known *invFilter
+	// the peer takes compact blocks, and wants new ones pushed without announcement
+	cmpct bool
+	cmpctAnnounce bool
+	// only used by Serve
+	partial *partialBlock
+	// loaded by a lightweight client, nil if transactions are not filtered
+	filter *BloomFilter
+	// transactions of the last merkleblock we are waiting for, only used by Serve
+	merkleTxns map[[32]byte][32]byte
 }
 
 func (c *PeerConnection) readMessage() (command string, payload []byte, err error) {
 	header := make([]byte, 4 + 12 + 4 + 4)
 	_, err = io.ReadFull(c.Conn, header)
 	if err != nil {
-		if err == io.EOF {
-			return
-		}
-		log.Println("[ERROR] Error returned when reading header")
 		return
 	}
 	if bytes.Compare(c.peer.Config.StartString[:], header[0:4]) != 0 {
-		log.Println("[ERROR] Invalid start string, discarding")
-		err = errors.New("invalidStartString")
+		err = errInvalidStartString
 		return
 	}
 	command = string(bytes.TrimRight(header[4:16], "\x00"))
 	payload_size := binary.LittleEndian.Uint32(header[16:20])
 	if payload_size > c.peer.Config.MaxNBits {
-		log.Println("[ERROR] Payload too large")
-		err = errors.New("payloadTooLarge")
+		err = errPayloadTooLarge
 		return
 	}
 	payload = make([]byte, payload_size)
 	_, err = io.ReadFull(c.Conn, payload)
 	if err != nil {
-		log.Println("[ERROR] Error occurred while reading payload")
 		return
 	}
 	recv_chksum := utils.Sha256Twice(payload)
 	if bytes.Compare(recv_chksum[:4], header[20:24]) != 0 {
-		log.Println("[ERROR] Checksum do not match in message, discarding")
+		err = errBadChecksum
 		return
 	}
+	metricMsgsReceived.With(commandLabel(command)).Inc()
+	metricBytesReceived.With(commandLabel(command)).Add(float64(len(header) + len(payload)))
 	return
 }
 
-func (c *PeerConnection) dispatchMessage(command string, payload []byte) (err error) {
+// Handle a message. Misbehavior is scored, and the connection is closed by a ban.
+// Other errors are deliberately ignored: they are on our side, like a missing index,
+// or the connection is closing and the next read in Serve fails anyway.
+func (c *PeerConnection) dispatchMessage(command string, payload []byte) {
+	var err error
 	switch command {
 	// Data messages
 	// https://developer.bitcoin.org/reference/p2p_networking.html#id1
 	case "getheaders":
-		// Not yet in plan
+		err = c.onGetHeaders(payload)
 	case "headers":
-		// Not yet in plan
+		err = c.onHeaders(payload)
 	case "getblocks":
-		c.onGetBlocks(payload)
+		err = c.onGetBlocks(payload)
 		// return "inv", at most 500
 	case "mempool":
-		c.onMempool(payload)
+		err = c.onMempool(payload)
 	case "inv":
-		c.onInv(payload)
+		err = c.onInv(payload)
 	case "getdata":
-		c.onGetData(payload)
+		err = c.onGetData(payload)
 	case "tx":
-		c.onTx(payload)
+		err = c.onTx(payload)
 	case "block":
-		c.onBlock(payload)
+		err = c.onBlock(payload)
 	case "merkleblock":
-		// Not yet in plan
+		err = c.onMerkleBlock(payload)
 	case "notfound":
-		// Not yet in plan
+		err = c.onNotFound(payload)
+	case "cmpctblock":
+		err = c.onCmpctBlock(payload)
+	case "getblocktxn":
+		err = c.onGetBlockTxn(payload)
+	case "blocktxn":
+		err = c.onBlockTxn(payload)
+	case "getcfilters":
+		err = c.onGetCFilters(payload)
+	case "getcfheaders":
+		err = c.onGetCFHeaders(payload)
+	case "getcfcheckpt":
+		err = c.onGetCFCheckpt(payload)
 
 	// Control messages
 	case "version":
 	case "verack":
 	case "ping":
-		// Not yet in plan
+		err = c.onPing(payload)
 	case "pong":
-		// Not yet in plan
+		err = c.onPong(payload)
 	case "getaddr":
-		c.onGetAddr(payload)
+		err = c.onGetAddr(payload)
 	case "addr":
-		c.onAddr(payload)
+		err = c.onAddr(payload)
 	case "addrv2":
 		// Not yet in plan
 	case "filterload":
-		// Not yet in plan
+		err = c.onFilterLoad(payload)
 	case "filteradd":
-		// Not yet in plan
+		err = c.onFilterAdd(payload)
 	case "filterclear":
-		// Not yet in plan
+		err = c.onFilterClear(payload)
 	case "sendaddrv2":
 		// Not yet in plan
 	case "sendheaders":
-		// Not yet in plan
+		err = c.onSendHeaders(payload)
+	case "sendcmpct":
+		err = c.onSendCmpct(payload)
 	case "reject":
-		// Not yet in plan
+		err = c.onReject(payload)
 	}
-	return
-}
-
-func (c *PeerConnection) sendMessage(command string, payload []byte) (err error) {
-	header := utils.NewBufWriter()
-	header.WriteBytes(c.peer.Config.StartString[:])
-	t := []byte(command)
-	header.WriteBytes(t)
-	for i := 0; i < 12 - len(t); i++ {
-		header.WriteUint8(0)
-	}
-	header.WriteUint32(uint32(len(payload)))
-	chksum := utils.Sha256Twice(payload)
-	header.WriteBytes(chksum[:4])
-	_, err = c.Conn.Write(header.Collect())
-	if err != nil {
-		return
+	var m *misbehavior
+	if errors.As(err, &m) {
+		c.Misbehaving(m.score, m.reason)
+	} else if err != nil {
+		netLog.Debug("Handling message failed", "addr", c.Conn.RemoteAddr(), "command", command, "err", err)
 	}
-	_, err = c.Conn.Write(payload)
-	return
 }
 
 func (c *PeerConnection) onMempool(data []byte) (err error) {
-	inv := make([][]message.Inventory, 0)
+	inv := make([]message.Inventory, 0)
+	filter := c.bloomFilter()
 	c.peer.Chain.Mtx.Lock()
-	cur_pt := make([]message.Inventory, 0)
-	inv = append(inv, cur_pt)
-	for k := range c.peer.Chain.Mempool {
-		if len(cur_pt) == message.InvMaxItemCount {
-			cur_pt := make([]message.Inventory, 0)
-			inv = append(inv, cur_pt)
+	for k, tx := range c.peer.Chain.Mempool {
+		if filter != nil && !filter.MatchTx(&tx, k) {
+			continue
 		}
-		cur_pt = append(cur_pt, message.Inventory{Type: message.MSG_TX, Hash: k})
+		inv = append(inv, message.Inventory{Type: message.MSG_TX, Hash: k})
 	}
 	c.peer.Chain.Mtx.Unlock()
-	for _, v := range inv {
-		msg := message.InvMsg{Inv: v}
+	for len(inv) > 0 {
+		n := len(inv)
+		if n > message.InvMaxItemCount {
+			n = message.InvMaxItemCount
+		}
+		msg := message.InvMsg{Inv: inv[:n]}
+		inv = inv[n:]
 		data, _ = utils.GetBytes(&msg)
 		err = c.sendMessage("inv", data)
 		if err != nil {
@@ -268,7 +481,7 @@ func (c *PeerConnection) onMempool(data []byte) (err error) {
 
 func (c *PeerConnection) onGetBlocks(data []byte) (err error) {
 	var msg message.GetBlocksMsg
-	err = msg.LoadBuffer(utils.NewBufReader(bytes.NewBuffer(data)))
+	err = decodePayload("getblocks", data, &msg)
 	if err != nil {
 		return
 	}
@@ -304,18 +517,24 @@ func (c *PeerConnection) onGetBlocks(data []byte) (err error) {
 }
 
 func (c *PeerConnection) onInv(data []byte) (err error) {
-	reader := utils.NewBufReader(bytes.NewBuffer(data))
 	var invmsg message.InvMsg
-	err = invmsg.LoadBuffer(reader)
+	err = decodePayload("inv", data, &invmsg)
 	if err != nil {
 		return
 	}
 	retmsg := message.InvMsg{Inv: make([]message.Inventory, 0)}
+	syncHeaders := false
 	c.peer.lock.RLock()
 	c.peer.Chain.Mtx.Lock()
 	for _, v := range invmsg.Inv {
+		c.known.add(v.Hash)
 		switch v.Type {
 		case message.MSG_BLOCK:
+			if c.peer.Headers != nil {
+				// lightweight clients follow headers only
+				syncHeaders = syncHeaders || !c.peer.Headers.Has(v.Hash)
+				continue
+			}
 			ok := false
 			if !ok {
 				_, ok = c.peer.Chain.Height[v.Hash]
@@ -331,30 +550,30 @@ func (c *PeerConnection) onInv(data []byte) (err error) {
 		case message.MSG_TX:
 			ok := false
 			_, ok = c.peer.Chain.TX[v.Hash]
+			if !ok {
+				_, ok = c.peer.orphanTxs.txs[v.Hash]
+			}
 			if !ok {
 				retmsg.Inv = append(retmsg.Inv, v)
 			}
 		default:
-			log.Println("[ERROR] Unknown inv type: ", v.Type)
+			netLog.Warn("Unknown inv type", "addr", c.Conn.RemoteAddr(), "type", v.Type)
 		}
 	}
 	c.peer.Chain.Mtx.Unlock()
 	c.peer.lock.RUnlock()
-	if len(retmsg.Inv) > 0 {
-		var data []byte
-		data, err = utils.GetBytes(&retmsg)
+	if syncHeaders {
+		err = c.doBlockSync()
 		if err != nil {
 			return
 		}
-		err = c.sendMessage("getdata", data)
 	}
-	return
+	return c.requestItems(retmsg.Inv)
 }
 
 func (c *PeerConnection) onTx(data []byte) (err error) {
-	reader := utils.NewBufReader(bytes.NewBuffer(data))
 	var tx message.Transaction
-	err = tx.LoadBuffer(reader)
+	err = decodePayload("tx", data, &tx)
 	if err != nil {
 		return
 	}
@@ -364,47 +583,76 @@ func (c *PeerConnection) onTx(data []byte) (err error) {
 	if err != nil {
 		return err
 	}
+	c.known.add(hash)
+	err = c.requestDone(hash)
+	if err != nil {
+		return
+	}
+	if c.peer.Headers != nil {
+		return c.onSPVTx(tx, hash)
+	}
+	var rejected error
+	var parents [][32]byte
+	var accepted []message.Transaction
 	c.peer.Chain.Mtx.Lock()
 	_, flag = c.peer.Chain.TX[hash]
 	if !flag {
-		c.peer.Chain.addTransaction(tx)
+		rejected = c.peer.Chain.checkNewTransaction(tx)
+		if rejected == nil {
+			c.peer.Chain.acceptTransaction(tx)
+			accepted = append([]message.Transaction{tx}, c.peer.orphanTxs.acceptChildren([]message.Transaction{tx})...)
+		} else if rejected == txMissingInputs {
+			parents = c.peer.orphanTxs.missingParents(&tx)
+			if len(parents) > 0 && c.peer.orphanTxs.add(tx, hash, c, time.Now()) {
+				rejected = nil
+			}
+		}
 	}
 	c.peer.Chain.Mtx.Unlock()
+	if rejected != nil {
+		mempoolLog.Debug("Transaction rejected", "addr", c.Conn.RemoteAddr(), "txid", utils.HashToString(hash), "reason", rejected)
+		return c.sendReject("tx", rejected, hash)
+	}
+	if len(parents) > 0 {
+		mempoolLog.Debug("Orphan transaction kept", "addr", c.Conn.RemoteAddr(), "txid", utils.HashToString(hash), "parents", len(parents))
+		inv := make([]message.Inventory, len(parents))
+		for i, parent := range parents {
+			inv[i] = message.Inventory{Type: message.MSG_TX, Hash: parent}
+		}
+		return c.requestItems(inv)
+	}
 	if !flag {
-		err = c.peer.BroadcastTransaction(tx)
+		c.mtx.Lock()
+		c.lastTx = time.Now()
+		c.mtx.Unlock()
+	}
+	for _, v := range accepted {
+		err = c.peer.BroadcastTransaction(v)
+		if err != nil {
+			return
+		}
 	}
 	return
 }
 
 func (c *PeerConnection) onGetData(data []byte) (err error) {
-	reader := utils.NewBufReader(bytes.NewBuffer(data))
 	var msg message.InvMsg
-	err = msg.LoadBuffer(reader)
+	err = decodePayload("getdata", data, &msg)
 	if err != nil {
 		return err
 	}
+	notfound := message.InvMsg{Inv: make([]message.Inventory, 0)}
 	for _, v := range msg.Inv {
 		switch v.Type {
-		case message.MSG_BLOCK:
-			var blk message.SerializedBlock
-			c.peer.Chain.Mtx.Lock()
-			h, ok := c.peer.Chain.Height[v.Hash]
-			if ok {
-				blk = c.peer.Chain.Block[h]
-			}
+		case message.MSG_BLOCK, message.MSG_CMPCT_BLOCK, message.MSG_FILTERED_BLOCK:
+			blk, _, ok := c.peer.findBlock(v.Hash)
 			if !ok {
-				var node *orphanNode
-				node, ok = c.peer.orphans.nodes[v.Hash]
-				if ok {
-					if node.blk != nil {
-						blk = *node.blk
-					} else {
-						ok = false
-					}
-				}
-			}
-			c.peer.Chain.Mtx.Unlock()
-			if ok {
+				notfound.Inv = append(notfound.Inv, v)
+			} else if v.Type == message.MSG_CMPCT_BLOCK {
+				c.sendCmpctBlock(v.Hash)
+			} else if v.Type == message.MSG_FILTERED_BLOCK {
+				c.sendFilteredBlock(v.Hash)
+			} else {
 				data, _ := utils.GetBytes(&blk)
 				c.sendMessage("block", data)
 			}
@@ -417,23 +665,64 @@ func (c *PeerConnection) onGetData(data []byte) (err error) {
 			if ok {
 				data, _ := utils.GetBytes(&tx)
 				c.sendMessage("tx", data)
+			} else {
+				notfound.Inv = append(notfound.Inv, v)
 			}
 		}
 	}
+	if len(notfound.Inv) > 0 {
+		data, err = utils.GetBytes(&notfound)
+		if err != nil {
+			return
+		}
+		err = c.sendMessage("notfound", data)
+	}
+	return
+}
+
+// A block in the chain or among the orphans, depth is -1 for orphans
+func (p *Peer) findBlock(hash [32]byte) (blk message.SerializedBlock, depth int, ok bool) {
+	p.Chain.Mtx.Lock()
+	defer p.Chain.Mtx.Unlock()
+	if h, ok := p.Chain.Height[hash]; ok {
+		return p.Chain.Block[h], len(p.Chain.Block) - 1 - h, true
+	}
+	if node, ok := p.orphans.nodes[hash]; ok && node.blk != nil {
+		return *node.blk, -1, true
+	}
 	return
 }
 
 var BlockTTL uint64 = 600 // seconds
 func (c *PeerConnection) onBlock(data []byte) (err error) {
 	var blk message.SerializedBlock
-	reader := utils.NewBufReader(bytes.NewBuffer(data))
-	err = blk.LoadBuffer(reader)
+	err = decodePayload("block", data, &blk)
+	if err != nil {
+		return
+	}
+	return c.processBlock(&blk)
+}
+
+// Connect a block the peer sent, with its orphaned ancestors,
+// if that makes a longer chain
+func (c *PeerConnection) processBlock(blk *message.SerializedBlock) (err error) {
+	err = c.requestDone(blk.HeaderHash)
 	if err != nil {
 		return
 	}
-	c.peer.orphans.AddBlock(&blk)
+	if c.peer.Headers != nil {
+		// lightweight clients do not keep blocks
+		return
+	}
+	c.known.add(blk.HeaderHash)
+	c.peer.orphans.AddBlock(blk)
 	go c.peer.orphans.RemoveBlock(blk.HeaderHash, BlockTTL)
-	chain := c.peer.orphans.GetLongestChain(blk.HeaderHash)
+	chain, err := c.peer.orphans.GetLongestChain(blk.HeaderHash)
+	if err != nil {
+		// part of the chain expired meanwhile, wait for it to be sent again
+		netLog.Debug("Orphan chain is incomplete", "block", utils.HashToString(blk.HeaderHash), "err", err)
+		return nil
+	}
 	if len(chain) > 0 {
 		c.peer.Chain.Mtx.Lock()
 		hei, ok := c.peer.Chain.Height[chain[0].Header.Previous_block_header_hash]
@@ -442,17 +731,36 @@ func (c *PeerConnection) onBlock(data []byte) (err error) {
 			ok = hei + 1 + len(chain) > len(c.peer.Chain.Block)
 		}
 		c.peer.Chain.Mtx.Unlock()
+		chain2 := make([]message.SerializedBlock, len(chain))
+		for i, v := range chain {
+			chain2[i] = *v
+		}
 		if ok {
-			chain2 := make([]message.SerializedBlock, len(chain))
-			for i, v := range chain {
-				chain2[i] = *v
+			err = c.peer.Chain.acceptBlocks(hei + 1, chain2)
+			if isInvalidBlock(err) {
+				for _, v := range chain {
+					c.peer.orphans.RemoveBlock(v.HeaderHash, 0)
+				}
+				c.sendReject("block", err, blk.HeaderHash)
+				return &misbehavior{scoreInvalidBlock, "invalid block: " + err.Error()}
 			}
-			ok = c.peer.Chain.addBlock(hei + 1, chain2)
+			ok = err == nil
 		}
 		if ok {
+			c.mtx.Lock()
+			c.lastBlock = time.Now()
+			c.mtx.Unlock()
 			for _, v := range chain {
 				c.peer.orphans.RemoveBlock(v.HeaderHash, 0)
 			}
+			c.peer.announceBlocks(chain2)
+			c.peer.Chain.Mtx.Lock()
+			accepted := c.peer.orphanTxs.connectBlocks(chain2)
+			c.peer.Chain.Mtx.Unlock()
+			for _, tx := range accepted {
+				c.peer.BroadcastTransaction(tx)
+				// err is ignored
+			}
 		}
 	} else {
 		err = c.doBlockSync()
@@ -461,6 +769,9 @@ func (c *PeerConnection) onBlock(data []byte) (err error) {
 }
 
 func (c *PeerConnection) doBlockSync() (err error) {
+	if c.peer.Headers != nil {
+		return c.sendGetHeaders()
+	}
 	var msg message.GetBlocksMsg
 	arr := make([][32]byte, 0)
 	c.peer.Chain.Mtx.Lock()
@@ -478,28 +789,46 @@ func (c *PeerConnection) doBlockSync() (err error) {
 	return
 }
 
-func (p *Peer) GetPeerList() (arr []net.TCPAddr) {
+type PeerInfo struct {
+	Addr net.TCPAddr
+	Inbound bool
+	// zero until the first pong
+	RTT time.Duration
+	PingWait time.Duration
+	BanScore int
+}
+
+func (p *Peer) GetPeerInfo() (arr []PeerInfo) {
 	p.lock.RLock()
 	defer p.lock.RUnlock()
-	arr = make([]net.TCPAddr, len(p.conns))
-	i := 0
+	arr = make([]PeerInfo, 0, len(p.conns))
 	for c := range p.conns {
-		arr[i] = ConnectionToAddr(c.Conn.RemoteAddr())
-		i++
+		info := PeerInfo{Addr: ConnectionToAddr(c.Conn.RemoteAddr()), Inbound: c.Inbound}
+		info.RTT, info.PingWait = c.PingTimes()
+		c.mtx.Lock()
+		info.BanScore = c.banScore
+		c.mtx.Unlock()
+		arr = append(arr, info)
 	}
 	return
 }
 
-var unexpectedPayload = errors.New("unexpectedPayload")
 func (c *PeerConnection) onGetAddr(payload []byte) (err error) {
 	if len(payload) > 0 {
-		return unexpectedPayload
+		return &misbehavior{scoreUnexpectedPayload, "unexpected payload in getaddr"}
 	}
-	peer_list := c.peer.GetPeerList()
-	arr := make([]message.NetworkIPAddress, len(peer_list))
-	for i, addr := range peer_list {
-		copy(arr[i].Ipv6[:], addr.IP.To16())
-		arr[i].Port = uint16(addr.Port)
+	known := c.peer.Addrs.GetAddresses(message.MaxAddrCount)
+	arr := make([]message.NetworkIPAddress, 0, len(known))
+	for _, ka := range known {
+		addr, err := net.ResolveTCPAddr("tcp", ka.Addr)
+		if err != nil {
+			continue
+		}
+		var v message.NetworkIPAddress
+		v.Time = uint32(ka.LastSeen)
+		copy(v.Ipv6[:], addr.IP.To16())
+		v.Port = uint16(addr.Port)
+		arr = append(arr, v)
 	}
 	addrmsg := message.AddrMsg{Addrs: arr}
 	var raw_data []byte
@@ -511,69 +840,73 @@ func (c *PeerConnection) onGetAddr(payload []byte) (err error) {
 	return
 }
 
+// Serve a connection we dialed
 func (p *Peer) NewConn(conn net.Conn) {
+	p.newConn(conn, false)
+}
+
+func (p *Peer) newConn(conn net.Conn, inbound bool) {
 	var new_c PeerConnection
 	new_c.Conn = conn
 	new_c.peer = p
+	new_c.Inbound = inbound
+	new_c.quit = make(chan void)
+	new_c.sendq = newSendQueue(MaxSendQueueBytes)
+	new_c.connectedAt = time.Now()
+	new_c.txQueue = make(map[[32]byte]void)
+	new_c.known = newInvFilter(knownInvSize)
 	go new_c.Serve()
-	log.Println("[INFO] New connection from", conn.RemoteAddr())
+	netLog.Info("New connection", "addr", conn.RemoteAddr(), "inbound", inbound)
 }
 
+// Addresses are only relayed when few were sent and they are new to us
+const maxAddrRelay = 10
+
 func (c *PeerConnection) onAddr(data []byte) (err error) {
 	p := c.peer
-	reader := utils.NewBufReader(bytes.NewBuffer(data))
 	var msg message.AddrMsg
-	err = msg.LoadBuffer(reader)
+	err = decodePayload("addr", data, &msg)
 	if err != nil {
 		return
 	}
-	filtered := make([]message.NetworkIPAddress, 0)
-	p.lock.RLock()
-	peer_list := p.GetPeerList()
+	now := utils.Now()
+	source := ConnectionToAddr(c.Conn.RemoteAddr())
+	relay := make([]message.NetworkIPAddress, 0)
 	for _, v := range msg.Addrs {
-		// check if we are already connected
-		found := false
-		for _, addr := range peer_list {
-			if bytes.Compare(v.Ipv6[:], addr.IP.To16()) == 0 && v.Port == uint16(addr.Port) {
-				found = true
-				break
-			}
+		addr := net.TCPAddr{IP: net.IP(v.Ipv6[:]), Port: int(v.Port)}
+		if p.isLocal(&addr) {
+			continue
 		}
-		if !found {
-			addr := ConnectionToAddr(p.ln.Addr())
-			if bytes.Compare(v.Ipv6[:], addr.IP.To16()) == 0 && v.Port == uint16(addr.Port) {
-				found = true
-			}
-		}
-		if !found {
-			addr := ConnectionToAddr(c.Conn.LocalAddr())
-			if bytes.Compare(v.Ipv6[:], addr.IP.To16()) == 0 && v.Port == uint16(addr.Port) {
-				found = true
-			}
+		seen := time.Unix(int64(v.Time), 0)
+		if v.Time == 0 || seen.After(now.Add(10 * time.Minute)) {
+			// unknown or in the future
+			seen = now.Add(-5 * 24 * time.Hour)
 		}
-		if !found {
-			tcpaddr := net.TCPAddr{IP: v.Ipv6[:], Port: int(v.Port)}
-			conn, err := p.Dial(tcpaddr.String())
-			if err != nil {
-				log.Printf("[WARNING] Connection to %v failed.", tcpaddr)
-			} else {
-				filtered = append(filtered, v)
-				p.NewConn(conn)
-			}
+		if p.Addrs.Add(&addr, source.IP, seen) && now.Sub(seen) < 10 * time.Minute {
+			relay = append(relay, v)
 		}
 	}
-	if len(filtered) > 0 {
-		addrmsg := message.AddrMsg{Addrs: filtered}
-		var raw_data []byte
-		raw_data, err = utils.GetBytes(&addrmsg)
-		if err != nil {
-			return
-		}
-		for c := range p.conns {
-			c.sendMessage("addr", raw_data)
-			// err is ignored
+	if len(msg.Addrs) > maxAddrRelay || len(relay) == 0 {
+		return
+	}
+	addrmsg := message.AddrMsg{Addrs: relay}
+	var raw_data []byte
+	raw_data, err = utils.GetBytes(&addrmsg)
+	if err != nil {
+		return
+	}
+	// to two other peers, so the addresses spread without flooding
+	p.lock.RLock()
+	targets := make([]*PeerConnection, 0, 2)
+	for other := range p.conns {
+		if other != c && len(targets) < 2 {
+			targets = append(targets, other)
 		}
 	}
 	p.lock.RUnlock()
+	for _, other := range targets {
+		other.sendMessage("addr", raw_data)
+		// err is ignored
+	}
 	return
 }
@@ -0,0 +1,823 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/p2p"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+type fakeConn struct {
+	net.Conn
+	remote net.TCPAddr
+	closed bool
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr {
+	return &c.remote
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestEviction(t *testing.T) {
+	p := &Peer{conns: make(map[*PeerConnection]void)}
+	start := time.Now()
+	add := func(ip net.IP, age time.Duration) *PeerConnection {
+		c := &PeerConnection{Conn: &fakeConn{remote: net.TCPAddr{IP: ip, Port: 8333}}, Inbound: true}
+		c.connectedAt = start.Add(-age)
+		p.conns[c] = void_null
+		return c
+	}
+	// honest peers in different groups, connected for a while
+	for i := 0; i < 20; i++ {
+		c := add(net.IPv4(byte(20+i), 0, 0, 1), time.Hour+time.Duration(i)*time.Minute)
+		c.rtt = time.Duration(100+i) * time.Millisecond
+	}
+	// a flood from one group
+	var newest *PeerConnection
+	for i := 0; i < 10; i++ {
+		newest = add(net.IPv4(10, 1, byte(i), 1), time.Duration(10-i)*time.Second)
+	}
+	if victim := p.selectEviction(); victim != newest {
+		t.Fatalf("Expect the newest connection of the largest group to be evicted, got %v", victim.Conn.RemoteAddr())
+	}
+
+	p.SetLimits(ConnLimits{MaxConnections: 38, MaxOutbound: 8, MaxPerIP: 1})
+	if p.acceptInbound(&net.TCPAddr{IP: net.IPv4(20, 0, 0, 1), Port: 1}) {
+		t.Fatalf("A second connection from one IP should be refused")
+	}
+	if !p.acceptInbound(&net.TCPAddr{IP: net.IPv4(99, 0, 0, 1), Port: 1}) || !newest.Conn.(*fakeConn).closed {
+		t.Fatalf("A connection should be evicted to make room")
+	}
+
+	// only protected connections left
+	p.conns = make(map[*PeerConnection]void)
+	for i := 0; i < 4; i++ {
+		add(net.IPv4(byte(20+i), 0, 0, 1), time.Hour)
+	}
+	p.SetLimits(ConnLimits{MaxConnections: 4})
+	if p.acceptInbound(&net.TCPAddr{IP: net.IPv4(99, 0, 0, 1), Port: 1}) {
+		t.Fatalf("The connection should be refused when nothing can be evicted")
+	}
+}
+
+func TestBanList(t *testing.T) {
+	clock := utils.NewMockClock(time.Unix(1650000000, 0))
+	utils.SetClock(clock)
+	defer utils.SetClock(nil)
+	l := NewBanList()
+	path := filepath.Join(t.TempDir(), "banlist.json")
+	if err := l.Load(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	subnet, _ := ParseSubnet("10.1.0.0/16")
+	l.Ban(subnet, time.Hour, "test")
+	single, _ := ParseSubnet("192.168.0.1")
+	l.Ban(single, 2*time.Hour, "test")
+	if !l.IsBanned(net.IPv4(10, 1, 2, 3)) || l.IsBanned(net.IPv4(10, 2, 0, 1)) {
+		t.Fatalf("Only addresses in the subnet should be banned")
+	}
+	loaded := NewBanList()
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := len(loaded.List()); n != 2 {
+		t.Fatalf("Expect 2 bans after loading, %v found", n)
+	}
+	clock.Advance(90 * time.Minute)
+	if loaded.IsBanned(net.IPv4(10, 1, 2, 3)) || !loaded.IsBanned(net.IPv4(192, 168, 0, 1)) {
+		t.Fatalf("Only the first ban should have expired")
+	}
+	if ok, _ := loaded.Unban(single); !ok || len(loaded.List()) != 0 {
+		t.Fatalf("Unban should remove the entry")
+	}
+}
+
+func TestMisbehaving(t *testing.T) {
+	p := &Peer{conns: make(map[*PeerConnection]void), Bans: NewBanList()}
+	fake := &fakeConn{remote: net.TCPAddr{IP: net.IPv4(20, 0, 0, 1), Port: 8333}}
+	c := &PeerConnection{Conn: fake, peer: p, Inbound: true}
+	p.conns[c] = void_null
+	// an unreadable tx
+	c.dispatchMessage("tx", []byte{1, 2, 3})
+	if c.banScore != scoreMalformed || fake.closed {
+		t.Fatalf("Unexpected score %v", c.banScore)
+	}
+	c.Misbehaving(BanThreshold-scoreMalformed, "test")
+	if !fake.closed || !p.Bans.IsBanned(fake.remote.IP) {
+		t.Fatalf("The peer should be banned and disconnected")
+	}
+
+	// loopback peers are banned too, unless whitelisted
+	local := &fakeConn{remote: net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 18444}}
+	c = &PeerConnection{Conn: local, peer: p, Inbound: true}
+	p.conns[c] = void_null
+	c.Misbehaving(BanThreshold, "test")
+	if !local.closed || !p.Bans.IsBanned(local.remote.IP) {
+		t.Fatalf("The loopback peer should be banned")
+	}
+	p.Bans.Unban(singleIP(local.remote.IP))
+	subnet, _ := ParseSubnet("127.0.0.0/8")
+	p.Bans.Whitelist(subnet)
+	local = &fakeConn{remote: net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 18444}}
+	c = &PeerConnection{Conn: local, peer: p, Inbound: true}
+	c.Misbehaving(BanThreshold, "test")
+	if !local.closed || p.Bans.IsBanned(local.remote.IP) {
+		t.Fatalf("The whitelisted peer should only be disconnected")
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	q := newSendQueue(100)
+	q.push(outMsg{"block", make([]byte, 60)})
+	q.push(outMsg{"ping", make([]byte, 30)})
+	if err := q.push(outMsg{"tx", make([]byte, 20)}); err != errSendQueueFull {
+		t.Fatalf("Expect errSendQueueFull, got %v", err)
+	}
+	released := make(chan void)
+	go func() {
+		q.waitBelow(50)
+		close(released)
+	}()
+	if m, _ := q.pop(); m.command != "ping" {
+		t.Fatalf("Control messages should be sent first, got %v", m.command)
+	}
+	select {
+	case <-released:
+		t.Fatalf("60 bytes are still queued")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if m, _ := q.pop(); m.command != "block" {
+		t.Fatalf("Unexpected message %v", m.command)
+	}
+	<-released
+	q.close()
+	if _, ok := q.pop(); ok {
+		t.Fatalf("A closed queue should return nothing")
+	}
+	if err := q.push(outMsg{"tx", nil}); err != errConnClosed {
+		t.Fatalf("Expect errConnClosed, got %v", err)
+	}
+}
+
+func TestInvFilter(t *testing.T) {
+	f := newInvFilter(2)
+	f.add([32]byte{1})
+	f.add([32]byte{2})
+	f.add([32]byte{1})
+	f.add([32]byte{3})
+	if f.has([32]byte{1}) || !f.has([32]byte{2}) || !f.has([32]byte{3}) {
+		t.Fatalf("The oldest hash should be forgotten first")
+	}
+}
+
+// Two regtest peers, a connected to b, and a helper to wait for something to happen
+func connectTestPeers(t *testing.T) (a *Peer, b *Peer, waitFor func(what string, cond func() bool)) {
+	newPeer := func() *Peer {
+		var chain BlockChain
+		var wallet Wallet
+		wallet.Init(&chain)
+		chain.init(&wallet)
+		peer, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return peer
+	}
+	a, b = newPeer(), newPeer()
+	conn, err := a.Dial(b.ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	a.NewConn(conn)
+	deadline := time.Now().Add(10 * time.Second)
+	waitFor = func(what string, cond func() bool) {
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %v", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return
+}
+
+func TestRelay(t *testing.T) {
+	inbound, outbound := InboundTrickleInterval, OutboundTrickleInterval
+	InboundTrickleInterval, OutboundTrickleInterval = 20*time.Millisecond, 20*time.Millisecond
+	defer func() { InboundTrickleInterval, OutboundTrickleInterval = inbound, outbound }()
+	a, b, waitFor := connectTestPeers(t)
+	defer a.ln.Close()
+	defer b.ln.Close()
+	sendsHeaders := func(p *Peer) func() bool {
+		return func() bool {
+			p.lock.RLock()
+			defer p.lock.RUnlock()
+			for c := range p.conns {
+				c.mtx.Lock()
+				defer c.mtx.Unlock()
+				return c.sendHeaders
+			}
+			return false
+		}
+	}
+	waitFor("sendheaders", sendsHeaders(a))
+	waitFor("sendheaders", sendsHeaders(b))
+
+	hashes, err := a.Generate(1, 0, pk_script3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitFor("the block", func() bool {
+		b.Chain.Mtx.Lock()
+		defer b.Chain.Mtx.Unlock()
+		_, ok := b.Chain.Height[hashes[0]]
+		return ok
+	})
+
+	// relayed transactions are checked, so spend the coinbase
+	blk, _, _ := a.findBlock(hashes[0])
+	coinbase, _ := utils.GetHash(&blk.Txns[0])
+	tx := message.Transaction{
+		Tx_in:  []message.TxIn{{Previous_output: message.Outpoint{Hash: coinbase}, Signature_script: signature_script3}},
+		Tx_out: []message.TxOut{{Value: 1, Pk_script: pk_script3}},
+	}
+	a.Chain.Mtx.Lock()
+	a.Chain.acceptTransaction(tx)
+	a.Chain.Mtx.Unlock()
+	a.BroadcastTransaction(tx)
+	txid, _ := utils.GetHash(&tx)
+	waitFor("the transaction", func() bool {
+		b.Chain.Mtx.Lock()
+		defer b.Chain.Mtx.Unlock()
+		_, ok := b.Chain.Mempool[txid]
+		return ok
+	})
+	// b got it from a, so it is not announced back
+	b.lock.RLock()
+	for c := range b.conns {
+		c.mtx.Lock()
+		if _, ok := c.txQueue[txid]; ok {
+			t.Fatalf("The transaction should not be queued for the peer it came from")
+		}
+		c.mtx.Unlock()
+	}
+	b.lock.RUnlock()
+}
+
+func TestCmpctBlock(t *testing.T) {
+	a, b, waitFor := connectTestPeers(t)
+	defer a.ln.Close()
+	defer b.ln.Close()
+	waitFor("sendcmpct", func() bool {
+		b.lock.RLock()
+		defer b.lock.RUnlock()
+		for c := range b.conns {
+			supported, _ := c.cmpctModes()
+			return supported
+		}
+		return false
+	})
+	hasBlock := func(hash [32]byte) func() bool {
+		return func() bool {
+			_, _, ok := b.findBlock(hash)
+			return ok
+		}
+	}
+	hashes, err := a.Generate(2, 0, pk_script3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitFor("the blocks", hasBlock(hashes[1]))
+
+	// spend both coinbases, b only has the first spend
+	spend := func(hash [32]byte) message.Transaction {
+		blk, _, _ := a.findBlock(hash)
+		txid, _ := utils.GetHash(&blk.Txns[0])
+		return message.Transaction{
+			Tx_in:  []message.TxIn{{Previous_output: message.Outpoint{Hash: txid}, Signature_script: signature_script3}},
+			Tx_out: []message.TxOut{{Value: 1, Pk_script: pk_script3}},
+		}
+	}
+	tx_a, tx_b := spend(hashes[0]), spend(hashes[1])
+	a.Chain.Mtx.Lock()
+	a.Chain.acceptTransaction(tx_a)
+	a.Chain.acceptTransaction(tx_b)
+	a.Chain.Mtx.Unlock()
+	b.Chain.Mtx.Lock()
+	b.Chain.acceptTransaction(tx_a)
+	b.Chain.Mtx.Unlock()
+	before := metricCmpctBlocks.With("blocktxn").Get()
+	hashes, err = a.Generate(1, 0, pk_script3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitFor("the compact block", hasBlock(hashes[0]))
+	blk, _, _ := b.findBlock(hashes[0])
+	if len(blk.Txns) != 3 {
+		t.Fatalf("Expect 3 transactions in the block, %v found", len(blk.Txns))
+	}
+	if metricCmpctBlocks.With("blocktxn").Get() != before+1 {
+		t.Fatalf("The missing transaction should have been asked for with getblocktxn")
+	}
+}
+
+// Test vector from Bitcoin Core's bloom_tests.cpp
+func TestBloomFilter(t *testing.T) {
+	f := NewBloomFilterFor(3, 0.01, 0, message.BloomUpdateAll)
+	for _, s := range []string{
+		"99108ad8ed9bb6274d3980bab5a85c048f0950c8",
+		"b5a2c786d9ef4658287ced5914b37a1b4aa32eee",
+		"b9300670b4c5366e95b2699e8b18bc75e5f729c5",
+	} {
+		data, _ := hex.DecodeString(s)
+		f.Add(data)
+		if !f.Contains(data) {
+			t.Fatalf("The filter should contain %v", s)
+		}
+	}
+	msg := f.LoadMsg()
+	data, _ := utils.GetBytes(&msg)
+	if hex.EncodeToString(data) != "03614e9b050000000000000001" {
+		t.Fatalf("Unexpected filter %x", data)
+	}
+
+	// a matching output makes spends of it match too
+	f = NewBloomFilterFor(10, 0.0001, 5, message.BloomUpdateAll)
+	f.Add(PK2Bytes(pk))
+	txid, _ := utils.GetHash(&tx1)
+	pays := message.Transaction{Tx_out: []message.TxOut{{Value: 1, Pk_script: pk_script3}, {Value: 1, Pk_script: pk_script2}}}
+	paysID, _ := utils.GetHash(&pays)
+	if f.MatchTx(&tx1, txid) || !f.MatchTx(&pays, paysID) {
+		t.Fatalf("Only the transaction paying to the key should match")
+	}
+	spends := message.Transaction{Tx_in: []message.TxIn{{Previous_output: message.NewOutPoint(paysID, 1)}}}
+	spendsID, _ := utils.GetHash(&spends)
+	if !f.MatchTx(&spends, spendsID) {
+		t.Fatalf("Spending a matched output should match")
+	}
+}
+
+func TestFilteredBlock(t *testing.T) {
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	p, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer p.ln.Close()
+	hashes, err := p.Generate(1, 0, pk_script2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c := &PeerConnection{Conn: &fakeConn{}, peer: p, sendq: newSendQueue(MaxSendQueueBytes), known: newInvFilter(10)}
+	// what c sends, without the message header
+	next := func(command string) []byte {
+		m, ok := c.sendq.pop()
+		if !ok || m.command != command {
+			t.Fatalf("Expect %v, %v sent", command, m.command)
+		}
+		return m.data[24:]
+	}
+	f := NewBloomFilterFor(1, 0.0001, 0, message.BloomUpdateNone)
+	f.Add(PK2Bytes(pk))
+	load := f.LoadMsg()
+	data, _ := utils.GetBytes(&load)
+	c.dispatchMessage("filterload", data)
+	getdata := message.InvMsg{Inv: []message.Inventory{{Type: message.MSG_FILTERED_BLOCK, Hash: hashes[0]}}}
+	data, _ = utils.GetBytes(&getdata)
+	c.dispatchMessage("getdata", data)
+	var mb message.MerkleBlockMsg
+	if err := decodePayload("merkleblock", next("merkleblock"), &mb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	matched, err := mb.MatchedTxns()
+	blk, _, _ := p.findBlock(hashes[0])
+	coinbase, _ := utils.GetHash(&blk.Txns[0])
+	if err != nil || len(matched) != 1 || matched[0] != coinbase {
+		t.Fatalf("Expect the coinbase to match, %v %v found", matched, err)
+	}
+	next("tx")
+}
+
+func TestBlocksEasierThanTarget(t *testing.T) {
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	p, err := NewPeer(&chain, p2p.GetBitebinet(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer p.ln.Close()
+	c := &PeerConnection{Conn: &fakeConn{}, peer: p, sendq: newSendQueue(MaxSendQueueBytes), known: newInvFilter(10)}
+	// valid for its own bits, which are far easier than the network's
+	header := message.CreateBlock(1, chain.Block[0].HeaderHash, []message.Transaction{tx1}, 0x207fffff, 0)
+	for {
+		hash, _ := utils.GetHash(&header)
+		if utils.HasValidHash(hash, header.NBits) {
+			break
+		}
+		header.Nonce++
+	}
+	tooEasy := func(err error) bool {
+		m, ok := err.(*misbehavior)
+		return ok && m.score == scoreInvalidBlock && strings.HasSuffix(m.reason, "invalid proof of work")
+	}
+	cmpct := message.CmpctBlockMsg{Header: header, Prefilled: []message.PrefilledTx{{Index: 0, Tx: tx1}}}
+	data, _ := utils.GetBytes(&cmpct)
+	if err := c.onCmpctBlock(data); !tooEasy(err) {
+		t.Fatalf("Expect the compact block scored, %v found", err)
+	}
+	hash, _ := utils.GetHash(&header)
+	mb, _ := message.NewMerkleBlock(&message.SerializedBlock{Header: header, HeaderHash: hash, Txns: []message.Transaction{tx1}}, []bool{true})
+	data, _ = utils.GetBytes(&mb)
+	if err := c.onMerkleBlock(data); !tooEasy(err) {
+		t.Fatalf("Expect the merkleblock scored, %v found", err)
+	}
+	if c.sendq.size() != 0 {
+		t.Fatalf("Nothing should be asked for")
+	}
+}
+
+func TestHeaderChain(t *testing.T) {
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	h := NewHeaderChain(chain.Block[0], 0x207fffff)
+	mine := func(prev [32]byte, nBits uint32) (header message.Block, hash [32]byte) {
+		header = message.Block{Previous_block_header_hash: prev, NBits: nBits}
+		for {
+			hash, _ = utils.GetHash(&header)
+			if utils.HasValidHash(hash, nBits) {
+				return
+			}
+			header.Nonce++
+		}
+	}
+	genesis := chain.Block[0].HeaderHash
+	if locator := h.Locator(); len(locator) != 1 || locator[0] != genesis {
+		t.Fatalf("Expect a locator of the genesis block, %v found", locator)
+	}
+	a1, hashA1 := mine(genesis, 0x207fffff)
+	a2, hashA2 := mine(hashA1, 0x207fffff)
+	connected, err := h.AddHeaders([]message.Block{a1, a2})
+	if err != nil || len(connected) != 2 || connected[1] != hashA2 {
+		t.Fatalf("Expect both headers to connect, %v %v found", connected, err)
+	}
+	if locator := h.Locator(); len(locator) != 3 || locator[0] != hashA2 || locator[2] != genesis {
+		t.Fatalf("Expect the locator to go from the tip to the genesis block, %v found", locator)
+	}
+	// one header with more work than two easy ones wins
+	b1, hashB1 := mine(genesis, 0x1f00ffff)
+	connected, err = h.AddHeaders([]message.Block{b1})
+	if err != nil || len(connected) != 1 || connected[0] != hashB1 {
+		t.Fatalf("Expect a reorganization, %v %v found", connected, err)
+	}
+	if tip, height := h.Tip(); tip != hashB1 || height != 1 {
+		t.Fatalf("Unexpected tip %v at %v", utils.HashToString(tip), height)
+	}
+	if _, ok := h.Height(hashA2); ok {
+		t.Fatalf("The old branch should have left the best chain")
+	}
+	h.Confirm([32]byte{1}, hashA1)
+	if h.Confirmations([32]byte{1}) != 0 {
+		t.Fatalf("Transactions of the old branch should lose their confirmations")
+	}
+	orphan := message.Block{Previous_block_header_hash: [32]byte{2}}
+	if _, err = h.AddHeaders([]message.Block{orphan}); err != headerNotConnected {
+		t.Fatalf("Expect headerNotConnected, %v found", err)
+	}
+	bad := message.Block{Previous_block_header_hash: hashB1, NBits: 0x03000001}
+	if _, err = h.AddHeaders([]message.Block{bad}); err != headerBadProofOfWork {
+		t.Fatalf("Expect headerBadProofOfWork, %v found", err)
+	}
+	// valid for its own target, but easier than the network allows
+	hard := NewHeaderChain(chain.Block[0], 0x1f00ffff)
+	if _, err = hard.AddHeaders([]message.Block{a1}); err != headerBadProofOfWork {
+		t.Fatalf("Expect headerBadProofOfWork, %v found", err)
+	}
+}
+
+func TestSPV(t *testing.T) {
+	var chain, spvChain BlockChain
+	var wallet, spvWallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	spvWallet.Init(&spvChain)
+	spvChain.init(&spvWallet)
+	spvWallet.AddPrivKey("self", sk)
+	a, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer a.ln.Close()
+	b, err := NewSPVPeer(&spvChain, p2p.GetRegtest(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer b.ln.Close()
+	// blocks mined before the client connects come with getheaders
+	hashes, err := a.Generate(2, 0, GenerateP2PKHPkScript(sk.PublicKey))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conn, err := b.Dial(a.ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	b.NewConn(conn)
+	deadline := time.Now().Add(10 * time.Second)
+	waitFor := func(what string, cond func() bool) {
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %v", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("the headers", func() bool {
+		tip, _ := b.Headers.Tip()
+		return tip == hashes[1]
+	})
+	// and later ones with announcements
+	more, err := a.Generate(1, 0, pk_script3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	waitFor("the announced header", func() bool {
+		tip, _ := b.Headers.Tip()
+		return tip == more[0]
+	})
+	waitFor("the wallet transactions", func() bool {
+		return spvWallet.GetBalance("self") == 2*CoinBaseReward
+	})
+	blk, _, _ := a.findBlock(hashes[0])
+	coinbase, _ := utils.GetHash(&blk.Txns[0])
+	waitFor("the confirmations", func() bool {
+		return b.Headers.Confirmations(coinbase) == 3
+	})
+	spvChain.Mtx.Lock()
+	defer spvChain.Mtx.Unlock()
+	if len(spvChain.Block) != 1 {
+		t.Fatalf("The client should not keep blocks, %v found", len(spvChain.Block))
+	}
+	if _, ok := spvChain.TX[coinbase]; !ok {
+		t.Fatalf("The wallet transaction should be known")
+	}
+}
+
+func TestNotFoundAndReject(t *testing.T) {
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	p, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer p.ln.Close()
+	newConn := func() *PeerConnection {
+		c := &PeerConnection{Conn: &fakeConn{}, peer: p, sendq: newSendQueue(MaxSendQueueBytes), known: newInvFilter(10)}
+		p.lock.Lock()
+		p.conns[c] = void_null
+		p.lock.Unlock()
+		return c
+	}
+	c1, c2 := newConn(), newConn()
+	next := func(c *PeerConnection, command string) []byte {
+		m, ok := c.sendq.pop()
+		if !ok || m.command != command {
+			t.Fatalf("Expect %v, %v sent", command, m.command)
+		}
+		return m.data[24:]
+	}
+
+	txid, _ := utils.GetHash(&tx1)
+	inv := message.InvMsg{Inv: []message.Inventory{{Type: message.MSG_TX, Hash: txid}}}
+	data, _ := utils.GetBytes(&inv)
+	c1.dispatchMessage("getdata", data)
+	var notfound message.InvMsg
+	if err := decodePayload("notfound", next(c1, "notfound"), &notfound); err != nil || len(notfound.Inv) != 1 || notfound.Inv[0].Hash != txid {
+		t.Fatalf("Expect the transaction in notfound, %+v %v found", notfound, err)
+	}
+
+	// spends an output the parent does not have
+	parent := message.Transaction{Tx_out: []message.TxOut{{Value: 0, Pk_script: pk_script3}}}
+	parentid, _ := utils.GetHash(&parent)
+	chain.Mtx.Lock()
+	chain.addTransaction(parent)
+	chain.Mtx.Unlock()
+	bad := message.Transaction{Tx_in: []message.TxIn{{Previous_output: message.Outpoint{Hash: parentid, Index: 1}, Signature_script: signature_script3}}}
+	badid, _ := utils.GetHash(&bad)
+	data, _ = utils.GetBytes(&bad)
+	c1.dispatchMessage("tx", data)
+	var reject message.RejectMsg
+	if err := decodePayload("reject", next(c1, "reject"), &reject); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if reject.Message != "tx" || reject.Data != badid || reject.Reason != txMissingInputs.Error() {
+		t.Fatalf("Unexpected reject %+v", reject)
+	}
+	if _, ok := chain.Mempool[badid]; ok {
+		t.Fatalf("Rejected transactions should stay out of the mempool")
+	}
+
+	// both announce it, only c1 is asked
+	data, _ = utils.GetBytes(&inv)
+	c1.dispatchMessage("inv", data)
+	c2.dispatchMessage("inv", data)
+	var getdata message.InvMsg
+	if err := decodePayload("getdata", next(c1, "getdata"), &getdata); err != nil || getdata.Inv[0].Hash != txid {
+		t.Fatalf("Expect c1 to be asked, %+v %v found", getdata, err)
+	}
+	if c2.sendq.size() != 0 {
+		t.Fatalf("The transaction is already asked from c1")
+	}
+	// c2 is asked when c1 does not have it
+	c1.dispatchMessage("notfound", data)
+	if err := decodePayload("getdata", next(c2, "getdata"), &getdata); err != nil || getdata.Inv[0].Hash != txid {
+		t.Fatalf("Expect c2 to be asked, %+v %v found", getdata, err)
+	}
+	// but c1 is not asked again
+	c2.dispatchMessage("notfound", data)
+	if c1.sendq.size() != 0 {
+		t.Fatalf("c1 said it does not have the transaction")
+	}
+}
+
+func TestRequestTracker(t *testing.T) {
+	tracker := newRequestTracker()
+	c1, c2 := &PeerConnection{}, &PeerConnection{}
+	now := time.Now()
+	inv := make([]message.Inventory, maxBlocksInFlight+2)
+	for i := range inv {
+		inv[i] = message.Inventory{Type: message.MSG_BLOCK, Hash: [32]byte{byte(i)}}
+	}
+	if send := tracker.announce(c1, inv, now); len(send) != maxBlocksInFlight || send[0] != inv[0] {
+		t.Fatalf("Expect the first %v blocks asked, %v found", maxBlocksInFlight, len(send))
+	}
+	if send := tracker.announce(c2, inv, now); len(send) != 2 || send[0] != inv[maxBlocksInFlight] {
+		t.Fatalf("Expect the rest asked from c2, %v found", send)
+	}
+	tracker.received(inv[0].Hash)
+	if send := tracker.refill(c1, now); len(send) != 0 {
+		t.Fatalf("Nothing is waiting, %v asked", send)
+	}
+
+	// c2 is slow, its blocks go back to c1
+	stalled, resend := tracker.expire(now.Add(BlockRequestTimeout/2), BlockRequestTimeout, TxRequestTimeout)
+	if len(stalled) != 0 || len(resend) != 0 {
+		t.Fatalf("Nothing should have timed out")
+	}
+	tracker.received(inv[1].Hash)
+	tracker.received(inv[2].Hash)
+	stalled, resend = tracker.expire(now.Add(BlockRequestTimeout), BlockRequestTimeout, TxRequestTimeout)
+	if len(stalled) != 2 {
+		t.Fatalf("Both peers held up blocks, %v stalled", len(stalled))
+	}
+	// c1 timed out too, so its blocks only go to c2 and c2's to c1
+	if len(resend[c1]) != 2 || len(resend[c2]) != maxBlocksInFlight-3 {
+		t.Fatalf("Unexpected requests %v to c1 and %v to c2", len(resend[c1]), len(resend[c2]))
+	}
+
+	// nobody else announced them
+	if resend := tracker.drop(c1, now); len(resend) != 0 {
+		t.Fatalf("Expect nothing to ask, %v found", resend)
+	}
+	if resend := tracker.drop(c2, now); len(resend) != 0 || len(tracker.items) != 0 || len(tracker.queued) != 0 || len(tracker.blocks) != 0 {
+		t.Fatalf("Expect the tracker empty, %v items left", len(tracker.items))
+	}
+
+	// announcements past the limit are ignored
+	txs := make([]message.Inventory, maxQueuedPerPeer+10)
+	for i := range txs {
+		txs[i] = message.Inventory{Type: message.MSG_TX, Hash: [32]byte{byte(i), byte(i >> 8)}}
+	}
+	if send := tracker.announce(c1, txs, now); len(send) != maxTxsInFlight || len(tracker.items) != maxQueuedPerPeer {
+		t.Fatalf("Expect %v announcements kept, %v found", maxQueuedPerPeer, len(tracker.items))
+	}
+	if send := tracker.announce(c2, txs[maxQueuedPerPeer:], now); len(send) != 10 {
+		t.Fatalf("Expect other peers to still announce, %v asked", len(send))
+	}
+	// room is made as items arrive
+	tracker.received(txs[0].Hash)
+	if send := tracker.refill(c1, now); len(send) != 1 || send[0] != txs[maxTxsInFlight] {
+		t.Fatalf("Expect the next queued item asked, %v found", send)
+	}
+	if send := tracker.announce(c1, txs[maxQueuedPerPeer:], now); len(send) != 0 || len(tracker.queued[c1]) != maxQueuedPerPeer {
+		t.Fatalf("Expect one more announcement kept, %v queued", len(tracker.queued[c1]))
+	}
+	if _, ok := tracker.items[txs[maxQueuedPerPeer].Hash].announcers[c1]; !ok {
+		t.Fatalf("Expect the announcement kept in place of the received item")
+	}
+}
+
+func TestOrphanTxs(t *testing.T) {
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	p, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer p.ln.Close()
+	c := &PeerConnection{Conn: &fakeConn{}, peer: p, sendq: newSendQueue(MaxSendQueueBytes), known: newInvFilter(10), txQueue: make(map[[32]byte]void)}
+	p.lock.Lock()
+	p.conns[c] = void_null
+	p.lock.Unlock()
+
+	parent := message.Transaction{Tx_out: []message.TxOut{{Value: 0, Pk_script: pk_script3}}}
+	parentid, _ := utils.GetHash(&parent)
+	child := message.Transaction{
+		Tx_in:  []message.TxIn{{Previous_output: message.Outpoint{Hash: parentid}, Signature_script: signature_script3}},
+		Tx_out: []message.TxOut{{Value: 0, Pk_script: pk_script3}},
+	}
+	childid, _ := utils.GetHash(&child)
+	data, _ := utils.GetBytes(&child)
+	c.dispatchMessage("tx", data)
+	m, ok := c.sendq.pop()
+	if !ok || m.command != "getdata" {
+		t.Fatalf("Expect the parent asked for, %v sent", m.command)
+	}
+	var getdata message.InvMsg
+	if err := decodePayload("getdata", m.data[24:], &getdata); err != nil || len(getdata.Inv) != 1 || getdata.Inv[0].Hash != parentid {
+		t.Fatalf("Expect the parent in getdata, %+v %v found", getdata, err)
+	}
+	if p.orphanTxs.Count() != 1 {
+		t.Fatalf("Expect the child kept as an orphan")
+	}
+	// it is not asked for again while it waits
+	inv := message.InvMsg{Inv: []message.Inventory{{Type: message.MSG_TX, Hash: childid}}}
+	data, _ = utils.GetBytes(&inv)
+	c.dispatchMessage("inv", data)
+	if c.sendq.size() != 0 {
+		t.Fatalf("The orphan should not be asked for")
+	}
+
+	data, _ = utils.GetBytes(&parent)
+	c.dispatchMessage("tx", data)
+	chain.Mtx.Lock()
+	_, ok = chain.Mempool[childid]
+	chain.Mtx.Unlock()
+	if !ok || p.orphanTxs.Count() != 0 {
+		t.Fatalf("Expect the child accepted with its parent")
+	}
+
+	// per peer and expiry limits
+	chain.Mtx.Lock()
+	defer chain.Mtx.Unlock()
+	now := time.Now()
+	for i := 0; i <= maxOrphanTxsPerPeer; i++ {
+		tx := message.Transaction{Version: int32(i), Tx_in: []message.TxIn{{Previous_output: message.Outpoint{Hash: [32]byte{1}}}}}
+		hash, _ := utils.GetHash(&tx)
+		if kept := p.orphanTxs.add(tx, hash, c, now); kept != (i < maxOrphanTxsPerPeer) {
+			t.Fatalf("Orphan %v kept: %v", i, kept)
+		}
+	}
+	p.orphanTxs.limit(MaxOrphanTxs, now.Add(OrphanTxExpiry+time.Second))
+	if len(p.orphanTxs.txs) != 0 || len(p.orphanTxs.byPrev) != 0 || len(p.orphanTxs.byPeer) != 0 {
+		t.Fatalf("Expect the orphans expired, %v left", len(p.orphanTxs.txs))
+	}
+}
+
+func TestOrphanTxExpiry(t *testing.T) {
+	expiry, interval := OrphanTxExpiry, RequestCheckInterval
+	OrphanTxExpiry, RequestCheckInterval = 50*time.Millisecond, 20*time.Millisecond
+	defer func() { OrphanTxExpiry, RequestCheckInterval = expiry, interval }()
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	p, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer p.ln.Close()
+	tx := message.Transaction{Tx_in: []message.TxIn{{Previous_output: message.Outpoint{Hash: [32]byte{1}}}}}
+	hash, _ := utils.GetHash(&tx)
+	chain.Mtx.Lock()
+	p.orphanTxs.add(tx, hash, &PeerConnection{}, time.Now())
+	chain.Mtx.Unlock()
+	// no other orphan arrives to trigger the expiry
+	deadline := time.Now().Add(10 * time.Second)
+	for p.orphanTxs.Count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expect the orphan expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// A ping is sent this often, and a peer that has not answered
+// the last one after PingTimeout is disconnected, read by NewPeer
+var (
+	PingInterval = 2 * time.Minute
+	PingTimeout  = 5 * time.Minute
+)
+
+func (c *PeerConnection) sendPing() (err error) {
+	msg := message.PingMsg{Nonce: rand.Uint64() | 1}
+	data, err := utils.GetBytes(&msg)
+	if err != nil {
+		return
+	}
+	c.mtx.Lock()
+	c.pingNonce = msg.Nonce
+	c.pingSent = time.Now()
+	c.mtx.Unlock()
+	return c.sendMessage("ping", data)
+}
+
+// Keep pinging until the connection is closed
+func (c *PeerConnection) pingLoop() {
+	ticker := time.NewTicker(c.peer.pingInterval)
+	defer ticker.Stop()
+	for {
+		c.mtx.Lock()
+		waiting := c.pingNonce != 0
+		since := time.Since(c.pingSent)
+		c.mtx.Unlock()
+		if waiting && since > c.peer.pingTimeout {
+			netLog.Info("Ping timeout, disconnecting", "addr", c.Conn.RemoteAddr(), "wait", since)
+			// unblocks the read in Serve
+			c.Conn.Close()
+			return
+		}
+		if !waiting {
+			err := c.sendPing()
+			if err != nil {
+				netLog.Debug("Sending ping failed", "addr", c.Conn.RemoteAddr(), "err", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *PeerConnection) onPing(data []byte) (err error) {
+	var msg message.PingMsg
+	err = decodePayload("ping", data, &msg)
+	if err != nil {
+		return
+	}
+	return c.sendMessage("pong", data[:8])
+}
+
+func (c *PeerConnection) onPong(data []byte) (err error) {
+	var msg message.PingMsg
+	err = decodePayload("pong", data, &msg)
+	if err != nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.pingNonce == 0 || msg.Nonce != c.pingNonce {
+		netLog.Debug("Unexpected pong", "addr", c.Conn.RemoteAddr(), "nonce", msg.Nonce)
+		return
+	}
+	c.rtt = time.Since(c.pingSent)
+	c.pingNonce = 0
+	return
+}
+
+// Round-trip time of the last answered ping, and how long
+// the current ping has been waiting for its pong
+func (c *PeerConnection) PingTimes() (rtt time.Duration, wait time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.pingNonce != 0 {
+		wait = time.Since(c.pingSent)
+	}
+	return c.rtt, wait
+}
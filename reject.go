@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Requests that cannot be served are answered with notfound, so the requester
+// can ask another peer, and invalid transactions and blocks with reject.
+
+func rejectCode(reason error) uint8 {
+	if reason == txInputSpent {
+		return message.REJECT_DUPLICATE
+	}
+	return message.REJECT_INVALID
+}
+
+// Tell the peer why the tx or block it sent was not accepted
+func (c *PeerConnection) sendReject(command string, reason error, hash [32]byte) error {
+	msg := message.RejectMsg{Message: command, CCode: rejectCode(reason), Reason: reason.Error(), Data: hash}
+	data, err := utils.GetBytes(&msg)
+	if err != nil {
+		return err
+	}
+	return c.sendMessage("reject", data)
+}
+
+func (c *PeerConnection) onReject(data []byte) (err error) {
+	var msg message.RejectMsg
+	err = decodePayload("reject", data, &msg)
+	if err != nil {
+		return
+	}
+	if msg.Message == "tx" || msg.Message == "block" {
+		netLog.Info("Peer rejected a message", "addr", c.Conn.RemoteAddr(), "command", msg.Message, "code", msg.CCode, "reason", msg.Reason, "hash", utils.HashToString(msg.Data))
+	} else {
+		netLog.Info("Peer rejected a message", "addr", c.Conn.RemoteAddr(), "command", msg.Message, "code", msg.CCode, "reason", msg.Reason)
+	}
+	return
+}
+
+// Ask for the missing items again from other peers that announced them.
+// A peer is not asked again for an item it does not have,
+// so the requests do not go around in circles.
+func (c *PeerConnection) onNotFound(data []byte) (err error) {
+	var msg message.InvMsg
+	err = decodePayload("notfound", data, &msg)
+	if err != nil {
+		return
+	}
+	retry := make(map[*PeerConnection][]message.Inventory)
+	now := time.Now()
+	for _, v := range msg.Inv {
+		next, inv := c.peer.requests.notFound(c, v.Hash, now)
+		if next != nil {
+			retry[next] = append(retry[next], inv)
+		}
+	}
+	resendRequests(retry)
+	// the slots freed may take more of what c announced
+	return c.sendGetData(c.peer.requests.refill(c, now))
+}
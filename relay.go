@@ -0,0 +1,306 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Transactions and blocks are announced with inv (or headers) instead of being
+// pushed, and never to a peer that is known to have them already.
+// Transactions are collected and announced in batches at random times,
+// which saves messages and hides where a transaction came from.
+var (
+	// Average time between transaction announcements to a peer, read by NewPeer
+	InboundTrickleInterval  = 5 * time.Second
+	OutboundTrickleInterval = 2 * time.Second
+)
+
+const (
+	// Hashes remembered per connection
+	knownInvSize = 50000
+	// Transactions announced in one batch, the rest wait for the next one
+	maxTrickleInv = 1000
+	// More new blocks than this are announced by inv of the tip only
+	maxHeadersAnnounce = 8
+)
+
+// Remembers the most recently added hashes
+type invFilter struct {
+	mtx  sync.Mutex
+	set  map[[32]byte]void
+	ring [][32]byte
+	next int
+}
+
+func newInvFilter(size int) *invFilter {
+	return &invFilter{set: make(map[[32]byte]void), ring: make([][32]byte, 0, size)}
+}
+
+func (f *invFilter) add(hash [32]byte) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, ok := f.set[hash]; ok {
+		return
+	}
+	if len(f.ring) < cap(f.ring) {
+		f.ring = append(f.ring, hash)
+	} else {
+		delete(f.set, f.ring[f.next])
+		f.ring[f.next] = hash
+		f.next = (f.next + 1) % len(f.ring)
+	}
+	f.set[hash] = void_null
+}
+
+func (f *invFilter) has(hash [32]byte) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	_, ok := f.set[hash]
+	return ok
+}
+
+// Queue a transaction to be announced to every peer that does not have it
+func (p *Peer) BroadcastTransaction(tx message.Transaction) (err error) {
+	hash, err := utils.GetHash(&tx)
+	if err != nil {
+		netLog.Error("Hashing tx failed", "err", err)
+		return
+	}
+	p.lock.RLock()
+	for c := range p.conns {
+		if c.known.has(hash) {
+			continue
+		}
+		c.mtx.Lock()
+		c.txQueue[hash] = void_null
+		c.mtx.Unlock()
+	}
+	p.lock.RUnlock()
+	return
+}
+
+// Announce a new tip to every peer that does not have it
+func (p *Peer) BroadcastBlock(blk message.SerializedBlock) (err error) {
+	p.announceBlocks([]message.SerializedBlock{blk})
+	return
+}
+
+// Announce blocks that were just connected, in chain order.
+// A single block is pushed as a compact block to peers that asked for that,
+// peers that sent sendheaders get the headers, the others an inv of the last block.
+func (p *Peer) announceBlocks(blks []message.SerializedBlock) {
+	if len(blks) == 0 {
+		return
+	}
+	tip := blks[len(blks)-1].HeaderHash
+	var headers []byte
+	if len(blks) <= maxHeadersAnnounce {
+		msg := message.HeadersMsg{Headers: make([]message.Block, len(blks))}
+		for i := range blks {
+			msg.Headers[i] = blks[i].Header
+		}
+		headers, _ = utils.GetBytes(&msg)
+	}
+	var cmpct []byte
+	if len(blks) == 1 {
+		msg, err := message.NewCmpctBlock(&blks[0], rand.Uint64())
+		if err == nil {
+			cmpct, _ = utils.GetBytes(&msg)
+		}
+	}
+	invmsg := message.InvMsg{Inv: []message.Inventory{{Type: message.MSG_BLOCK, Hash: tip}}}
+	inv, _ := utils.GetBytes(&invmsg)
+	p.lock.RLock()
+	targets := make([]*PeerConnection, 0, len(p.conns))
+	for c := range p.conns {
+		if !c.known.has(tip) {
+			targets = append(targets, c)
+		}
+	}
+	p.lock.RUnlock()
+	for _, c := range targets {
+		for _, blk := range blks {
+			c.known.add(blk.HeaderHash)
+		}
+		c.mtx.Lock()
+		sendHeaders, pushCmpct := c.sendHeaders, c.cmpctAnnounce
+		c.mtx.Unlock()
+		if pushCmpct && cmpct != nil {
+			c.sendMessage("cmpctblock", cmpct)
+		} else if sendHeaders && headers != nil {
+			c.sendMessage("headers", headers)
+		} else {
+			c.sendMessage("inv", inv)
+		}
+		// err is ignored
+	}
+}
+
+// Announce queued transactions at random times until the connection is closed
+func (c *PeerConnection) trickleLoop() {
+	mean := c.peer.outboundTrickle
+	if c.Inbound {
+		mean = c.peer.inboundTrickle
+	}
+	for {
+		// exponential delays, like Bitcoin Core's poisson timer
+		timer := time.NewTimer(time.Duration(rand.ExpFloat64() * float64(mean)))
+		select {
+		case <-timer.C:
+		case <-c.quit:
+			timer.Stop()
+			return
+		}
+		err := c.trickle()
+		if err != nil {
+			netLog.Debug("Announcing transactions failed", "addr", c.Conn.RemoteAddr(), "err", err)
+		}
+	}
+}
+
+func (c *PeerConnection) trickle() error {
+	c.mtx.Lock()
+	if len(c.txQueue) == 0 {
+		c.mtx.Unlock()
+		return nil
+	}
+	hashes := make([][32]byte, 0, len(c.txQueue))
+	for hash := range c.txQueue {
+		if len(hashes) == maxTrickleInv {
+			break
+		}
+		hashes = append(hashes, hash)
+		delete(c.txQueue, hash)
+	}
+	c.mtx.Unlock()
+	inv := make([]message.Inventory, 0, len(hashes))
+	filter := c.bloomFilter()
+	c.peer.Chain.Mtx.Lock()
+	for _, hash := range hashes {
+		// confirmed meanwhile, the block announcement covers it
+		tx, ok := c.peer.Chain.Mempool[hash]
+		if !ok {
+			continue
+		}
+		if c.known.has(hash) {
+			continue
+		}
+		if filter != nil && !filter.MatchTx(&tx, hash) {
+			continue
+		}
+		inv = append(inv, message.Inventory{Type: message.MSG_TX, Hash: hash})
+	}
+	c.peer.Chain.Mtx.Unlock()
+	if len(inv) == 0 {
+		return nil
+	}
+	for _, v := range inv {
+		c.known.add(v.Hash)
+	}
+	msg := message.InvMsg{Inv: inv}
+	data, err := utils.GetBytes(&msg)
+	if err != nil {
+		return err
+	}
+	return c.sendMessage("inv", data)
+}
+
+func (c *PeerConnection) onSendHeaders(data []byte) (err error) {
+	if len(data) > 0 {
+		return &misbehavior{scoreUnexpectedPayload, "unexpected payload in sendheaders"}
+	}
+	c.mtx.Lock()
+	c.sendHeaders = true
+	c.mtx.Unlock()
+	return
+}
+
+// Request the announced blocks we do not have
+func (c *PeerConnection) onHeaders(data []byte) (err error) {
+	var msg message.HeadersMsg
+	err = decodePayload("headers", data, &msg)
+	if err != nil || len(msg.Headers) == 0 {
+		return
+	}
+	hashes := make([][32]byte, len(msg.Headers))
+	for i := range msg.Headers {
+		hashes[i], err = utils.GetHash(&msg.Headers[i])
+		if err != nil {
+			return
+		}
+		if i > 0 && msg.Headers[i].Previous_block_header_hash != hashes[i-1] {
+			return &misbehavior{scoreMalformed, "non-continuous headers"}
+		}
+		c.known.add(hashes[i])
+	}
+	if c.peer.Headers != nil {
+		return c.onSPVHeaders(&msg)
+	}
+	getdata := message.InvMsg{Inv: make([]message.Inventory, 0)}
+	c.peer.Chain.Mtx.Lock()
+	tip := c.peer.Chain.Block[len(c.peer.Chain.Block)-1].HeaderHash
+	_, connects := c.peer.Chain.Height[msg.Headers[0].Previous_block_header_hash]
+	if !connects {
+		if node, ok := c.peer.orphans.nodes[msg.Headers[0].Previous_block_header_hash]; ok {
+			connects = node.blk != nil
+		}
+	}
+	for _, hash := range hashes {
+		if _, ok := c.peer.Chain.Height[hash]; ok {
+			continue
+		}
+		if node, ok := c.peer.orphans.nodes[hash]; ok && node.blk != nil {
+			continue
+		}
+		getdata.Inv = append(getdata.Inv, message.Inventory{Type: message.MSG_BLOCK, Hash: hash})
+	}
+	c.peer.Chain.Mtx.Unlock()
+	if !connects {
+		// we are further behind than the announcement
+		return c.doBlockSync()
+	}
+	if len(getdata.Inv) == 0 {
+		return
+	}
+	// a new tip is likely made of transactions we already have
+	supported, _ := c.cmpctModes()
+	last := len(msg.Headers) - 1
+	if supported && len(getdata.Inv) == 1 && getdata.Inv[0].Hash == hashes[last] && msg.Headers[last].Previous_block_header_hash == tip {
+		getdata.Inv[0].Type = message.MSG_CMPCT_BLOCK
+	}
+	return c.requestItems(getdata.Inv)
+}
+
+// Send the headers after the locator, for lightweight clients
+func (c *PeerConnection) onGetHeaders(data []byte) (err error) {
+	var msg message.GetBlocksMsg
+	err = decodePayload("getheaders", data, &msg)
+	if err != nil {
+		return
+	}
+	var commonHeight int
+	resp := message.HeadersMsg{Headers: make([]message.Block, 0)}
+	c.peer.Chain.Mtx.Lock()
+	for _, hash := range msg.BlockHeaderHashes {
+		if h, ok := c.peer.Chain.Height[hash]; ok {
+			commonHeight = h
+			break
+		}
+	}
+	for i := commonHeight + 1; i < len(c.peer.Chain.Block) && len(resp.Headers) < message.MaxHeadersCount; i++ {
+		resp.Headers = append(resp.Headers, c.peer.Chain.Block[i].Header)
+		if c.peer.Chain.Block[i].HeaderHash == msg.StopHash {
+			break
+		}
+	}
+	c.peer.Chain.Mtx.Unlock()
+	raw, err := utils.GetBytes(&resp)
+	if err != nil {
+		return
+	}
+	return c.sendMessage("headers", raw)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Every item we ask for with getdata is asked from one peer at a time.
+// The other peers that announced it are kept to ask if that one says notfound,
+// disconnects or does not deliver in time. Peers only have a few requests
+// in flight, the rest wait in order for a free slot. Like Bitcoin Core,
+// announcements past a limit per peer are ignored.
+
+// How long a peer has to deliver what we asked for,
+// and how often that is checked, read by NewPeer
+var (
+	BlockRequestTimeout  = 30 * time.Second
+	TxRequestTimeout     = 60 * time.Second
+	RequestCheckInterval = time.Second
+)
+
+// Requests in flight to one peer, like Bitcoin Core
+const (
+	maxBlocksInFlight = 16
+	maxTxsInFlight    = 100
+	// announcements kept from one peer
+	maxQueuedPerPeer = 5000
+)
+
+func isBlockInv(t uint32) bool {
+	return t == message.MSG_BLOCK || t == message.MSG_CMPCT_BLOCK || t == message.MSG_FILTERED_BLOCK
+}
+
+type request struct {
+	inv message.Inventory
+	// the peer asked, nil while waiting for a free slot
+	conn *PeerConnection
+	sent time.Time
+	// peers that announced the item and have not failed to deliver it
+	announcers map[*PeerConnection]void
+}
+
+type requestTracker struct {
+	mtx   sync.Mutex
+	items map[[32]byte]*request
+	// hashes each peer announced, in order. Those of items that are gone
+	// or no longer announced by the peer are pruned when the list is walked
+	queued map[*PeerConnection][][32]byte
+	// requests in flight by peer
+	blocks map[*PeerConnection]int
+	txs    map[*PeerConnection]int
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{
+		items:  make(map[[32]byte]*request),
+		queued: make(map[*PeerConnection][][32]byte),
+		blocks: make(map[*PeerConnection]int),
+		txs:    make(map[*PeerConnection]int),
+	}
+}
+
+func (t *requestTracker) inFlight(blockInv bool) map[*PeerConnection]int {
+	if blockInv {
+		return t.blocks
+	}
+	return t.txs
+}
+
+func (t *requestTracker) hasSlot(c *PeerConnection, blockInv bool) bool {
+	if blockInv {
+		return t.blocks[c] < maxBlocksInFlight
+	}
+	return t.txs[c] < maxTxsInFlight
+}
+
+func (t *requestTracker) assign(r *request, c *PeerConnection, now time.Time) {
+	r.conn = c
+	r.sent = now
+	t.inFlight(isBlockInv(r.inv.Type))[c]++
+}
+
+func (t *requestTracker) unassign(r *request) {
+	if r.conn == nil {
+		return
+	}
+	counts := t.inFlight(isBlockInv(r.inv.Type))
+	counts[r.conn]--
+	if counts[r.conn] <= 0 {
+		delete(counts, r.conn)
+	}
+	r.conn = nil
+}
+
+// Give the item to another announcer with a free slot,
+// or leave it waiting, or forget it if nobody else has it
+func (t *requestTracker) reassign(hash [32]byte, r *request, now time.Time) *PeerConnection {
+	t.unassign(r)
+	for other := range r.announcers {
+		if t.hasSlot(other, isBlockInv(r.inv.Type)) {
+			t.assign(r, other, now)
+			return other
+		}
+	}
+	if len(r.announcers) == 0 {
+		delete(t.items, hash)
+	}
+	return nil
+}
+
+// Record that c has the items, and return the ones to ask c for now
+func (t *requestTracker) announce(c *PeerConnection, inv []message.Inventory, now time.Time) (send []message.Inventory) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	pruned := false
+	for _, v := range inv {
+		r, ok := t.items[v.Hash]
+		if ok {
+			if _, ok := r.announcers[c]; ok {
+				continue
+			}
+		}
+		if len(t.queued[c]) >= maxQueuedPerPeer && !pruned {
+			t.prune(c)
+			pruned = true
+		}
+		if len(t.queued[c]) >= maxQueuedPerPeer {
+			continue
+		}
+		if !ok {
+			r = &request{inv: v, announcers: make(map[*PeerConnection]void)}
+			t.items[v.Hash] = r
+		}
+		r.announcers[c] = void_null
+		t.queued[c] = append(t.queued[c], v.Hash)
+		if r.conn == nil && t.hasSlot(c, isBlockInv(v.Type)) {
+			// the type asked from c, a compact block from one peer is a block from another
+			r.inv = v
+			t.assign(r, c, now)
+			send = append(send, v)
+		}
+	}
+	return
+}
+
+// Whether c still has the item announced
+func (t *requestTracker) queuedFrom(c *PeerConnection, hash [32]byte) (*request, bool) {
+	r, ok := t.items[hash]
+	if !ok {
+		return nil, false
+	}
+	_, ok = r.announcers[c]
+	return r, ok
+}
+
+// Drop the hashes c no longer has announced from its list
+func (t *requestTracker) prune(c *PeerConnection) {
+	queue := t.queued[c][:0]
+	for _, hash := range t.queued[c] {
+		if _, ok := t.queuedFrom(c, hash); ok {
+			queue = append(queue, hash)
+		}
+	}
+	t.setQueued(c, queue)
+}
+
+func (t *requestTracker) setQueued(c *PeerConnection, queue [][32]byte) {
+	if len(queue) == 0 {
+		delete(t.queued, c)
+	} else {
+		t.queued[c] = queue
+	}
+}
+
+// The item arrived, from whichever peer
+func (t *requestTracker) received(hash [32]byte) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	r, ok := t.items[hash]
+	if !ok {
+		return
+	}
+	t.unassign(r)
+	delete(t.items, hash)
+}
+
+// Take queued items c announced while it has free slots
+func (t *requestTracker) refill(c *PeerConnection, now time.Time) (send []message.Inventory) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	queue := t.queued[c][:0]
+	for _, hash := range t.queued[c] {
+		r, ok := t.queuedFrom(c, hash)
+		if !ok {
+			continue
+		}
+		queue = append(queue, hash)
+		if r.conn == nil && t.hasSlot(c, isBlockInv(r.inv.Type)) {
+			t.assign(r, c, now)
+			send = append(send, r.inv)
+		}
+	}
+	t.setQueued(c, queue)
+	return
+}
+
+// c does not have the item, return who to ask instead
+func (t *requestTracker) notFound(c *PeerConnection, hash [32]byte, now time.Time) (next *PeerConnection, v message.Inventory) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	r, ok := t.items[hash]
+	if !ok {
+		return
+	}
+	delete(r.announcers, c)
+	if r.conn != c {
+		return
+	}
+	return t.reassign(hash, r, now), r.inv
+}
+
+// c disconnected, return what to ask the other peers for
+func (t *requestTracker) drop(c *PeerConnection, now time.Time) map[*PeerConnection][]message.Inventory {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	resend := make(map[*PeerConnection][]message.Inventory)
+	delete(t.queued, c)
+	for hash, r := range t.items {
+		delete(r.announcers, c)
+		if r.conn == c {
+			if next := t.reassign(hash, r, now); next != nil {
+				resend[next] = append(resend[next], r.inv)
+			}
+		} else if len(r.announcers) == 0 {
+			t.unassign(r)
+			delete(t.items, hash)
+		}
+	}
+	return resend
+}
+
+// Give the requests older than their timeout to other peers.
+// Peers holding up a block are returned as stalling.
+func (t *requestTracker) expire(now time.Time, blockTimeout, txTimeout time.Duration) (stalled []*PeerConnection, resend map[*PeerConnection][]message.Inventory) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	resend = make(map[*PeerConnection][]message.Inventory)
+	seen := make(map[*PeerConnection]void)
+	for hash, r := range t.items {
+		if r.conn == nil {
+			continue
+		}
+		blockInv := isBlockInv(r.inv.Type)
+		timeout := txTimeout
+		if blockInv {
+			timeout = blockTimeout
+		}
+		if now.Sub(r.sent) < timeout {
+			continue
+		}
+		slow := r.conn
+		if blockInv {
+			metricRequestTimeouts.With("block").Inc()
+			if _, ok := seen[slow]; !ok {
+				seen[slow] = void_null
+				stalled = append(stalled, slow)
+			}
+		} else {
+			metricRequestTimeouts.With("tx").Inc()
+		}
+		delete(r.announcers, slow)
+		if next := t.reassign(hash, r, now); next != nil {
+			resend[next] = append(resend[next], r.inv)
+		}
+	}
+	return
+}
+
+func (c *PeerConnection) sendGetData(inv []message.Inventory) error {
+	if len(inv) == 0 {
+		return nil
+	}
+	msg := message.InvMsg{Inv: inv}
+	data, err := utils.GetBytes(&msg)
+	if err != nil {
+		return err
+	}
+	return c.sendMessage("getdata", data)
+}
+
+// Ask c for the items no other peer is already asked for
+func (c *PeerConnection) requestItems(inv []message.Inventory) error {
+	return c.sendGetData(c.peer.requests.announce(c, inv, time.Now()))
+}
+
+// An item we may have asked for arrived from c,
+// so c has room for more of what it announced
+func (c *PeerConnection) requestDone(hash [32]byte) error {
+	c.peer.requests.received(hash)
+	return c.sendGetData(c.peer.requests.refill(c, time.Now()))
+}
+
+func resendRequests(resend map[*PeerConnection][]message.Inventory) {
+	for other, inv := range resend {
+		netLog.Debug("Asking another peer for requested inventory", "addr", other.Conn.RemoteAddr(), "items", len(inv))
+		other.sendGetData(inv)
+		// err is ignored
+	}
+}
+
+func (p *Peer) requestLoop() {
+	ticker := time.NewTicker(p.requestCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+		stalled, resend := p.requests.expire(time.Now(), p.blockRequestTimeout, p.txRequestTimeout)
+		resendRequests(resend)
+		for _, c := range stalled {
+			netLog.Info("Peer stalled block download, disconnecting", "addr", c.Conn.RemoteAddr())
+			// unblocks the read in Serve, which gives the rest of its requests away
+			c.Conn.Close()
+		}
+		// orphans expire even if no new ones come
+		p.Chain.Mtx.Lock()
+		p.orphanTxs.expire(time.Now())
+		p.Chain.Mtx.Unlock()
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Read-only REST interface for block explorers.
+// All responses are JSON, errors look like {"error": "..."}.
+//
+//	GET /rest/tip
+//	GET /rest/block/<hash>
+//	GET /rest/block-height/<height>
+//	GET /rest/tx/<txid>
+//	GET /rest/outpoint/<txid>/<n>
+//	GET /rest/address/<address>          (needs -addrindex)
+//	GET /rest/address/<address>/unspent  (needs -addrindex)
+//	GET /rest/mempool
+//	GET /rest/mempool/contents
+
+const DefaultRESTPort = 8335
+
+type RESTServer struct {
+	app    *CmdApp
+	ln     net.Listener
+	server *http.Server
+	mux    *http.ServeMux
+}
+
+type restError struct {
+	Error string `json:"error"`
+}
+
+type restTip struct {
+	Height int    `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+type restBlock struct {
+	message.BlockJSON
+	Height        int    `json:"height"`
+	Confirmations int    `json:"confirmations"`
+	NextBlockHash string `json:"nextblockhash,omitempty"`
+}
+
+type restOutpoint struct {
+	Txid         string             `json:"txid"`
+	N            uint32             `json:"n"`
+	Value        int64              `json:"value"`
+	ScriptPubKey message.ScriptJSON `json:"scriptPubKey"`
+	Spent        bool               `json:"spent"`
+	Confirmed    bool               `json:"confirmed"`
+}
+
+type restMempool struct {
+	Size  int      `json:"size"`
+	Bytes int      `json:"bytes"`
+	Txids []string `json:"txids"`
+}
+
+func NewRESTServer(app *CmdApp, addr string) (s *RESTServer, err error) {
+	s = new(RESTServer)
+	s.app = app
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/rest/tip", s.handleTip)
+	s.mux.HandleFunc("/rest/block/", s.handleBlock)
+	s.mux.HandleFunc("/rest/block-height/", s.handleBlockHeight)
+	s.mux.HandleFunc("/rest/tx/", s.handleTx)
+	s.mux.HandleFunc("/rest/outpoint/", s.handleOutpoint)
+	s.mux.HandleFunc("/rest/address/", s.handleAddress)
+	s.mux.HandleFunc("/rest/mempool", s.handleMempool)
+	s.mux.HandleFunc("/rest/mempool/contents", s.handleMempoolContents)
+	s.ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	s.server = &http.Server{Handler: s}
+	rpcLog.Info("REST server listening", "addr", s.ln.Addr())
+	go func() {
+		err := s.server.Serve(s.ln)
+		if err != nil && err != http.ErrServerClosed {
+			rpcLog.Error("REST server stopped", "err", err)
+		}
+	}()
+	return
+}
+
+func (s *RESTServer) Close() error {
+	return s.server.Close()
+}
+
+func (s *RESTServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the explorer front-end is served from elsewhere
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		restReply(w, http.StatusMethodNotAllowed, restError{"REST server handles only GET requests"})
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func restReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func restNotFound(w http.ResponseWriter, what string) {
+	restReply(w, http.StatusNotFound, restError{what + " not found"})
+}
+
+func restBadRequest(w http.ResponseWriter, msg string) {
+	restReply(w, http.StatusBadRequest, restError{msg})
+}
+
+// The part of the path after the prefix, split by '/'
+func restArgs(r *http.Request, prefix string) []string {
+	return strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"), "/")
+}
+
+// Must be called with Mtx held
+func (s *RESTServer) blockAt(height int) restBlock {
+	b := &s.app.blockchain
+	ret := restBlock{
+		BlockJSON:     b.Block[height].JSON(),
+		Height:        height,
+		Confirmations: len(b.Block) - height,
+	}
+	if height+1 < len(b.Block) {
+		ret.NextBlockHash = utils.HashToString(b.Block[height+1].HeaderHash)
+	}
+	return ret
+}
+
+func (s *RESTServer) handleTip(w http.ResponseWriter, r *http.Request) {
+	b := &s.app.blockchain
+	b.Mtx.Lock()
+	height := len(b.Block) - 1
+	tip := restTip{height, utils.HashToString(b.Block[height].HeaderHash)}
+	b.Mtx.Unlock()
+	restReply(w, http.StatusOK, tip)
+}
+
+func (s *RESTServer) handleBlock(w http.ResponseWriter, r *http.Request) {
+	args := restArgs(r, "/rest/block/")
+	hash, err := utils.StringToHash(args[0])
+	if len(args) != 1 || err != nil {
+		restBadRequest(w, "Invalid block hash")
+		return
+	}
+	b := &s.app.blockchain
+	b.Mtx.Lock()
+	height, ok := b.Height[hash]
+	var blk restBlock
+	if ok {
+		blk = s.blockAt(height)
+	}
+	b.Mtx.Unlock()
+	if !ok {
+		restNotFound(w, "Block")
+		return
+	}
+	restReply(w, http.StatusOK, blk)
+}
+
+func (s *RESTServer) handleBlockHeight(w http.ResponseWriter, r *http.Request) {
+	args := restArgs(r, "/rest/block-height/")
+	height, err := strconv.Atoi(args[0])
+	if len(args) != 1 || err != nil {
+		restBadRequest(w, "Invalid block height")
+		return
+	}
+	b := &s.app.blockchain
+	b.Mtx.Lock()
+	ok := height >= 0 && height < len(b.Block)
+	var blk restBlock
+	if ok {
+		blk = s.blockAt(height)
+	}
+	b.Mtx.Unlock()
+	if !ok {
+		restNotFound(w, "Block")
+		return
+	}
+	restReply(w, http.StatusOK, blk)
+}
+
+func (s *RESTServer) handleTx(w http.ResponseWriter, r *http.Request) {
+	args := restArgs(r, "/rest/tx/")
+	txid, err := utils.StringToHash(args[0])
+	if len(args) != 1 || err != nil {
+		restBadRequest(w, "Invalid transaction id")
+		return
+	}
+	b := &s.app.blockchain
+	b.Mtx.Lock()
+	ret, ok := b.getTxInfo(txid)
+	b.Mtx.Unlock()
+	if !ok {
+		restNotFound(w, "Transaction")
+		return
+	}
+	restReply(w, http.StatusOK, ret)
+}
+
+func (s *RESTServer) handleOutpoint(w http.ResponseWriter, r *http.Request) {
+	args := restArgs(r, "/rest/outpoint/")
+	if len(args) != 2 {
+		restBadRequest(w, "Expected /rest/outpoint/<txid>/<n>")
+		return
+	}
+	txid, err := utils.StringToHash(args[0])
+	if err != nil {
+		restBadRequest(w, "Invalid transaction id")
+		return
+	}
+	n, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		restBadRequest(w, "Invalid output index")
+		return
+	}
+	b := &s.app.blockchain
+	b.Mtx.Lock()
+	tx, ok := b.TX[txid]
+	ok = ok && int(n) < len(tx.Tx_out)
+	var ret restOutpoint
+	if ok {
+		_, inMempool := b.Mempool[txid]
+		unspent := b.UTXO[message.NewOutPoint(txid, uint32(n))]
+		ret = restOutpoint{
+			Txid:         args[0],
+			N:            uint32(n),
+			Value:        tx.Tx_out[n].Value,
+			ScriptPubKey: message.DecodeScript(tx.Tx_out[n].Pk_script),
+			Spent:        !unspent,
+			Confirmed:    !inMempool,
+		}
+	}
+	b.Mtx.Unlock()
+	if !ok {
+		restNotFound(w, "Outpoint")
+		return
+	}
+	restReply(w, http.StatusOK, ret)
+}
+
+func (s *RESTServer) handleAddress(w http.ResponseWriter, r *http.Request) {
+	args := restArgs(r, "/rest/address/")
+	unspent := len(args) == 2 && args[1] == "unspent"
+	if len(args) != 1 && !unspent {
+		restBadRequest(w, "Expected /rest/address/<address>[/unspent]")
+		return
+	}
+	b := &s.app.blockchain
+	b.Mtx.Lock()
+	idx := b.GetAddrIndex()
+	var events []AddrEvent
+	if idx != nil && unspent {
+		events = idx.Unspent(args[0])
+	} else if idx != nil {
+		events = idx.History(args[0])
+	}
+	ret := make([]AddrEventJSON, len(events))
+	for i := range events {
+		ret[i] = events[i].JSON()
+	}
+	b.Mtx.Unlock()
+	if idx == nil {
+		restReply(w, http.StatusNotImplemented, restError{"Address index is not enabled"})
+		return
+	}
+	restReply(w, http.StatusOK, ret)
+}
+
+func (s *RESTServer) handleMempool(w http.ResponseWriter, r *http.Request) {
+	b := &s.app.blockchain
+	b.Mtx.Lock()
+	ret := restMempool{Size: len(b.Mempool), Txids: make([]string, 0, len(b.Mempool))}
+	for _, txid := range b.sortedMempool() {
+		tx := b.Mempool[txid]
+		data, _ := utils.GetBytes(&tx)
+		ret.Bytes += len(data)
+		ret.Txids = append(ret.Txids, utils.HashToString(txid))
+	}
+	b.Mtx.Unlock()
+	restReply(w, http.StatusOK, ret)
+}
+
+func (s *RESTServer) handleMempoolContents(w http.ResponseWriter, r *http.Request) {
+	b := &s.app.blockchain
+	b.Mtx.Lock()
+	ret := make([]message.TransactionJSON, 0, len(b.Mempool))
+	for _, txid := range b.sortedMempool() {
+		ret = append(ret, b.Mempool[txid].JSON())
+	}
+	b.Mtx.Unlock()
+	restReply(w, http.StatusOK, ret)
+}
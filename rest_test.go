@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+func doREST(t *testing.T, s *RESTServer, path string, v interface{}) int {
+	resp, err := http.Get("http://" + s.ln.Addr().String() + path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+func TestRESTServer(t *testing.T) {
+	app := newTestApp()
+	s, err := NewRESTServer(app, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer s.Close()
+	genesis := utils.HashToString(app.blockchain.Block[0].HeaderHash)
+
+	var tip restTip
+	if code := doREST(t, s, "/rest/tip", &tip); code != http.StatusOK || tip.Height != 0 || tip.Hash != genesis {
+		t.Fatalf("Unexpected tip: %v %+v", code, tip)
+	}
+	var blk restBlock
+	if code := doREST(t, s, "/rest/block-height/0", &blk); code != http.StatusOK || blk.Hash != genesis || blk.Confirmations != 1 {
+		t.Fatalf("Unexpected block: %v %+v", code, blk)
+	}
+	if code := doREST(t, s, "/rest/block/"+genesis, &blk); code != http.StatusOK || blk.Height != 0 {
+		t.Fatalf("Unexpected block: %v %+v", code, blk)
+	}
+	if code := doREST(t, s, "/rest/block/"+utils.HashToString([32]byte{1}), nil); code != http.StatusNotFound {
+		t.Fatalf("Unexpected status for unknown block: %v", code)
+	}
+	if code := doREST(t, s, "/rest/block-height/abc", nil); code != http.StatusBadRequest {
+		t.Fatalf("Unexpected status for invalid height: %v", code)
+	}
+
+	tx := message.Transaction{Tx_out: []message.TxOut{{Value: 3, Pk_script: []byte("pk*OP CHECKSIG")}}}
+	txid, _ := utils.GetHash(&tx)
+	app.blockchain.Mtx.Lock()
+	app.blockchain.addTransaction(tx)
+	app.blockchain.Mtx.Unlock()
+	var pool restMempool
+	if code := doREST(t, s, "/rest/mempool", &pool); code != http.StatusOK || pool.Size != 1 || pool.Txids[0] != utils.HashToString(txid) {
+		t.Fatalf("Unexpected mempool: %v %+v", code, pool)
+	}
+	var rtx txInfo
+	if code := doREST(t, s, "/rest/tx/"+utils.HashToString(txid), &rtx); code != http.StatusOK || rtx.BlockHash != "" || rtx.Vout[0].Value != 3 {
+		t.Fatalf("Unexpected transaction: %v %+v", code, rtx)
+	}
+	var out restOutpoint
+	if code := doREST(t, s, "/rest/outpoint/"+utils.HashToString(txid)+"/0", &out); code != http.StatusOK || out.Spent || out.Confirmed || out.Value != 3 {
+		t.Fatalf("Unexpected outpoint: %v %+v", code, out)
+	}
+	if code := doREST(t, s, "/rest/outpoint/"+utils.HashToString(txid)+"/1", nil); code != http.StatusNotFound {
+		t.Fatalf("Unexpected status for unknown outpoint: %v", code)
+	}
+}
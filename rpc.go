@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// JSON-RPC 2.0 over HTTP
+// https://www.jsonrpc.org/specification
+
+const DefaultCookieFile = ".cookie"
+const cookieUser = "__cookie__"
+
+// Requests larger than this are refused
+const MaxRPCRequestSize = 1 << 24
+
+// Error codes defined by the specification, and the ones of bitcoind
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcMiscError      = -1
+	rpcNotFound       = -5
+)
+
+type RPCConfig struct {
+	Addr     string
+	User     string
+	Password string
+	// When no user is given, a random password is written here
+	CookieFile string
+}
+
+type RPCServer struct {
+	app      *CmdApp
+	cfg      RPCConfig
+	ln       net.Listener
+	server   *http.Server
+	user     string
+	password string
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+type rpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+type rpcHandler func(c *CmdApp, params []json.RawMessage) (interface{}, error)
+
+var rpcHandlers map[string]rpcHandler
+
+func NewRPCServer(app *CmdApp, cfg RPCConfig) (s *RPCServer, err error) {
+	s = new(RPCServer)
+	s.app = app
+	s.cfg = cfg
+	s.user = cfg.User
+	s.password = cfg.Password
+	if s.user == "" {
+		buf := make([]byte, 32)
+		_, err = rand.Read(buf)
+		if err != nil {
+			return
+		}
+		s.user = cookieUser
+		s.password = hex.EncodeToString(buf)
+		err = os.WriteFile(cfg.CookieFile, []byte(s.user+":"+s.password), 0600)
+		if err != nil {
+			return
+		}
+	}
+	s.ln, err = net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return
+	}
+	s.server = &http.Server{Handler: s}
+	rpcLog.Info("RPC server listening", "addr", s.ln.Addr())
+	go func() {
+		err := s.server.Serve(s.ln)
+		if err != nil && err != http.ErrServerClosed {
+			rpcLog.Error("RPC server stopped", "err", err)
+		}
+	}()
+	return
+}
+
+func (s *RPCServer) Close() error {
+	if s.cfg.User == "" {
+		os.Remove(s.cfg.CookieFile)
+	}
+	return s.server.Close()
+}
+
+func (s *RPCServer) authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(s.user)) == 1
+	passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) == 1
+	return userOk && passwordOk
+}
+
+func (s *RPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ws" {
+		// event notifications share the credentials of RPC
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ServeEvents(s.app.blockchain.Events, w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC server handles only POST requests", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxRPCRequestSize))
+	if err != nil {
+		return
+	}
+	var resp interface{}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if json.Unmarshal(body, &batch) != nil || len(batch) == 0 {
+			resp = rpcErrorResponse(nil, rpcInvalidRequest, "Invalid batch")
+		} else {
+			arr := make([]*rpcResponse, 0)
+			for _, raw := range batch {
+				if r := s.handle(raw); r != nil {
+					arr = append(arr, r)
+				}
+			}
+			if len(arr) > 0 {
+				resp = arr
+			}
+		}
+	} else if r := s.handle(body); r != nil {
+		resp = r
+	}
+	if resp == nil {
+		// only notifications were sent
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func rpcErrorResponse(id json.RawMessage, code int, msg string) *rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: "2.0", ID: id, Error: &RPCError{code, msg}}
+}
+
+// Returns nil for notifications
+func (s *RPCServer) handle(raw []byte) *rpcResponse {
+	var req rpcRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return rpcErrorResponse(nil, rpcParseError, "Parse error")
+		}
+		return rpcErrorResponse(nil, rpcInvalidRequest, "Invalid request")
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcErrorResponse(req.ID, rpcInvalidRequest, "Invalid request")
+	}
+	handler, ok := rpcHandlers[req.Method]
+	var result interface{}
+	if !ok {
+		err = &RPCError{rpcMethodNotFound, "Method not found"}
+	} else {
+		result, err = handler(s.app, req.Params)
+	}
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		rpcErr, ok := err.(*RPCError)
+		if !ok {
+			rpcErr = &RPCError{rpcMiscError, err.Error()}
+		}
+		return rpcErrorResponse(req.ID, rpcErr.Code, rpcErr.Message)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return rpcErrorResponse(req.ID, rpcInternalError, err.Error())
+	}
+	return &rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: data}
+}
+
+var errMissingParam = &RPCError{rpcInvalidParams, "Missing parameter"}
+
+// Decode the i-th positional parameter into v.
+// Optional parameters keep the value of v when absent.
+func rpcParam(params []json.RawMessage, i int, v interface{}, required bool) error {
+	if i >= len(params) || string(params[i]) == "null" {
+		if required {
+			return errMissingParam
+		}
+		return nil
+	}
+	err := json.Unmarshal(params[i], v)
+	if err != nil {
+		return &RPCError{rpcInvalidParams, fmt.Sprintf("Invalid parameter %v: %v", i+1, err)}
+	}
+	return nil
+}
+
+func rpcHashParam(params []json.RawMessage, i int) (hash [32]byte, err error) {
+	var s string
+	err = rpcParam(params, i, &s, true)
+	if err != nil {
+		return
+	}
+	hash, err = utils.StringToHash(s)
+	if err != nil {
+		err = &RPCError{rpcInvalidParams, fmt.Sprintf("Invalid hash %v", s)}
+	}
+	return
+}
+
+var errBlockNotFound = &RPCError{rpcNotFound, "Block not found"}
+var errTxNotFound = &RPCError{rpcNotFound, "Transaction not found"}
+
+type rpcPeerInfo struct {
+	Addr    string `json:"addr"`
+	Inbound bool   `json:"inbound"`
+	// in seconds
+	PingTime float64 `json:"pingtime,omitempty"`
+	PingWait float64 `json:"pingwait,omitempty"`
+	BanScore int     `json:"banscore"`
+}
+
+type rpcBlockInfo struct {
+	Hash              string   `json:"hash"`
+	Height            int      `json:"height"`
+	Confirmations     int      `json:"confirmations"`
+	Version           int32    `json:"version"`
+	PreviousBlockHash string   `json:"previousblockhash"`
+	MerkleRoot        string   `json:"merkleroot"`
+	Time              uint32   `json:"time"`
+	Bits              string   `json:"bits"`
+	Nonce             uint32   `json:"nonce"`
+	Tx                []string `json:"tx"`
+}
+
+func (c *CmdApp) getBlockInfo(hash [32]byte) (info rpcBlockInfo, err error) {
+	c.blockchain.Mtx.Lock()
+	defer c.blockchain.Mtx.Unlock()
+	height, ok := c.blockchain.Height[hash]
+	if !ok {
+		return info, errBlockNotFound
+	}
+	blk := c.blockchain.Block[height]
+	info = rpcBlockInfo{
+		Hash:              utils.HashToString(blk.HeaderHash),
+		Height:            height,
+		Confirmations:     len(c.blockchain.Block) - height,
+		Version:           blk.Header.Version,
+		PreviousBlockHash: utils.HashToString(blk.Header.Previous_block_header_hash),
+		MerkleRoot:        utils.HashToString(blk.Header.Merkle_root_hash),
+		Time:              blk.Header.Time,
+		Bits:              fmt.Sprintf("%08x", blk.Header.NBits),
+		Nonce:             blk.Header.Nonce,
+		Tx:                make([]string, len(blk.Txns)),
+	}
+	for i := range blk.Txns {
+		txid, _ := utils.GetHash(&blk.Txns[i])
+		info.Tx[i] = utils.HashToString(txid)
+	}
+	return
+}
+
+type rpcBlockFilter struct {
+	Filter string `json:"filter"`
+	Header string `json:"header"`
+}
+
+func (c *CmdApp) getBlockFilter(hash [32]byte) (ret rpcBlockFilter, err error) {
+	c.blockchain.Mtx.Lock()
+	defer c.blockchain.Mtx.Unlock()
+	idx := c.blockchain.GetCFilterIndex()
+	if idx == nil {
+		return ret, errNoCFilterIndex
+	}
+	height, ok := c.blockchain.Height[hash]
+	if !ok {
+		return ret, errBlockNotFound
+	}
+	filter, header, _ := idx.Filter(height)
+	return rpcBlockFilter{hex.EncodeToString(filter), utils.HashToString(header)}, nil
+}
+
+func init() {
+	rpcHandlers = map[string]rpcHandler{
+		"getblockcount": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			c.blockchain.Mtx.Lock()
+			defer c.blockchain.Mtx.Unlock()
+			return len(c.blockchain.Block) - 1, nil
+		},
+		"getbestblockhash": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			c.blockchain.Mtx.Lock()
+			defer c.blockchain.Mtx.Unlock()
+			return utils.HashToString(c.blockchain.Block[len(c.blockchain.Block)-1].HeaderHash), nil
+		},
+		"getblockhash": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var height int
+			if err := rpcParam(params, 0, &height, true); err != nil {
+				return nil, err
+			}
+			c.blockchain.Mtx.Lock()
+			defer c.blockchain.Mtx.Unlock()
+			if height < 0 || height >= len(c.blockchain.Block) {
+				return nil, &RPCError{rpcInvalidParams, "Block height out of range"}
+			}
+			return utils.HashToString(c.blockchain.Block[height].HeaderHash), nil
+		},
+		"getblock": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			hash, err := rpcHashParam(params, 0)
+			if err != nil {
+				return nil, err
+			}
+			return c.getBlockInfo(hash)
+		},
+		"getblockfilter": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			hash, err := rpcHashParam(params, 0)
+			if err != nil {
+				return nil, err
+			}
+			return c.getBlockFilter(hash)
+		},
+		"getrawtransaction": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			hash, err := rpcHashParam(params, 0)
+			if err != nil {
+				return nil, err
+			}
+			verbose := false
+			if err := rpcParam(params, 1, &verbose, false); err != nil {
+				return nil, err
+			}
+			c.blockchain.Mtx.Lock()
+			tx, ok := c.blockchain.TX[hash]
+			var info txInfo
+			if ok && verbose {
+				info, _ = c.blockchain.getTxInfo(hash)
+			}
+			c.blockchain.Mtx.Unlock()
+			if !ok {
+				return nil, errTxNotFound
+			}
+			if verbose {
+				return info, nil
+			}
+			data, err := utils.GetBytes(&tx)
+			return hex.EncodeToString(data), err
+		},
+		"getchainstats": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			return c.GetChainStats()
+		},
+		"getpeerinfo": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			peers, err := c.GetPeerInfo()
+			if err != nil {
+				return nil, err
+			}
+			ret := make([]rpcPeerInfo, len(peers))
+			for i, info := range peers {
+				ret[i] = rpcPeerInfo{
+					Addr:     info.Addr.String(),
+					Inbound:  info.Inbound,
+					PingTime: info.RTT.Seconds(),
+					PingWait: info.PingWait.Seconds(),
+					BanScore: info.BanScore,
+				}
+			}
+			return ret, nil
+		},
+		"ban": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var subnet string
+			seconds := 0
+			if err := rpcParam(params, 0, &subnet, true); err != nil {
+				return nil, err
+			}
+			if err := rpcParam(params, 1, &seconds, false); err != nil {
+				return nil, err
+			}
+			return nil, c.Ban(subnet, seconds)
+		},
+		"unban": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var subnet string
+			if err := rpcParam(params, 0, &subnet, true); err != nil {
+				return nil, err
+			}
+			return nil, c.Unban(subnet)
+		},
+		"listbanned": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			bans, err := c.ListBanned()
+			if bans == nil {
+				bans = []BanEntry{}
+			}
+			return bans, err
+		},
+		"addnode": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var addr string
+			if err := rpcParam(params, 0, &addr, true); err != nil {
+				return nil, err
+			}
+			return nil, c.Connect(addr)
+		},
+		"addpk": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var name, pk string
+			if err := rpcParam(params, 0, &name, true); err != nil {
+				return nil, err
+			}
+			if err := rpcParam(params, 1, &pk, true); err != nil {
+				return nil, err
+			}
+			return nil, c.AddPubKey(name, pk)
+		},
+		"addsk": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var name, sk string
+			if err := rpcParam(params, 0, &name, true); err != nil {
+				return nil, err
+			}
+			if err := rpcParam(params, 1, &sk, true); err != nil {
+				return nil, err
+			}
+			return nil, c.AddPrivKey(name, sk)
+		},
+		"transfer": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var from, to string
+			var amount int64
+			if err := rpcParam(params, 0, &from, true); err != nil {
+				return nil, err
+			}
+			if err := rpcParam(params, 1, &to, true); err != nil {
+				return nil, err
+			}
+			if err := rpcParam(params, 2, &amount, true); err != nil {
+				return nil, err
+			}
+			txid, err := c.Transfer(from, to, amount)
+			if err != nil {
+				return nil, err
+			}
+			return utils.HashToString(txid), nil
+		},
+		"getbalance": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			name := "self"
+			if err := rpcParam(params, 0, &name, false); err != nil {
+				return nil, err
+			}
+			return c.Wallet.GetBalance(name), nil
+		},
+		"rescan": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			name := "self"
+			if err := rpcParam(params, 0, &name, false); err != nil {
+				return nil, err
+			}
+			return nil, c.Rescan(name)
+		},
+		"getaddresshistory": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var addr string
+			unspentOnly := false
+			if err := rpcParam(params, 0, &addr, true); err != nil {
+				return nil, err
+			}
+			if err := rpcParam(params, 1, &unspentOnly, false); err != nil {
+				return nil, err
+			}
+			return c.GetAddressHistory(addr, unspentOnly)
+		},
+		"enableindex": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var name string
+			if err := rpcParam(params, 0, &name, true); err != nil {
+				return nil, err
+			}
+			return nil, c.EnableIndex(name)
+		},
+		"reindex": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			c.Reindex()
+			return nil, nil
+		},
+		"setloglevel": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			spec := ""
+			if err := rpcParam(params, 0, &spec, false); err != nil {
+				return nil, err
+			}
+			levels, err := c.SetLogLevel(spec)
+			if err != nil {
+				return nil, &RPCError{rpcInvalidParams, err.Error()}
+			}
+			return levels, nil
+		},
+		"mine": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			threads := 0
+			if err := rpcParam(params, 0, &threads, false); err != nil {
+				return nil, err
+			}
+			return nil, c.StartMining(threads)
+		},
+		"stopmining": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			c.blockchain.PauseMining()
+			return nil, nil
+		},
+		"resumemining": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			return nil, c.blockchain.ResumeMining()
+		},
+		"generate": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var n int
+			account := "self"
+			if err := rpcParam(params, 0, &n, true); err != nil {
+				return nil, err
+			}
+			if err := rpcParam(params, 1, &account, false); err != nil {
+				return nil, err
+			}
+			hashes, err := c.Generate(n, account)
+			if err != nil {
+				return nil, err
+			}
+			ret := make([]string, len(hashes))
+			for i := range hashes {
+				ret[i] = utils.HashToString(hashes[i])
+			}
+			return ret, nil
+		},
+		"setmocktime": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var t int64
+			if err := rpcParam(params, 0, &t, true); err != nil {
+				return nil, err
+			}
+			return nil, c.SetMockTime(t)
+		},
+		"getblocktemplate": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			return c.GetBlockTemplate()
+		},
+		"submitblock": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			var data string
+			if err := rpcParam(params, 0, &data, true); err != nil {
+				return nil, err
+			}
+			return nil, c.SubmitBlock(data)
+		},
+		"getworkerstats": func(c *CmdApp, params []json.RawMessage) (interface{}, error) {
+			return c.GetWorkerStats()
+		},
+	}
+}
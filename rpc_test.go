@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func newTestApp() *CmdApp {
+	app := new(CmdApp)
+	app.Wallet.Init(&app.blockchain)
+	app.blockchain.init(&app.Wallet)
+	return app
+}
+
+func doRPC(t *testing.T, s *RPCServer, user string, body string) (*http.Response, map[string]interface{}) {
+	req, _ := http.NewRequest("POST", "http://"+s.ln.Addr().String(), bytes.NewBufferString(body))
+	req.SetBasicAuth(user, "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	var ret map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&ret)
+	return resp, ret
+}
+
+func TestRPCServer(t *testing.T) {
+	s, err := NewRPCServer(newTestApp(), RPCConfig{Addr: "127.0.0.1:0", User: "user", Password: "secret"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer s.Close()
+	resp, _ := doRPC(t, s, "nobody", `{"jsonrpc":"2.0","id":1,"method":"getblockcount"}`)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expect status 401, %v found", resp.StatusCode)
+	}
+	_, ret := doRPC(t, s, "user", `{"jsonrpc":"2.0","id":1,"method":"getblockcount"}`)
+	if ret["result"] != float64(0) {
+		t.Fatalf("Expect block count 0, %v found", ret)
+	}
+	_, ret = doRPC(t, s, "user", `{"jsonrpc":"2.0","id":2,"method":"nosuchmethod"}`)
+	if ret["error"].(map[string]interface{})["code"] != float64(rpcMethodNotFound) {
+		t.Fatalf("Expect method not found, %v found", ret)
+	}
+	_, ret = doRPC(t, s, "user", `{"jsonrpc":"2.0","id":3,"method":"getblockhash","params":[0]}`)
+	if _, ok := ret["result"].(string); !ok {
+		t.Fatalf("Expect the genesis hash, %v found", ret)
+	}
+	for _, amount := range []string{"0", "-5"} {
+		_, ret = doRPC(t, s, "user", `{"jsonrpc":"2.0","id":4,"method":"transfer","params":["self","self",`+amount+`]}`)
+		if ret["error"].(map[string]interface{})["message"] != errBadAmount.Error() {
+			t.Fatalf("Expect the amount rejected, %v found", ret)
+		}
+	}
+}
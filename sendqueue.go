@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Each connection has one writer goroutine, so messages never interleave on the wire.
+// Control messages skip ahead of queued data.
+var controlCommands = map[string]bool{
+	"version":     true,
+	"verack":      true,
+	"ping":        true,
+	"pong":        true,
+	"reject":      true,
+	"sendheaders": true,
+}
+
+var (
+	// Reading from a peer pauses while more than this is waiting to be sent to it
+	SendPauseBytes = 1 << 20
+	// A peer that lets this much pile up is disconnected
+	MaxSendQueueBytes = 32 << 20
+	// A single write taking longer than this drops the connection
+	WriteTimeout = time.Minute
+)
+
+var errSendQueueFull = errors.New("sendQueueFull")
+var errConnClosed = errors.New("connClosed")
+
+type outMsg struct {
+	command string
+	data    []byte // header and payload
+}
+
+type sendQueue struct {
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	control []outMsg
+	data    []outMsg
+	bytes   int
+	max     int
+	closed  bool
+}
+
+// Pushing beyond max bytes fails
+func newSendQueue(max int) *sendQueue {
+	q := &sendQueue{max: max}
+	q.cond = sync.NewCond(&q.mtx)
+	return q
+}
+
+func (q *sendQueue) push(m outMsg) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.closed {
+		return errConnClosed
+	}
+	if q.bytes+len(m.data) > q.max {
+		return errSendQueueFull
+	}
+	if controlCommands[m.command] {
+		q.control = append(q.control, m)
+	} else {
+		q.data = append(q.data, m)
+	}
+	q.bytes += len(m.data)
+	q.cond.Broadcast()
+	return nil
+}
+
+// Wait for the next message, ok is false once the queue is closed
+func (q *sendQueue) pop() (m outMsg, ok bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for len(q.control) == 0 && len(q.data) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return
+	}
+	if len(q.control) > 0 {
+		m, q.control = q.control[0], q.control[1:]
+	} else {
+		m, q.data = q.data[0], q.data[1:]
+	}
+	q.bytes -= len(m.data)
+	q.cond.Broadcast()
+	return m, true
+}
+
+// Block while more than max bytes are queued
+func (q *sendQueue) waitBelow(max int) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for q.bytes > max && !q.closed {
+		q.cond.Wait()
+	}
+}
+
+func (q *sendQueue) close() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.closed = true
+	q.control, q.data = nil, nil
+	q.cond.Broadcast()
+}
+
+func (q *sendQueue) size() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.bytes
+}
+
+func (c *PeerConnection) writeLoop() {
+	for {
+		m, ok := c.sendq.pop()
+		if !ok {
+			return
+		}
+		c.Conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+		_, err := c.Conn.Write(m.data)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				netLog.Info("Write timeout, disconnecting", "addr", c.Conn.RemoteAddr())
+			} else {
+				netLog.Debug("Writing message failed", "addr", c.Conn.RemoteAddr(), "command", m.command, "err", err)
+			}
+			c.sendq.close()
+			// unblocks the read in Serve
+			c.Conn.Close()
+			return
+		}
+		metricMsgsSent.With(m.command).Inc()
+		metricBytesSent.With(m.command).Add(float64(len(m.data)))
+	}
+}
+
+// Queue a message for the writer goroutine, it never blocks
+func (c *PeerConnection) sendMessage(command string, payload []byte) (err error) {
+	buf := utils.NewBufWriter()
+	buf.WriteBytes(c.peer.Config.StartString[:])
+	t := []byte(command)
+	buf.WriteBytes(t)
+	for i := 0; i < 12-len(t); i++ {
+		buf.WriteUint8(0)
+	}
+	buf.WriteUint32(uint32(len(payload)))
+	chksum := utils.Sha256Twice(payload)
+	buf.WriteBytes(chksum[:4])
+	buf.WriteBytes(payload)
+	err = c.sendq.push(outMsg{command, buf.Collect()})
+	if err == errSendQueueFull {
+		netLog.Info("Peer is too slow to receive, disconnecting", "addr", c.Conn.RemoteAddr(), "command", command)
+		c.sendq.close()
+		c.Conn.Close()
+	}
+	return
+}
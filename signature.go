@@ -5,7 +5,6 @@ import (
 	"crypto/rand"
 	"encoding/asn1"
 	"fmt"
-	"log"
 	"math/big"
 	"strconv"
 	"strings"
@@ -145,11 +144,11 @@ func GenPrivKey() (priv dsa.PrivateKey) {
 	// Generate private and public key
 	var params dsa.Parameters
 	if e := dsa.GenerateParameters(&params, rand.Reader, dsa.L1024N160); e != nil {
-		log.Printf("[ERROR] Generate key parameters error!" + e.Error())
+		walletLog.Error("Generating key parameters failed", "err", e)
 	}
 	priv.Parameters = params
 	if e := dsa.GenerateKey(&priv, rand.Reader); e != nil {
-		log.Printf("[ERROR] Generate keys error!" + e.Error())
+		walletLog.Error("Generating keys failed", "err", e)
 	}
 	return
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"math/rand"
+	"sync"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Lightweight (SPV) mode. Only block headers are downloaded and checked
+// for proof of work, and the chain with the most work is followed.
+// Peers are given a bloom filter of the wallet keys, and wallet transactions
+// are taken from filtered blocks, whose merkle proofs tie them to the headers.
+// Transactions of blocks that are reorganized away stay in the wallet,
+// they just lose their confirmations.
+
+// False positive rate of the wallet filter
+const walletFilterFP = 0.0001
+
+var (
+	headerNotConnected   = errors.New("headerNotConnected")
+	headerBadProofOfWork = errors.New("headerBadProofOfWork")
+)
+
+type headerNode struct {
+	header message.Block
+	hash   [32]byte
+	height int
+	// total work of the chain ending here
+	work   *big.Int
+	parent *headerNode
+}
+
+// Headers of all known blocks, and the chain with the most work among them
+type HeaderChain struct {
+	mtx   sync.Mutex
+	nodes map[[32]byte]*headerNode
+	// the best chain by height
+	best []*headerNode
+	// the block each wallet transaction was proven in
+	txBlock map[[32]byte][32]byte
+	// the easiest target of the network, easier headers are cheap to make up
+	maxNBits uint32
+}
+
+func NewHeaderChain(genesis message.SerializedBlock, maxNBits uint32) *HeaderChain {
+	node := &headerNode{header: genesis.Header, hash: genesis.HeaderHash, work: utils.Work(genesis.Header.NBits)}
+	return &HeaderChain{
+		nodes:    map[[32]byte]*headerNode{node.hash: node},
+		best:     []*headerNode{node},
+		txBlock:  make(map[[32]byte][32]byte),
+		maxNBits: maxNBits,
+	}
+}
+
+// Add continuous headers, and return the hashes that joined the best chain in order.
+// Those added before an error are kept.
+func (h *HeaderChain) AddHeaders(headers []message.Block) (connected [][32]byte, err error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	tip := h.best[len(h.best)-1]
+	for i := range headers {
+		var hash [32]byte
+		hash, err = utils.GetHash(&headers[i])
+		if err != nil {
+			break
+		}
+		if _, ok := h.nodes[hash]; ok {
+			continue
+		}
+		parent, ok := h.nodes[headers[i].Previous_block_header_hash]
+		if !ok {
+			err = headerNotConnected
+			break
+		}
+		if utils.EasierThan(headers[i].NBits, h.maxNBits) || !utils.HasValidHash(hash, headers[i].NBits) {
+			err = headerBadProofOfWork
+			break
+		}
+		node := &headerNode{header: headers[i], hash: hash, height: parent.height + 1, parent: parent}
+		node.work = new(big.Int).Add(parent.work, utils.Work(headers[i].NBits))
+		h.nodes[hash] = node
+		if node.work.Cmp(tip.work) > 0 {
+			tip = node
+		}
+	}
+	if tip == h.best[len(h.best)-1] {
+		return
+	}
+	// go back to where the new tip forks off the best chain
+	var branch []*headerNode
+	for node := tip; node.height >= len(h.best) || h.best[node.height] != node; node = node.parent {
+		branch = append(branch, node)
+	}
+	fork := tip.height - len(branch)
+	if fork+1 < len(h.best) {
+		metricReorgs.Inc()
+		chainLog.Info("Header chain reorganized", "height", fork+1)
+	}
+	h.best = h.best[:fork+1]
+	for i := len(branch) - 1; i >= 0; i-- {
+		h.best = append(h.best, branch[i])
+		connected = append(connected, branch[i].hash)
+	}
+	chainLog.Info("New header tip", "height", tip.height, "hash", utils.HashToString(tip.hash))
+	return
+}
+
+func (h *HeaderChain) Tip() (hash [32]byte, height int) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	tip := h.best[len(h.best)-1]
+	return tip.hash, tip.height
+}
+
+// Height of a header, ok is false unless it is in the best chain
+func (h *HeaderChain) Height(hash [32]byte) (height int, ok bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.height(hash)
+}
+
+// h.mtx should be held
+func (h *HeaderChain) height(hash [32]byte) (int, bool) {
+	node, ok := h.nodes[hash]
+	if !ok || node.height >= len(h.best) || h.best[node.height] != node {
+		return 0, false
+	}
+	return node.height, true
+}
+
+func (h *HeaderChain) Has(hash [32]byte) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	_, ok := h.nodes[hash]
+	return ok
+}
+
+// Hashes of the best chain from the tip backwards, more sparse further down,
+// always ending at the genesis block as peers expect
+func (h *HeaderChain) Locator() [][32]byte {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	arr := make([][32]byte, 0)
+	for i, j := len(h.best)-1, 1; i > 0; i, j = i-j, j*2 {
+		arr = append(arr, h.best[i].hash)
+	}
+	return append(arr, h.best[0].hash)
+}
+
+// Remember that a merkle proof put txid in a block
+func (h *HeaderChain) Confirm(txid [32]byte, block [32]byte) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.txBlock[txid] = block
+}
+
+// Blocks on top of the transaction including its own, 0 if it is not in the best chain
+func (h *HeaderChain) Confirmations(txid [32]byte) int {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	block, ok := h.txBlock[txid]
+	if !ok {
+		return 0
+	}
+	height, ok := h.height(block)
+	if !ok {
+		return 0
+	}
+	return len(h.best) - height
+}
+
+// Record a transaction a lightweight client learned of.
+// Confirmed ones leave the mempool and spend their inputs.
+// b.Mtx should be held
+func (b *BlockChain) addSPVTransaction(tx message.Transaction, confirmed bool) {
+	txID, _ := utils.GetHash(&tx)
+	b.acceptTransaction(tx)
+	if !confirmed {
+		return
+	}
+	if _, ok := b.Mempool[txID]; !ok {
+		return
+	}
+	for _, in := range tx.Tx_in {
+		if _, ok := b.UTXO[in.Previous_output]; ok {
+			b.UTXO[in.Previous_output] = false
+		}
+	}
+	delete(b.Mempool, txID)
+	b.Events.Publish(TopicTxRemoved, TxEvent{utils.HashToString(txID), "confirmed"})
+}
+
+// A filter matching the outputs of our keys, and so the spends of them
+func (p *Peer) walletFilter() *BloomFilter {
+	keys := p.Chain.Wallet.OwnedPubkeys()
+	f := NewBloomFilterFor(len(keys), walletFilterFP, rand.Uint32(), message.BloomUpdateAll)
+	for _, k := range keys {
+		f.Add(k)
+	}
+	return f
+}
+
+func (c *PeerConnection) sendFilterLoad(f *BloomFilter) error {
+	msg := f.LoadMsg()
+	data, err := utils.GetBytes(&msg)
+	if err != nil {
+		return err
+	}
+	return c.sendMessage("filterload", data)
+}
+
+// Give every peer a new wallet filter, after keys were added
+func (p *Peer) ReloadFilter() {
+	if p.Headers == nil {
+		return
+	}
+	f := p.walletFilter()
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for c := range p.conns {
+		c.sendFilterLoad(f)
+		// err is ignored
+	}
+}
+
+func (c *PeerConnection) sendGetHeaders() error {
+	msg := message.GetBlocksMsg{BlockHeaderHashes: c.peer.Headers.Locator()}
+	data, err := utils.GetBytes(&msg)
+	if err != nil {
+		return err
+	}
+	return c.sendMessage("getheaders", data)
+}
+
+// Follow the headers, and ask for the new blocks of the best chain filtered
+func (c *PeerConnection) onSPVHeaders(msg *message.HeadersMsg) error {
+	connected, err := c.peer.Headers.AddHeaders(msg.Headers)
+	if len(connected) > 0 {
+		getdata := message.InvMsg{Inv: make([]message.Inventory, len(connected))}
+		for i, hash := range connected {
+			getdata.Inv[i] = message.Inventory{Type: message.MSG_FILTERED_BLOCK, Hash: hash}
+		}
+		err := c.requestItems(getdata.Inv)
+		if err != nil {
+			return err
+		}
+	}
+	if err == headerBadProofOfWork {
+		return &misbehavior{scoreInvalidBlock, "header with invalid proof of work"}
+	}
+	if err == headerNotConnected || len(msg.Headers) == message.MaxHeadersCount {
+		// behind the announcement, or there are more headers to come
+		return c.sendGetHeaders()
+	}
+	return err
+}
+
+// Note the wallet transactions a checked merkleblock proves.
+// Those we do not have yet are sent by the peer right after it.
+func (c *PeerConnection) onSPVMerkleBlock(header *message.Block, hash [32]byte, matched [][32]byte) error {
+	headers := c.peer.Headers
+	if !headers.Has(hash) {
+		_, err := headers.AddHeaders([]message.Block{*header})
+		if err == headerNotConnected {
+			return c.sendGetHeaders()
+		} else if err == headerBadProofOfWork {
+			return &misbehavior{scoreInvalidBlock, "merkleblock with invalid proof of work"}
+		} else if err != nil {
+			return err
+		}
+	}
+	c.merkleTxns = make(map[[32]byte][32]byte)
+	for _, txid := range matched {
+		c.peer.Chain.Mtx.Lock()
+		tx, ok := c.peer.Chain.TX[txid]
+		if ok {
+			c.peer.Chain.addSPVTransaction(tx, true)
+		}
+		c.peer.Chain.Mtx.Unlock()
+		if ok {
+			headers.Confirm(txid, hash)
+		} else {
+			c.merkleTxns[txid] = hash
+		}
+	}
+	return nil
+}
+
+// Keep a transaction the filter matched, without relaying it
+func (c *PeerConnection) onSPVTx(tx message.Transaction, hash [32]byte) error {
+	block, confirmed := c.merkleTxns[hash]
+	delete(c.merkleTxns, hash)
+	c.peer.Chain.Mtx.Lock()
+	c.peer.Chain.addSPVTransaction(tx, confirmed)
+	c.peer.Chain.Mtx.Unlock()
+	if confirmed {
+		c.peer.Headers.Confirm(hash, block)
+		walletLog.Debug("Transaction confirmed", "txid", utils.HashToString(hash), "block", utils.HashToString(block))
+	}
+	return nil
+}
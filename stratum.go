@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sshockwave/bitebi/message"
+	"github.com/sshockwave/bitebi/utils"
+)
+
+// Stratum v1 mining server
+// https://en.bitcoin.it/wiki/Stratum_mining_protocol
+//
+// Byte order of the fields in mining.notify:
+// prevhash and the merkle branches are the raw bytes as they appear in the header,
+// version, nbits and ntime are big endian hex of the integers,
+// the submitted nonce is big endian hex as well.
+
+// The extranonce in the coinbase is split into a part assigned by us
+// and a part rolled by the miner
+const StratumExtraNonce1Size = 4
+const StratumExtraNonce2Size = ExtraNonceSize - StratumExtraNonce1Size
+
+// Where the extranonce starts in a serialized coinbase built by makeCoinbase:
+// version, txin count, outpoint, script length and the height
+const coinbaseExtraNonceOffset = 4 + 1 + 36 + 1 + 4
+
+// How often to check whether the block template is outdated
+var StratumPollInterval = 500 * time.Millisecond
+
+// Shares are at most this much easier than a block by default
+const DefaultShareNBits = 0x1f00ffff
+
+// Error codes used by most pools
+const (
+	stratumErrOther        = 20
+	stratumErrJobNotFound  = 21
+	stratumErrDuplicate    = 22
+	stratumErrLowDiff      = 23
+	stratumErrUnauthorized = 24
+)
+
+type WorkerStats struct {
+	Accepted  uint64
+	Rejected  uint64
+	Blocks    uint64
+	LastShare time.Time
+}
+
+type stratumJob struct {
+	id          string
+	tmpl        BlockTemplate
+	coinb1      []byte
+	coinb2      []byte
+	branch      [][32]byte
+	submissions map[string]void
+}
+
+type StratumServer struct {
+	peer       *Peer
+	Pk_script  []byte
+	ShareNBits uint32
+	ln         net.Listener
+	lock       sync.Mutex
+	jobSeq     uint64
+	curJob     *stratumJob
+	jobs       map[string]*stratumJob
+	sessions   map[*stratumSession]void
+	workers    map[string]*WorkerStats
+	extraNonce uint32
+	done       chan void
+}
+
+type stratumSession struct {
+	server      *StratumServer
+	conn        net.Conn
+	writeLock   sync.Mutex
+	subscribed  bool
+	extraNonce1 []byte
+	authorized  map[string]void
+}
+
+type stratumRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type stratumResponse struct {
+	ID     json.RawMessage `json:"id"`
+	Result interface{}     `json:"result"`
+	Error  interface{}     `json:"error"`
+}
+
+type stratumNotification struct {
+	ID     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+func NewStratumServer(peer *Peer, Pk_script []byte, addr string, shareNBits uint32) (s *StratumServer, err error) {
+	s = new(StratumServer)
+	s.peer = peer
+	s.Pk_script = Pk_script
+	// shares should never be harder than blocks
+	if utils.NBitsToTarget(shareNBits).Cmp(utils.NBitsToTarget(peer.Config.MaxNBits)) < 0 {
+		shareNBits = peer.Config.MaxNBits
+	}
+	s.ShareNBits = shareNBits
+	s.jobs = make(map[string]*stratumJob)
+	s.sessions = make(map[*stratumSession]void)
+	s.workers = make(map[string]*WorkerStats)
+	s.done = make(chan void)
+	// sessions and pollLoop need a job from the start
+	err = s.newJob()
+	if err != nil {
+		return nil, err
+	}
+	s.ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	minerLog.Info("Stratum server listening", "addr", s.ln.Addr())
+	go s.acceptLoop()
+	go s.pollLoop()
+	return
+}
+
+func (s *StratumServer) acceptLoop() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				minerLog.Error("Accepting stratum connections failed", "err", err)
+			}
+			break
+		}
+		sess := &stratumSession{server: s, conn: conn, authorized: make(map[string]void)}
+		s.lock.Lock()
+		s.extraNonce++
+		sess.extraNonce1 = make([]byte, StratumExtraNonce1Size)
+		binary.BigEndian.PutUint32(sess.extraNonce1, s.extraNonce)
+		s.sessions[sess] = void_null
+		s.lock.Unlock()
+		minerLog.Info("New stratum connection", "addr", conn.RemoteAddr())
+		go sess.serve()
+	}
+}
+
+// Hand out a new job whenever the chain or the mempool changes
+func (s *StratumServer) pollLoop() {
+	ticker := time.NewTicker(StratumPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.peer.Chain.Mtx.Lock()
+		version := s.peer.Chain.MineVersion
+		s.peer.Chain.Mtx.Unlock()
+		s.lock.Lock()
+		if s.curJob.tmpl.mineVersion < version {
+			err := s.newJob()
+			if err != nil {
+				minerLog.Error("Making a new stratum job failed", "err", err)
+			} else {
+				s.broadcastJob()
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Stop accepting miners and drop the connected ones
+func (s *StratumServer) Close() error {
+	close(s.done)
+	err := s.ln.Close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for sess := range s.sessions {
+		sess.conn.Close()
+	}
+	return err
+}
+
+// The caller must hold s.lock
+func (s *StratumServer) newJob() error {
+	tmpl := s.peer.Chain.GetBlockTemplate(0, s.peer.Config.MaxNBits)
+	coinbase := makeCoinbase(tmpl.Height, 0, s.Pk_script)
+	raw, err := utils.GetBytes(&coinbase)
+	if err != nil {
+		return err
+	}
+	hashes := make([][32]byte, len(tmpl.Txns)+1)
+	for i := range tmpl.Txns {
+		hashes[i+1], _ = utils.GetHash(&tmpl.Txns[i])
+	}
+	s.jobSeq++
+	job := &stratumJob{
+		id:          strconv.FormatUint(s.jobSeq, 16),
+		tmpl:        tmpl,
+		coinb1:      raw[:coinbaseExtraNonceOffset],
+		coinb2:      raw[coinbaseExtraNonceOffset+ExtraNonceSize:],
+		branch:      message.MerkleBranch(hashes),
+		submissions: make(map[string]void),
+	}
+	// old jobs are useless once the previous block changes
+	if s.curJob != nil && s.curJob.tmpl.PreviousHash != tmpl.PreviousHash {
+		s.jobs = make(map[string]*stratumJob)
+	}
+	s.jobs[job.id] = job
+	s.curJob = job
+	return nil
+}
+
+// The caller must hold s.lock
+func (s *StratumServer) broadcastJob() {
+	params := s.curJob.notifyParams(true)
+	for sess := range s.sessions {
+		if sess.subscribed {
+			go sess.notify("mining.notify", params)
+		}
+	}
+}
+
+func (j *stratumJob) notifyParams(clean bool) []interface{} {
+	branch := make([]string, len(j.branch))
+	for i := range j.branch {
+		branch[i] = hex.EncodeToString(j.branch[i][:])
+	}
+	return []interface{}{
+		j.id,
+		hex.EncodeToString(j.tmpl.PreviousHash[:]),
+		hex.EncodeToString(j.coinb1),
+		hex.EncodeToString(j.coinb2),
+		branch,
+		fmt.Sprintf("%08x", uint32(j.tmpl.Version)),
+		fmt.Sprintf("%08x", j.tmpl.NBits),
+		fmt.Sprintf("%08x", j.tmpl.CurTime),
+		clean,
+	}
+}
+
+func (s *StratumServer) GetWorkerStats() map[string]WorkerStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := make(map[string]WorkerStats)
+	for name, v := range s.workers {
+		ret[name] = *v
+	}
+	return ret
+}
+
+func (sess *stratumSession) serve() {
+	scanner := bufio.NewScanner(sess.conn)
+	for scanner.Scan() {
+		var req stratumRequest
+		err := json.Unmarshal(scanner.Bytes(), &req)
+		if err != nil {
+			minerLog.Warn("Malformed stratum request", "addr", sess.conn.RemoteAddr(), "err", err)
+			break
+		}
+		result, errCode, errMsg := sess.dispatch(req)
+		var resp stratumResponse
+		resp.ID = req.ID
+		if errCode != 0 {
+			resp.Error = []interface{}{errCode, errMsg, nil}
+		} else {
+			resp.Result = result
+		}
+		if sess.write(resp) != nil {
+			break
+		}
+		if req.Method == "mining.subscribe" && errCode == 0 {
+			sess.server.lock.Lock()
+			params := sess.server.curJob.notifyParams(true)
+			sess.server.lock.Unlock()
+			sess.notify("mining.set_difficulty", []interface{}{utils.Difficulty(sess.server.ShareNBits)})
+			sess.notify("mining.notify", params)
+		}
+	}
+	sess.server.lock.Lock()
+	delete(sess.server.sessions, sess)
+	sess.server.lock.Unlock()
+	sess.conn.Close()
+	minerLog.Info("Stratum connection ended", "addr", sess.conn.RemoteAddr())
+}
+
+func (sess *stratumSession) write(v interface{}) (err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	sess.writeLock.Lock()
+	defer sess.writeLock.Unlock()
+	_, err = sess.conn.Write(append(data, '\n'))
+	return
+}
+
+func (sess *stratumSession) notify(method string, params []interface{}) {
+	sess.write(stratumNotification{ID: nil, Method: method, Params: params})
+}
+
+func (sess *stratumSession) dispatch(req stratumRequest) (result interface{}, errCode int, errMsg string) {
+	switch req.Method {
+	case "mining.subscribe":
+		sess.server.lock.Lock()
+		sess.subscribed = true
+		sess.server.lock.Unlock()
+		id := hex.EncodeToString(sess.extraNonce1)
+		result = []interface{}{
+			[][]string{{"mining.set_difficulty", id}, {"mining.notify", id}},
+			id,
+			StratumExtraNonce2Size,
+		}
+	case "mining.authorize":
+		var name string
+		if len(req.Params) < 1 || json.Unmarshal(req.Params[0], &name) != nil {
+			return nil, stratumErrOther, "Usage: mining.authorize [worker, password]"
+		}
+		// anyone can mine for this node, the password is not checked
+		sess.authorized[name] = void_null
+		sess.server.lock.Lock()
+		if _, ok := sess.server.workers[name]; !ok {
+			sess.server.workers[name] = new(WorkerStats)
+		}
+		sess.server.lock.Unlock()
+		minerLog.Info("Stratum worker authorized", "worker", name)
+		result = true
+	case "mining.submit":
+		var params [5]string
+		if len(req.Params) < 5 {
+			return nil, stratumErrOther, "Usage: mining.submit [worker, job_id, extranonce2, ntime, nonce]"
+		}
+		for i := range params {
+			if json.Unmarshal(req.Params[i], &params[i]) != nil {
+				return nil, stratumErrOther, "Parameters should be strings"
+			}
+		}
+		if _, ok := sess.authorized[params[0]]; !ok {
+			return nil, stratumErrUnauthorized, "Unauthorized worker"
+		}
+		errCode, errMsg = sess.server.submit(sess, params)
+		result = errCode == 0
+	default:
+		return nil, stratumErrOther, "Unknown method"
+	}
+	return
+}
+
+func (s *StratumServer) submit(sess *stratumSession, params [5]string) (errCode int, errMsg string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := s.workers[params[0]]
+	errCode, errMsg = s.checkShare(sess, params, stats)
+	if errCode != 0 {
+		stats.Rejected++
+		minerLog.Info("Share rejected", "worker", params[0], "reason", errMsg)
+	} else {
+		stats.Accepted++
+		stats.LastShare = time.Now()
+	}
+	return
+}
+
+// The caller must hold s.lock
+func (s *StratumServer) checkShare(sess *stratumSession, params [5]string, stats *WorkerStats) (errCode int, errMsg string) {
+	job, ok := s.jobs[params[1]]
+	if !ok {
+		return stratumErrJobNotFound, "Job not found"
+	}
+	extraNonce2, err := hex.DecodeString(params[2])
+	if err != nil || len(extraNonce2) != StratumExtraNonce2Size {
+		return stratumErrOther, "Invalid extranonce2"
+	}
+	ntime, err := strconv.ParseUint(params[3], 16, 32)
+	if err != nil {
+		return stratumErrOther, "Invalid ntime"
+	}
+	if uint32(ntime) < job.tmpl.CurTime || int64(ntime) > utils.Now().Unix()+7200 {
+		return stratumErrOther, "ntime out of range"
+	}
+	nonce, err := strconv.ParseUint(params[4], 16, 32)
+	if err != nil {
+		return stratumErrOther, "Invalid nonce"
+	}
+	key := hex.EncodeToString(sess.extraNonce1) + params[2] + params[3] + params[4]
+	if _, ok := job.submissions[key]; ok {
+		return stratumErrDuplicate, "Duplicate share"
+	}
+	raw := bytes.Join([][]byte{job.coinb1, sess.extraNonce1, extraNonce2, job.coinb2}, []byte{})
+	var coinbase message.Transaction
+	err = coinbase.LoadBuffer(utils.NewBufReader(bytes.NewBuffer(raw)))
+	if err != nil {
+		return stratumErrOther, "Invalid coinbase"
+	}
+	header := message.Block{
+		Version:                    job.tmpl.Version,
+		Previous_block_header_hash: job.tmpl.PreviousHash,
+		Merkle_root_hash:           message.MerkleRootFromBranch(utils.Sha256Twice(raw), job.branch),
+		Time:                       uint32(ntime),
+		NBits:                      job.tmpl.NBits,
+		Nonce:                      uint32(nonce),
+	}
+	hash, err := utils.GetHash(&header)
+	if err != nil {
+		return stratumErrOther, err.Error()
+	}
+	if !utils.HasValidHash(hash, s.ShareNBits) {
+		return stratumErrLowDiff, "Low difficulty share"
+	}
+	job.submissions[key] = void_null
+	if utils.HasValidHash(hash, job.tmpl.NBits) {
+		blk := message.SerializedBlock{
+			Header:     header,
+			HeaderHash: hash,
+			Txns:       append([]message.Transaction{coinbase}, job.tmpl.Txns...),
+		}
+		err = s.peer.SubmitBlock(blk)
+		if err != nil {
+			minerLog.Warn("Block found by stratum worker is discarded", "worker", params[0], "err", err)
+		} else {
+			minerLog.Info("Block found by stratum worker", "worker", params[0])
+			stats.Blocks++
+		}
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sshockwave/bitebi/p2p"
+)
+
+func TestStratumClose(t *testing.T) {
+	interval := StratumPollInterval
+	StratumPollInterval = 10 * time.Millisecond
+	defer func() { StratumPollInterval = interval }()
+	var chain BlockChain
+	var wallet Wallet
+	wallet.Init(&chain)
+	chain.init(&wallet)
+	p, err := NewPeer(&chain, p2p.GetRegtest(), "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer p.ln.Close()
+	s, err := NewStratumServer(p, pk_script2, "127.0.0.1:0", DefaultShareNBits)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	addr := s.ln.Addr().String()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	// a new block makes a new job while the server polls
+	if _, err := p.Generate(1, 0, pk_script2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		s.lock.Lock()
+		seq := s.jobSeq
+		s.lock.Unlock()
+		if seq > 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expect a new job for the new block")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Expect the miner disconnected")
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatalf("Expect the server to stop listening")
+	}
+}
@@ -1,4 +1,4 @@
 source ~/.bashrc
 cd ~/data/bitebi
 conda activate go
-go run ./... < testcase/peer1.txt
+go run . < testcase/peer1.txt
@@ -14,6 +14,15 @@ func NewBufReader(src io.Reader) BufReader {
     return BufReader{src}
 }
 
+// The bytes left to read, false if the source cannot tell
+func (b *BufReader) Remaining() (int, bool) {
+    src, ok := b.src.(interface{ Len() int })
+    if !ok {
+        return 0, false
+    }
+    return src.Len(), true
+}
+
 func (b *BufReader) ReadBytes(n int) (data []byte, err error){
     data = make([]byte, n)
     n, err = io.ReadFull(b.src, data)
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Source of the current time, so that tests and regtest can control it
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// A clock that only moves when told to
+type MockClock struct {
+	mtx sync.Mutex
+	t   time.Time
+}
+
+func NewMockClock(t time.Time) *MockClock {
+	return &MockClock{t: t}
+}
+
+func (c *MockClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.t
+}
+
+func (c *MockClock) Set(t time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.t = t
+}
+
+func (c *MockClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.t = c.t.Add(d)
+}
+
+var clockMtx sync.RWMutex
+var clock Clock = systemClock{}
+
+// Replace the clock, nil restores the system clock
+func SetClock(c Clock) {
+	clockMtx.Lock()
+	defer clockMtx.Unlock()
+	if c == nil {
+		c = systemClock{}
+	}
+	clock = c
+}
+
+func Now() time.Time {
+	clockMtx.RLock()
+	defer clockMtx.RUnlock()
+	return clock.Now()
+}
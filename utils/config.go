@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const ConfigFileName = "bitebi.conf"
+
+// Where the node keeps its config file and data, ~/.bitebi
+func DefaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".bitebi"
+	}
+	return filepath.Join(home, ".bitebi")
+}
+
+// One "key=value" line of a config file
+type ConfigEntry struct {
+	Key   string
+	Value string
+	Line  int
+}
+
+// Config files have one "key=value" per line, '#' starts a comment.
+// A key without a value is read as "1", which turns on boolean options.
+func ReadConfigFile(path string) (entries []ConfigEntry, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		entry := ConfigEntry{Value: "1", Line: line}
+		if i := strings.IndexByte(text, '='); i >= 0 {
+			entry.Key = strings.TrimSpace(text[:i])
+			entry.Value = strings.TrimSpace(text[i+1:])
+		} else {
+			entry.Key = text
+		}
+		entries = append(entries, entry)
+	}
+	err = scanner.Err()
+	return
+}
+
+// Set the flags found in a config file, except those given on the command line.
+// Unknown keys are errors unless ignoreUnknown is set,
+// so that several programs can share one file.
+func ApplyConfigFile(fs *flag.FlagSet, path string, ignoreUnknown bool) error {
+	entries, err := ReadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for _, e := range entries {
+		if fs.Lookup(e.Key) == nil {
+			if ignoreUnknown {
+				continue
+			}
+			return fmt.Errorf("%v:%v: unknown option %v", path, e.Line, e.Key)
+		}
+		if given[e.Key] {
+			continue
+		}
+		err = fs.Set(e.Key, e.Value)
+		if err != nil {
+			return fmt.Errorf("%v:%v: %v", path, e.Line, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+// Golomb-coded sets, the compact probabilistic sets of BIP158 block filters.
+// Items are hashed into [0, N*M), sorted, and the differences are written
+// with Golomb-Rice coding of parameter P.
+// https://github.com/bitcoin/bips/blob/master/bip-0158.mediawiki
+
+var gcsTruncated = errors.New("gcsTruncated")
+
+type bitWriter struct {
+	data []byte
+	// bits used in the last byte
+	used uint
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		if w.used%8 == 0 {
+			w.data = append(w.data, 0)
+			w.used = 0
+		}
+		n--
+		if (v>>n)&1 == 1 {
+			w.data[len(w.data)-1] |= 0x80 >> w.used
+		}
+		w.used++
+	}
+}
+
+type bitReader struct {
+	data []byte
+	pos  uint
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= uint(len(r.data))*8 {
+		return false, gcsTruncated
+	}
+	b := r.data[r.pos/8]&(0x80>>(r.pos%8)) != 0
+	r.pos++
+	return b, nil
+}
+
+func (r *bitReader) readBits(n uint) (v uint64, err error) {
+	for ; n > 0; n-- {
+		var b bool
+		b, err = r.readBit()
+		if err != nil {
+			return
+		}
+		v <<= 1
+		if b {
+			v |= 1
+		}
+	}
+	return
+}
+
+func (r *bitReader) readGolombRice(p uint8) (v uint64, err error) {
+	var q uint64
+	for {
+		var b bool
+		b, err = r.readBit()
+		if err != nil {
+			return
+		}
+		if !b {
+			break
+		}
+		q++
+	}
+	v, err = r.readBits(uint(p))
+	return q<<p | v, err
+}
+
+// Hashes of the items in [0, f), sorted
+func gcsHashes(f uint64, k0, k1 uint64, items [][]byte) []uint64 {
+	ret := make([]uint64, len(items))
+	for i, item := range items {
+		// map the hash to the range by taking the high bits of the product
+		ret[i], _ = bits.Mul64(SipHash24(k0, k1, item), f)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// Encode a set, duplicated items are only taken once.
+// The result starts with the number of items.
+func BuildGCS(p uint8, m uint64, k0, k1 uint64, items [][]byte) []byte {
+	set := make(map[string]bool, len(items))
+	unique := make([][]byte, 0, len(items))
+	for _, item := range items {
+		if set[string(item)] {
+			continue
+		}
+		set[string(item)] = true
+		unique = append(unique, item)
+	}
+	writer := NewBufWriter()
+	writer.WriteCompactUint(uint64(len(unique)))
+	var w bitWriter
+	var last uint64
+	for _, v := range gcsHashes(uint64(len(unique))*m, k0, k1, unique) {
+		delta := v - last
+		last = v
+		for q := delta >> p; q > 0; q-- {
+			w.writeBits(1, 1)
+		}
+		w.writeBits(0, 1)
+		w.writeBits(delta, uint(p))
+	}
+	return append(writer.Collect(), w.data...)
+}
+
+// Whether any of the items may be in the set
+func MatchGCS(p uint8, m uint64, k0, k1 uint64, filter []byte, items [][]byte) (bool, error) {
+	buf := bytes.NewBuffer(filter)
+	reader := NewBufReader(buf)
+	n, err := reader.ReadCompactUint()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 || len(items) == 0 {
+		return false, nil
+	}
+	// in the range of the filter, not of the items
+	queries := gcsHashes(n*m, k0, k1, items)
+	r := bitReader{data: buf.Bytes()}
+	var value uint64
+	for i := uint64(0); i < n; i++ {
+		var delta uint64
+		delta, err = r.readGolombRice(p)
+		if err != nil {
+			return false, err
+		}
+		value += delta
+		for len(queries) > 0 && queries[0] < value {
+			queries = queries[1:]
+		}
+		if len(queries) == 0 {
+			return false, nil
+		}
+		if queries[0] == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -2,6 +2,9 @@ package utils
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
 )
 
 func Sha256Twice(data []byte) [32]byte {
@@ -48,3 +51,63 @@ func HasValidHash(hash [32]byte, nBits uint32) bool {
 	}
 	return true
 }
+
+// Hashes are displayed in reversed byte order, as bitcoin does
+func HashToString(hash [32]byte) string {
+	for a, b := 0, 31; a < b; a, b = a+1, b-1 {
+		hash[a], hash[b] = hash[b], hash[a]
+	}
+	return hex.EncodeToString(hash[:])
+}
+
+var HashStringLengthError = errors.New("HashStringLengthError")
+
+// Inverse of HashToString
+func StringToHash(s string) (hash [32]byte, err error) {
+	var data []byte
+	data, err = hex.DecodeString(s)
+	if err != nil {
+		return
+	}
+	if len(data) != 32 {
+		err = HashStringLengthError
+		return
+	}
+	for i := range data {
+		hash[31-i] = data[i]
+	}
+	return
+}
+
+// The target encoded in nBits, in the scale of hashes read as little endian
+func NBitsToTarget(nBits uint32) *big.Int {
+	exp := nBits >> 24
+	target := big.NewInt(int64(nBits & ((1 << 24) - 1)))
+	if exp < 3 {
+		return target.Rsh(target, uint(8*(3-exp)))
+	}
+	return target.Lsh(target, uint(8*(exp-3)))
+}
+
+// Whether nBits has a larger target than limit, which takes less work to meet
+func EasierThan(nBits uint32, limit uint32) bool {
+	return NBitsToTarget(nBits).Cmp(NBitsToTarget(limit)) > 0
+}
+
+var diff1Target = NBitsToTarget(0x1d00ffff)
+
+// How many times harder nBits is than the easiest mainnet target
+func Difficulty(nBits uint32) float64 {
+	quo := new(big.Float).SetInt(diff1Target)
+	quo.Quo(quo, new(big.Float).SetInt(NBitsToTarget(nBits)))
+	res, _ := quo.Float64()
+	return res
+}
+
+var two256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// Expected number of hashes to meet nBits, the chain with the most of it wins
+func Work(nBits uint32) *big.Int {
+	target := NBitsToTarget(nBits)
+	return target.Div(two256, target.Add(target, big.NewInt(1)))
+}
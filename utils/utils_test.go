@@ -1,8 +1,12 @@
 package utils
 
 import (
+	"flag"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 // https://developer.bitcoin.org/reference/p2p_networking.html#message-headers
@@ -33,3 +37,111 @@ func TestHashNBits(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestHashString(t *testing.T) {
+	hash := [32]byte{0x01, 0x02, 31: 0xff}
+	s := HashToString(hash)
+	if s[:2] != "ff" || s[62:] != "01" {
+		t.Fatalf("Expect reversed byte order, %v found", s)
+	}
+	res, err := StringToHash(s)
+	if err != nil || res != hash {
+		t.Fatalf("Expect %v, %v found", hash, res)
+	}
+	if _, err = StringToHash("00ff"); err == nil {
+		t.Fatal()
+	}
+}
+
+func TestDifficulty(t *testing.T) {
+	if Difficulty(0x1d00ffff) != 1 {
+		t.Fatalf("Expect difficulty 1, %v found", Difficulty(0x1d00ffff))
+	}
+	if Difficulty(0x1c00ffff) != 256 {
+		t.Fatalf("Expect difficulty 256, %v found", Difficulty(0x1c00ffff))
+	}
+	if NBitsToTarget(0x03001000).Int64() != 0x1000 {
+		t.Fatal()
+	}
+	if !EasierThan(0x1d00ffff, 0x1c00ffff) || EasierThan(0x1c00ffff, 0x1d00ffff) || EasierThan(0x1d00ffff, 0x1d00ffff) {
+		t.Fatalf("Smaller targets should be harder")
+	}
+	// the work of Bitcoin's genesis block
+	if Work(0x1d00ffff).Int64() != 0x100010001 {
+		t.Fatalf("Unexpected work %x", Work(0x1d00ffff))
+	}
+}
+
+// Test vectors from the SipHash reference implementation,
+// key 00 01 ... 0f and messages 00 01 ... of each length
+func TestSipHash(t *testing.T) {
+	k0, k1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	data := make([]byte, 15)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	expect := map[int]uint64{0: 0x726fdb47dd0e0e31, 8: 0x93f5f5799a932462, 15: 0xa129ca6149be45e5}
+	for n, v := range expect {
+		if h := SipHash24(k0, k1, data[:n]); h != v {
+			t.Fatalf("Expect %x for %v bytes, %x found", v, n, h)
+		}
+	}
+}
+
+// Test vectors from Bitcoin Core's hash_tests.cpp
+func TestMurmur3(t *testing.T) {
+	cases := []struct {
+		seed   uint32
+		data   []byte
+		expect uint32
+	}{
+		{0x00000000, []byte{}, 0x00000000},
+		{0xfba4c795, []byte{}, 0x6a396f08},
+		{0xffffffff, []byte{}, 0x81f16f39},
+		{0x00000000, []byte{0x00}, 0x514e28b7},
+		{0xfba4c795, []byte{0x00}, 0xea3f0b17},
+		{0x00000000, []byte{0xff}, 0xfd6cf10d},
+		{0x00000000, []byte{0x00, 0x11}, 0x16c6b7ab},
+		{0x00000000, []byte{0x00, 0x11, 0x22}, 0x8eb51c3d},
+		{0x00000000, []byte{0x00, 0x11, 0x22, 0x33}, 0xb4471bf8},
+	}
+	for _, c := range cases {
+		if h := Murmur3(c.seed, c.data); h != c.expect {
+			t.Fatalf("Expect %08x for %x with seed %08x, %08x found", c.expect, c.data, c.seed, h)
+		}
+	}
+}
+
+func TestMockClock(t *testing.T) {
+	c := NewMockClock(time.Unix(1000, 0))
+	SetClock(c)
+	defer SetClock(nil)
+	c.Advance(time.Minute)
+	if Now().Unix() != 1060 {
+		t.Fatalf("Expect 1060, %v found", Now().Unix())
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ConfigFileName)
+	conf := "# comment\nport = 8333\ndaemon\naddnode=1.2.3.4:8333 # inline\nrpcuser=alice\n"
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.Int("port", 0, "")
+	daemon := fs.Bool("daemon", false, "")
+	addnode := fs.String("addnode", "", "")
+	if err := fs.Parse([]string{"-port", "18444"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := ApplyConfigFile(fs, path, false); err == nil {
+		t.Fatalf("Unknown option rpcuser should be rejected")
+	}
+	if err := ApplyConfigFile(fs, path, true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if *port != 18444 || !*daemon || *addnode != "1.2.3.4:8333" {
+		t.Fatalf("Unexpected values: %v %v %v", *port, *daemon, *addnode)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"crypto/dsa"
-	"log"
 	"sync"
 
 	"github.com/sshockwave/bitebi/message"
@@ -39,7 +38,7 @@ func (w *Wallet) AddPubKey(name string, pub dsa.PublicKey) {
 		if ret == pub {
 			return
 		}
-		log.Printf("[ERROR] Name %v has an existing pubkey: %v", name, string(PK2Bytes(pub)))
+		walletLog.Error("Name has an existing pubkey", "name", name, "pubkey", string(PK2Bytes(pub)))
 		return
 	}
 	w.Pubkey[name] = pub
@@ -52,31 +51,105 @@ func (w *Wallet) AddPrivKey(name string, prv dsa.PrivateKey) {
 		if ret.key == prv {
 			return
 		}
-		log.Printf("[ERROR] Name %v has an existing privkey: %v", name, string(SK2Bytes(prv)))
+		walletLog.Error("Name has an existing privkey", "name", name)
 		return
 	}
 	if pub, ok := w.Pubkey[name]; ok && pub != prv.PublicKey {
-		log.Printf("[ERROR] Name %v has an existing pubkey: %v", name, string(PK2Bytes(pub)))
+		walletLog.Error("Name has an existing pubkey", "name", name, "pubkey", string(PK2Bytes(pub)))
 	}
 	var ac Account
 	ac.name = name
 	ac.key = prv
 	ac.UTXO = make(map[message.Outpoint]void)
-	self_script := string(PK2Bytes(ac.key.PublicKey))
-	for outPoint, val := range w.blockchain.UTXO {
-		if !val {
-			continue
-		}
-		pk_script := w.blockchain.TX[outPoint.Hash].Tx_out[outPoint.Index].Pk_script
-		if string(pk_script) == self_script {
-			ac.UTXO[outPoint] = void_null
-		}
-	}
+	w.rescan(&ac)
 	w.Accounts[name] = &ac
 	w.Pubkey[name] = prv.PublicKey
 	w.keyowner[string(PK2Bytes(prv.PublicKey))] = &ac
 }
 
+// Find the unspent outputs of an account, using the address index
+// or the block filters if there is one
+func (w *Wallet) rescan(acc *Account) { // WARN: no lock!
+	b := w.blockchain
+	addr := string(PK2Bytes(acc.key.PublicKey))
+	idx := b.GetAddrIndex()
+	if idx == nil {
+		if filters := b.GetCFilterIndex(); filters != nil {
+			w.rescanFiltered(acc, filters)
+			return
+		}
+		for outPoint, val := range b.UTXO {
+			if !val {
+				continue
+			}
+			pk_script := b.TX[outPoint.Hash].Tx_out[outPoint.Index].Pk_script
+			if ScriptAddress(pk_script) == addr {
+				acc.UTXO[outPoint] = void_null
+			}
+		}
+		return
+	}
+	for _, e := range idx.Unspent(addr) {
+		if b.UTXO[e.Outpoint] {
+			acc.UTXO[e.Outpoint] = void_null
+		}
+	}
+	// the index only covers confirmed transactions
+	for hash, tx := range b.Mempool {
+		w.findOutputs(acc, addr, hash, &tx)
+	}
+}
+
+// Only the blocks whose filters may pay the account are read
+func (w *Wallet) rescanFiltered(acc *Account, filters *CFilterIndex) {
+	b := w.blockchain
+	addr := string(PK2Bytes(acc.key.PublicKey))
+	script := [][]byte{GenerateP2PKHPkScript(acc.key.PublicKey)}
+	for height := range b.Block {
+		blk := &b.Block[height]
+		filter, _, ok := filters.Filter(height)
+		if ok {
+			match, err := message.MatchBasicFilter(blk.HeaderHash, filter, script)
+			if err == nil && !match {
+				continue
+			}
+		}
+		for i := range blk.Txns {
+			hash, err := utils.GetHash(&blk.Txns[i])
+			if err != nil {
+				continue
+			}
+			w.findOutputs(acc, addr, hash, &blk.Txns[i])
+		}
+	}
+	// filters only cover blocks
+	for hash, tx := range b.Mempool {
+		w.findOutputs(acc, addr, hash, &tx)
+	}
+}
+
+// Add the unspent outputs of tx paying addr to the account
+func (w *Wallet) findOutputs(acc *Account, addr string, hash [32]byte, tx *message.Transaction) {
+	for i, o := range tx.Tx_out {
+		outPoint := message.NewOutPoint(hash, uint32(i))
+		if w.blockchain.UTXO[outPoint] && ScriptAddress(o.Pk_script) == addr {
+			acc.UTXO[outPoint] = void_null
+		}
+	}
+}
+
+func (w *Wallet) Rescan(name string) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	acc, ok := w.Accounts[name]
+	if !ok {
+		return false
+	}
+	acc.UTXO = make(map[message.Outpoint]void)
+	w.rescan(acc)
+	return true
+}
+
 func (w *Wallet) OnTX(tx *message.Transaction) { // WARN: no lock!
 	hash, _ := utils.GetHash(tx)
 	for i, o := range tx.Tx_out {
@@ -86,8 +159,9 @@ func (w *Wallet) OnTX(tx *message.Transaction) { // WARN: no lock!
 		}
 		acc, ok := w.keyowner[string(PK2Bytes(pk_script[0]))]
 		if ok {
-			log.Printf("[INFO] New balance for %v: %v", acc.name, o.Value)
+			walletLog.Info("New balance", "account", acc.name, "value", o.Value)
 			acc.UTXO[message.NewOutPoint(hash, uint32(i))] = void_null
+			w.blockchain.Events.Publish(TopicWalletBalance, BalanceEvent{acc.name, w.balance(acc)})
 		}
 	}
 }
@@ -128,6 +202,7 @@ func (w *Wallet) RemoveUTXO(name string, remove_list []message.Outpoint) {
 	for _, o := range remove_list {
 		delete(acc.UTXO, o)
 	}
+	w.blockchain.Events.Publish(TopicWalletBalance, BalanceEvent{acc.name, w.balance(acc)})
 }
 
 func (w *Wallet) GetSK(name string) (sk dsa.PrivateKey, ok bool) {
@@ -141,6 +216,23 @@ func (w *Wallet) GetSK(name string) (sk dsa.PrivateKey, ok bool) {
 	return acc.key, true
 }
 
+func (w *Wallet) GetPK(name string) (pk dsa.PublicKey, ok bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	pk, ok = w.Pubkey[name]
+	return
+}
+
+// Encoded public keys of the accounts we have private keys for
+func (w *Wallet) OwnedPubkeys() (ret [][]byte) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for pk := range w.keyowner {
+		ret = append(ret, []byte(pk))
+	}
+	return
+}
+
 func (w *Wallet) GetBalance(name string) (sum int64) {
 	w.mtx.Lock()
 	defer w.mtx.Unlock()
@@ -148,6 +240,10 @@ func (w *Wallet) GetBalance(name string) (sum int64) {
 	if !ok {
 		return
 	}
+	return w.balance(acc)
+}
+
+func (w *Wallet) balance(acc *Account) (sum int64) { // WARN: no lock!
 	for oput, _ := range acc.UTXO {
 		if ok1, ok2 := w.blockchain.UTXO[oput]; !ok1 || !ok2 {
 			continue
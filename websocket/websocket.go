@@ -0,0 +1,256 @@
+// Server side of the WebSocket protocol, enough for pushing JSON events.
+// https://datatracker.ietf.org/doc/html/rfc6455
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Opcodes
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// Status codes sent in close frames
+const (
+	CloseNormal        = 1000
+	CloseProtocolError = 1002
+	CloseTooBig        = 1009
+)
+
+// Messages larger than this close the connection
+const MaxMessageSize = 1 << 20
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrNotWebSocket = errors.New("not a websocket handshake")
+var ErrProtocol = errors.New("websocket protocol error")
+var ErrTooBig = errors.New("websocket message too big")
+var ErrClosed = errors.New("websocket closed")
+
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// writes come from several goroutines
+	wmtx   sync.Mutex
+	closed bool
+}
+
+func headerContains(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// Take over an HTTP connection after the opening handshake
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-Websocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a websocket handshake", http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrNotWebSocket
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Cannot upgrade this connection", http.StatusInternalServerError)
+		return nil, ErrNotWebSocket
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	_, err = conn.Write([]byte(resp))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, reader: rw.Reader}, nil
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	// servers never mask their frames
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n < 1<<16:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	_, err := c.conn.Write(append(header, payload...))
+	if opcode == OpClose {
+		c.closed = true
+	}
+	return err
+}
+
+func (c *Conn) WriteMessage(opcode byte, data []byte) error {
+	return c.writeFrame(opcode, data)
+}
+
+func (c *Conn) WriteText(data []byte) error {
+	return c.writeFrame(OpText, data)
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	_, err = io.ReadFull(c.reader, head[:])
+	if err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	if head[0]&0x70 != 0 || head[1]&0x80 == 0 {
+		// no extensions are negotiated, and clients must mask
+		err = ErrProtocol
+		return
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return
+	}
+	if opcode >= OpClose && (n > 125 || !fin) {
+		err = ErrProtocol
+		return
+	}
+	if n > MaxMessageSize {
+		err = ErrTooBig
+		return
+	}
+	var mask [4]byte
+	_, err = io.ReadFull(c.reader, mask[:])
+	if err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	_, err = io.ReadFull(c.reader, payload)
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// Read the next data message, answering pings and close frames on the way.
+// io.EOF is returned after the peer closes the connection.
+func (c *Conn) ReadMessage() (opcode byte, data []byte, err error) {
+	for {
+		var fin bool
+		var op byte
+		var payload []byte
+		fin, op, payload, err = c.readFrame()
+		if err == ErrProtocol {
+			c.CloseWithStatus(CloseProtocolError)
+		} else if err == ErrTooBig {
+			c.CloseWithStatus(CloseTooBig)
+		}
+		if err != nil {
+			return
+		}
+		switch op {
+		case OpPing:
+			err = c.writeFrame(OpPong, payload)
+			if err != nil {
+				return
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			c.writeFrame(OpClose, payload)
+			c.conn.Close()
+			return 0, nil, io.EOF
+		case OpContinuation:
+			if opcode == 0 {
+				c.CloseWithStatus(CloseProtocolError)
+				return 0, nil, ErrProtocol
+			}
+		case OpText, OpBinary:
+			if opcode != 0 {
+				c.CloseWithStatus(CloseProtocolError)
+				return 0, nil, ErrProtocol
+			}
+			opcode = op
+		default:
+			c.CloseWithStatus(CloseProtocolError)
+			return 0, nil, ErrProtocol
+		}
+		if len(data)+len(payload) > MaxMessageSize {
+			c.CloseWithStatus(CloseTooBig)
+			return 0, nil, ErrTooBig
+		}
+		data = append(data, payload...)
+		if fin {
+			return
+		}
+	}
+}
+
+func (c *Conn) CloseWithStatus(status uint16) error {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], status)
+	c.writeFrame(OpClose, payload[:])
+	return c.conn.Close()
+}
+
+func (c *Conn) Close() error {
+	return c.CloseWithStatus(CloseNormal)
+}
@@ -0,0 +1,76 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A masked client frame
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	head := opcode
+	if fin {
+		head |= 0x80
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{head, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	return frame
+}
+
+func TestEcho(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteText(data)
+		}
+	}))
+	defer server.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected handshake response: %v %v", resp, err)
+	}
+	// example from the RFC
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected accept key %v", accept)
+	}
+	// a fragmented message with a ping in between
+	conn.Write(clientFrame(false, OpText, []byte("Hel")))
+	conn.Write(clientFrame(true, OpPing, []byte("p")))
+	conn.Write(clientFrame(true, OpContinuation, []byte("lo")))
+	expect := [][]byte{{0x80 | OpPong, 1, 'p'}, {0x80 | OpText, 5, 'H', 'e', 'l', 'l', 'o'}}
+	for _, e := range expect {
+		buf := make([]byte, len(e))
+		if _, err = io.ReadFull(reader, buf); err != nil || !bytes.Equal(buf, e) {
+			t.Fatalf("Expect frame %v, %v found: %v", e, buf, err)
+		}
+	}
+	conn.Write(clientFrame(true, OpClose, []byte{0x03, 0xe8}))
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(reader, buf); err != nil || buf[0] != 0x80|OpClose {
+		t.Fatalf("Expect a close frame, %v found: %v", buf, err)
+	}
+}